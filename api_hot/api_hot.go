@@ -13,7 +13,6 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/idempotency"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/monitor"
 	"github.com/gofiber/fiber/v2/middleware/recover"
@@ -162,11 +161,14 @@ func main() {
 
 	auth := fiber.New()
 
-	auth.Use(limiter.New(limiter.Config{
-		Max:               30,
-		Expiration:        1 * time.Hour,
-		LimiterMiddleware: limiter.SlidingWindow{},
-	}))
+	// Limits are kept in redis so they hold across every replica
+	rateLimit := func(policy handlers.RateLimitPolicy) fiber.Handler {
+		return func(c *fiber.Ctx) error {
+			return handlers.RateLimit(c, ctx, wRdb, policy)
+		}
+	}
+
+	auth.Use(rateLimit(handlers.AuthRateLimit))
 
 	v1.Mount("/auth", auth)
 
@@ -210,6 +212,10 @@ func main() {
 		return handlers.CommunityUsers(c, ctx, db, wRdb, rRdb, queue)
 	})
 
+	v1.Get("/communities/:communityHandle/search", func(c *fiber.Ctx) error {
+		return handlers.SearchMessages(c, ctx, db, wRdb, rRdb, queue)
+	})
+
 	v1.Get("/communities/:communityHandle/channels/:channelHandle", func(c *fiber.Ctx) error {
 		return handlers.Channel(c, ctx, db, wRdb, rRdb, queue)
 	})
@@ -236,6 +242,14 @@ func main() {
 		return c.Next()
 	})
 
+	v1.Use(func(c *fiber.Ctx) error {
+		if c.Method() != fiber.MethodPost {
+			return c.Next()
+		}
+
+		return handlers.RateLimit(c, ctx, wRdb, handlers.WriteRateLimit)
+	})
+
 	v1.Post("/communities/create", func(c *fiber.Ctx) error {
 		return handlers.CreateCommunity(c, ctx, db, rRdb, queue)
 	})
@@ -245,7 +259,7 @@ func main() {
 	})
 
 	v1.Get("/me", func(c *fiber.Ctx) error {
-		return handlers.Me(c, ctx, db, rRdb, queue)
+		return handlers.Me(c, ctx, db, wRdb, rRdb, queue)
 	})
 
 	v1.Post("/me/update", func(c *fiber.Ctx) error {
@@ -260,10 +274,46 @@ func main() {
 		return handlers.EditProfilePicture(c, ctx, db, wRdb, rRdb, queue)
 	})
 
+	v1.Get("/me/mentions", func(c *fiber.Ctx) error {
+		return handlers.Mentions(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/me/mentions/read", func(c *fiber.Ctx) error {
+		return handlers.ReadMentions(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Get("/me/bookmarks", func(c *fiber.Ctx) error {
+		return handlers.Bookmarks(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/me/bookmarks/save", func(c *fiber.Ctx) error {
+		return handlers.SaveBookmark(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/me/bookmarks/unsave", func(c *fiber.Ctx) error {
+		return handlers.UnsaveBookmark(c, ctx, db, wRdb, rRdb, queue)
+	})
+
 	v1.Post("/communities/:handle/edit", func(c *fiber.Ctx) error {
 		return handlers.EditCommunity(c, ctx, db, wRdb, rRdb, queue)
 	})
 
+	v1.Get("/communities/:handle/emojis", func(c *fiber.Ctx) error {
+		return handlers.CommunityEmojis(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/emojis/create", func(c *fiber.Ctx) error {
+		return handlers.CreateCommunityEmoji(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/emojis/edit", func(c *fiber.Ctx) error {
+		return handlers.EditCommunityEmoji(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/emojis/delete", func(c *fiber.Ctx) error {
+		return handlers.DeleteCommunityEmoji(c, ctx, db, wRdb, rRdb, queue)
+	})
+
 	v1.Get("/communities/:handle/roles", func(c *fiber.Ctx) error {
 		return handlers.CommunityRoles(c, ctx, db, wRdb, rRdb, queue)
 	})
@@ -280,7 +330,7 @@ func main() {
 		return handlers.BanUser(c, ctx, db, wRdb, rRdb, queue)
 	})
 
-	v1.Post("/communities/:handle/invites/create", func(c *fiber.Ctx) error {
+	v1.Post("/communities/:handle/invites/create", rateLimit(handlers.InviteRateLimit), func(c *fiber.Ctx) error {
 		return handlers.CreateCommunityInvite(c, ctx, db, wRdb, rRdb, queue)
 	})
 
@@ -288,14 +338,62 @@ func main() {
 		return handlers.LeaveCommunity(c, ctx, db, wRdb, rRdb, queue)
 	})
 
-	v1.Post("/communities/:handle/join", func(c *fiber.Ctx) error {
+	v1.Post("/communities/:handle/join", rateLimit(handlers.JoinRateLimit), func(c *fiber.Ctx) error {
 		return handlers.JoinCommunity(c, ctx, db, wRdb, rRdb, queue)
 	})
 
+	v1.Get("/communities/:handle/automod/rules", func(c *fiber.Ctx) error {
+		return handlers.AutomodRules(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/automod/rules/create", func(c *fiber.Ctx) error {
+		return handlers.CreateAutomodRule(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/automod/rules/edit", func(c *fiber.Ctx) error {
+		return handlers.EditAutomodRule(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/automod/rules/delete", func(c *fiber.Ctx) error {
+		return handlers.DeleteAutomodRule(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Get("/communities/:handle/automod/flags", func(c *fiber.Ctx) error {
+		return handlers.AutomodFlags(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/reports/create", rateLimit(handlers.ReportRateLimit), func(c *fiber.Ctx) error {
+		return handlers.CreateReport(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Get("/communities/:handle/reports", func(c *fiber.Ctx) error {
+		return handlers.Reports(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/reports/resolve", func(c *fiber.Ctx) error {
+		return handlers.ResolveReport(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/reports/dismiss", func(c *fiber.Ctx) error {
+		return handlers.DismissReport(c, ctx, db, wRdb, rRdb, queue)
+	})
+
 	v1.Post("/communities/:handle/default-permissions/edit", func(c *fiber.Ctx) error {
 		return handlers.EditCommunityDefaultPermissions(c, ctx, db, wRdb, rRdb, queue)
 	})
 
+	v1.Get("/communities/:handle/permission-overwrites", func(c *fiber.Ctx) error {
+		return handlers.PermissionOverwrites(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/permission-overwrites/edit", func(c *fiber.Ctx) error {
+		return handlers.EditPermissionOverwrite(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/permission-overwrites/delete", func(c *fiber.Ctx) error {
+		return handlers.DeletePermissionOverwrite(c, ctx, db, wRdb, rRdb, queue)
+	})
+
 	v1.Get("/communities/:handle/roles/:roleId", func(c *fiber.Ctx) error {
 		return handlers.CommunityRole(c, ctx, db, wRdb, rRdb, queue)
 	})
@@ -324,6 +422,14 @@ func main() {
 		return handlers.ChannelSelect(c, ctx, db, wRdb, rRdb, queue)
 	})
 
+	v1.Post("/communities/:handle/channels/read", func(c *fiber.Ctx) error {
+		return handlers.ReadChannel(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/read", func(c *fiber.Ctx) error {
+		return handlers.ReadCommunity(c, ctx, db, wRdb, rRdb, queue)
+	})
+
 	v1.Post("/communities/:handle/channels/create", func(c *fiber.Ctx) error {
 		return handlers.CreateChannel(c, ctx, db, wRdb, rRdb, queue)
 	})
@@ -332,6 +438,10 @@ func main() {
 		return handlers.DeleteChannel(c, ctx, db, wRdb, rRdb, queue)
 	})
 
+	v1.Post("/communities/:handle/channels/reorder", func(c *fiber.Ctx) error {
+		return handlers.ReorderChannels(c, ctx, db, wRdb, rRdb, queue)
+	})
+
 	v1.Post("/communities/:handle/groups/create", func(c *fiber.Ctx) error {
 		return handlers.CreateGroup(c, ctx, db, wRdb, rRdb, queue)
 	})
@@ -344,7 +454,7 @@ func main() {
 		return handlers.DeleteGroup(c, ctx, db, wRdb, rRdb, queue)
 	})
 
-	v1.Post("/communities/:handle/messages/create", func(c *fiber.Ctx) error {
+	v1.Post("/communities/:handle/messages/create", rateLimit(handlers.MessageRateLimit), func(c *fiber.Ctx) error {
 		return handlers.CreateMessage(c, ctx, db, wRdb, rRdb, queue)
 	})
 
@@ -352,10 +462,54 @@ func main() {
 		return handlers.EditMessage(c, ctx, db, wRdb, rRdb, queue)
 	})
 
-	v1.Post("/communities/:handle/messages/react", func(c *fiber.Ctx) error {
+	v1.Post("/communities/:handle/messages/react", rateLimit(handlers.ReactionRateLimit), func(c *fiber.Ctx) error {
 		return handlers.ReactToMessage(c, ctx, db, wRdb, rRdb, queue)
 	})
 
+	v1.Post("/communities/:handle/messages/vote", func(c *fiber.Ctx) error {
+		return handlers.VotePoll(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Get("/communities/:handle/messages/scheduled", func(c *fiber.Ctx) error {
+		return handlers.ScheduledMessages(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/messages/schedule", rateLimit(handlers.MessageRateLimit), func(c *fiber.Ctx) error {
+		return handlers.ScheduleMessage(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/messages/scheduled/edit", func(c *fiber.Ctx) error {
+		return handlers.EditScheduledMessage(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/messages/scheduled/cancel", func(c *fiber.Ctx) error {
+		return handlers.CancelScheduledMessage(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/messages/delete", func(c *fiber.Ctx) error {
+		return handlers.DeleteMessage(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Get("/communities/:communityHandle/messages/:messageId/thread", func(c *fiber.Ctx) error {
+		return handlers.Thread(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Get("/communities/:communityHandle/messages/:messageId/revisions", func(c *fiber.Ctx) error {
+		return handlers.MessageRevisions(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/messages/pin", func(c *fiber.Ctx) error {
+		return handlers.PinMessage(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Post("/communities/:handle/messages/unpin", func(c *fiber.Ctx) error {
+		return handlers.UnpinMessage(c, ctx, db, wRdb, rRdb, queue)
+	})
+
+	v1.Get("/communities/:communityHandle/channels/:channelHandle/pins", func(c *fiber.Ctx) error {
+		return handlers.ChannelPins(c, ctx, db, wRdb, rRdb, queue)
+	})
+
 	port := ":3001"
 
 	if envPort := os.Getenv("PORT"); envPort != "" {
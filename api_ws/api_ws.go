@@ -345,6 +345,12 @@ func main() {
 							return // Calls the deferred unregister function
 						}
 
+						if !handlers.CanSubscribe(user.ID, topic, db, rdb, ctx) {
+							slog.Warn("Not allowed to subscribe to topic", slog.String("topic", topic))
+
+							continue
+						}
+
 						server.Subscribe <- chatserver.Message{
 							Topic:      topic,
 							UserID:     user.ID,
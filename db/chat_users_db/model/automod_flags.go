@@ -0,0 +1,20 @@
+package model
+
+import (
+	"time"
+)
+
+// A message let through but flagged by a rule for moderators to look at
+type AutomodFlags struct {
+	ID          uint64    `db:"id"`
+	CreatedAt   time.Time `db:"created_at"`
+	Salt        string    `db:"object_salt"`
+	CommunityID uint64    `db:"community_id"`
+	ChannelID   uint64    `db:"channel_id"`
+	MessageID   uint64    `db:"message_id"`
+	UserID      uint64    `db:"user_id"`
+	RuleID      uint64    `db:"rule_id"`
+	Text        string    `db:"text"`
+}
+
+var AUTOMOD_FLAGS_TYPE = "AutomodFlags"
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"maps"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/macwilko/exotic-auth/security_helpers"
+)
+
+// A content rule checked against every message sent or edited in the community.
+// Patterns are kept as a JSON array, threshold is a mention count or a caps percentage.
+type AutomodRules struct {
+	ID             uint64       `db:"id"`
+	CreatedAt      time.Time    `db:"created_at"`
+	UpdatedAt      sql.NullTime `db:"updated_at"`
+	Salt           string       `db:"object_salt"`
+	CommunityID    uint64       `db:"community_id"`
+	CreatedBy      uint64       `db:"created_by"`
+	Name           string       `db:"name"`
+	Kind           string       `db:"kind"`
+	Action         string       `db:"action"`
+	Patterns       string       `db:"patterns"`
+	Threshold      uint32       `db:"threshold"`
+	TimeoutSeconds uint32       `db:"timeout_seconds"`
+	Enabled        bool         `db:"enabled"`
+}
+
+const (
+	AUTOMOD_KEYWORD      = "keyword"
+	AUTOMOD_REGEX        = "regex"
+	AUTOMOD_LINK_ALLOW   = "link_allow"
+	AUTOMOD_LINK_DENY    = "link_deny"
+	AUTOMOD_MASS_MENTION = "mass_mention"
+	AUTOMOD_CAPS         = "caps"
+)
+
+const (
+	AUTOMOD_BLOCK   = "block"
+	AUTOMOD_FLAG    = "flag"
+	AUTOMOD_TIMEOUT = "timeout"
+)
+
+func (c AutomodRules) PatternList() []string {
+	patterns := []string{}
+
+	json.Unmarshal([]byte(c.Patterns), &patterns)
+
+	return patterns
+}
+
+func (c AutomodRules) ToFiberMap() fiber.Map {
+	m := fiber.Map{
+		"id":              security_helpers.Encode(c.ID, AUTOMOD_RULES_TYPE, c.Salt),
+		"created_at":      c.CreatedAt.Format(time.RFC3339),
+		"name":            c.Name,
+		"kind":            c.Kind,
+		"action":          c.Action,
+		"patterns":        c.PatternList(),
+		"threshold":       c.Threshold,
+		"timeout_seconds": c.TimeoutSeconds,
+		"enabled":         c.Enabled,
+	}
+
+	if c.UpdatedAt.Valid {
+		maps.Copy(m, fiber.Map{
+			"updated_at": c.UpdatedAt.Time.Format(time.RFC3339),
+		})
+	}
+
+	return m
+}
+
+var AUTOMOD_RULES_TYPE = "AutomodRules"
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"database/sql"
+	"maps"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/macwilko/exotic-auth/security_helpers"
+)
+
+// A message a user saved to come back to, with an optional note only they can see
+type Bookmarks struct {
+	ID          uint64         `db:"id"`
+	CreatedAt   time.Time      `db:"created_at"`
+	UpdatedAt   sql.NullTime   `db:"updated_at"`
+	Salt        string         `db:"object_salt"`
+	UserID      uint64         `db:"user_id"`
+	MessageID   uint64         `db:"message_id"`
+	ChannelID   uint64         `db:"channel_id"`
+	CommunityID uint64         `db:"community_id"`
+	Note        sql.NullString `db:"note"`
+}
+
+func (c Bookmarks) ToFiberMap() fiber.Map {
+	m := fiber.Map{
+		"id":         security_helpers.Encode(c.ID, BOOKMARKS_TYPE, c.Salt),
+		"created_at": c.CreatedAt.Format(time.RFC3339),
+		"note":       nil,
+	}
+
+	if c.Note.Valid {
+		m["note"] = c.Note.String
+	}
+
+	if c.UpdatedAt.Valid {
+		maps.Copy(m, fiber.Map{
+			"updated_at": c.UpdatedAt.Time.Format(time.RFC3339),
+		})
+	}
+
+	return m
+}
+
+var BOOKMARKS_TYPE = "Bookmarks"
@@ -12,6 +12,7 @@ type ChannelGroups struct {
 	CommunityID uint64       `db:"community_id"`
 	Salt        string       `db:"object_salt"`
 	Name        string       `db:"name"`
+	Position    uint32       `db:"position"`
 }
 
 var CHANNEL_GROUPS_TYPE = "ChannelGroup"
@@ -9,14 +9,30 @@ import (
 )
 
 type Channels struct {
-	ID          uint64       `db:"id"`
-	CreatedAt   time.Time    `db:"created_at"`
-	UpdatedAt   sql.NullTime `db:"updated_at"`
-	CommunityID uint64       `db:"community_id"`
-	GroupID     uint64       `db:"group_id"`
-	Salt        string       `db:"object_salt"`
-	Name        string       `db:"name"`
-	Handle      string       `db:"handle"`
+	ID              uint64       `db:"id"`
+	CreatedAt       time.Time    `db:"created_at"`
+	UpdatedAt       sql.NullTime `db:"updated_at"`
+	CommunityID     uint64       `db:"community_id"`
+	GroupID         uint64       `db:"group_id"`
+	Salt            string       `db:"object_salt"`
+	Name            string       `db:"name"`
+	Handle          string       `db:"handle"`
+	MaxPins         uint32       `db:"max_pins"`
+	RetentionDays   uint32       `db:"retention_days"`
+	LastSeq         uint64       `db:"last_seq"`
+	SlowModeSeconds uint32       `db:"slow_mode_seconds"`
+	Private         bool         `db:"private"`
+	Position        uint32       `db:"position"`
+}
+
+// Days messages are kept in the channel, 0 keeps them forever.
+// The shorter of the channel's and the community's settings wins.
+func (c Channels) EffectiveRetentionDays(community Communities) uint32 {
+	if c.RetentionDays == 0 || (community.RetentionDays > 0 && community.RetentionDays < c.RetentionDays) {
+		return community.RetentionDays
+	}
+
+	return c.RetentionDays
 }
 
 func (c Channels) ToFiberMap() fiber.Map {
@@ -25,6 +41,7 @@ func (c Channels) ToFiberMap() fiber.Map {
 		"created_at": c.CreatedAt.Format(time.RFC3339),
 		"name":       c.Name,
 		"handle":     c.Handle,
+		"private":    c.Private,
 	}
 }
 
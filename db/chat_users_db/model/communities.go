@@ -20,6 +20,7 @@ type Communities struct {
 	RailwayDeployStatus sql.NullString `db:"railway_deploy_status"`
 	CFRecordID          sql.NullString `db:"cf_fqn_zone_id"`
 	Ready               bool           `db:"ready"`
+	RetentionDays       uint32         `db:"retention_days"`
 	Permissions
 }
 
@@ -1,17 +1,32 @@
 package model
 
 import (
+	"database/sql"
 	"time"
 )
 
 type CommunitiesUsers struct {
-	CreatedAt         time.Time `db:"created_at"`
-	CommunityID       uint64    `db:"community_id"`
-	SelectedChannelID uint64    `db:"selected_channel_id"`
-	UserID            uint64    `db:"user_id"`
+	CreatedAt         time.Time    `db:"created_at"`
+	CommunityID       uint64       `db:"community_id"`
+	SelectedChannelID uint64       `db:"selected_channel_id"`
+	UserID            uint64       `db:"user_id"`
+	TimedOutUntil     sql.NullTime `db:"timed_out_until"`
 	Permissions
 }
 
+// Time left on the member's timeout, 0 when they aren't timed out
+func (c CommunitiesUsers) TimeoutRemaining() time.Duration {
+	if !c.TimedOutUntil.Valid {
+		return 0
+	}
+
+	if remaining := time.Until(c.TimedOutUntil.Time); remaining > 0 {
+		return remaining
+	}
+
+	return 0
+}
+
 func (c CommunitiesUsers) HasCommunityPermission(permission Permission) bool {
 	switch permission {
 	case ViewChannels:
@@ -30,6 +45,8 @@ func (c CommunitiesUsers) HasCommunityPermission(permission Permission) bool {
 		return c.SendMessages
 	case AttachMedia:
 		return c.AttachMedia
+	case MentionRoles:
+		return c.MentionRoles
 	default:
 		return false
 	}
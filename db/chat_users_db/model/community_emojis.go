@@ -0,0 +1,39 @@
+package model
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/macwilko/exotic-auth/security_helpers"
+)
+
+type CommunityEmojis struct {
+	ID          uint64       `db:"id"`
+	CreatedAt   time.Time    `db:"created_at"`
+	UpdatedAt   sql.NullTime `db:"updated_at"`
+	Salt        string       `db:"object_salt"`
+	CommunityID uint64       `db:"community_id"`
+	Name        string       `db:"name"`
+	FileID      uint64       `db:"file_id"`
+	CFImagesID  string       `db:"cf_images_id"`
+	CreatedBy   uint64       `db:"created_by"`
+}
+
+// How the emoji is written in message text and reactions
+func (c CommunityEmojis) Token() string {
+	return ":" + c.Name + ":"
+}
+
+func (c CommunityEmojis) ToFiberMap() fiber.Map {
+	return fiber.Map{
+		"id":         security_helpers.Encode(c.ID, COMMUNITY_EMOJIS_TYPE, c.Salt),
+		"created_at": c.CreatedAt.Format(time.RFC3339),
+		"name":       c.Name,
+		"token":      c.Token(),
+		"url":        os.Getenv("CLOUDFLARE_IMAGES_PROXY") + c.CFImagesID + "/public",
+	}
+}
+
+var COMMUNITY_EMOJIS_TYPE = "CommunityEmojis"
@@ -41,6 +41,7 @@ func (c CommunityRoles) ToFiberMap(showPermissions bool) fiber.Map {
 		"ban_members":      c.BanMembers,
 		"send_messages":    c.SendMessages,
 		"attach_media":     c.AttachMedia,
+		"mention_roles":    c.MentionRoles,
 	}
 
 	if showPermissions {
@@ -19,9 +19,17 @@ type Messages struct {
 	CommunityID uint64       `db:"community_id"`
 	Edited      bool         `db:"edited"`
 	ParentID    uint64       `db:"parent_id"`
+	Deleted     bool         `db:"deleted"`
+	DeletedAt   sql.NullTime `db:"deleted_at"`
+	DeletedBy   uint64       `db:"deleted_by"`
+	Seq         uint64       `db:"seq"`
 }
 
 func (c Messages) ToFiberMap() fiber.Map {
+	if c.Deleted {
+		return c.ToTombstoneFiberMap()
+	}
+
 	return fiber.Map{
 		"id":         security_helpers.Encode(c.ID, MESSAGES_TYPE, c.Salt),
 		"created_at": c.CreatedAt.Format(time.RFC3339),
@@ -30,4 +38,16 @@ func (c Messages) ToFiberMap() fiber.Map {
 	}
 }
 
+// A deleted message keeps its row so replies can still point at it,
+// but none of its content is exposed.
+func (c Messages) ToTombstoneFiberMap() fiber.Map {
+	return fiber.Map{
+		"id":         security_helpers.Encode(c.ID, MESSAGES_TYPE, c.Salt),
+		"created_at": c.CreatedAt.Format(time.RFC3339),
+		"text":       "",
+		"edited":     false,
+		"deleted":    true,
+	}
+}
+
 var MESSAGES_TYPE = "Messages"
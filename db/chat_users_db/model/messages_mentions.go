@@ -0,0 +1,23 @@
+package model
+
+import (
+	"time"
+)
+
+type MessagesMentions struct {
+	CreatedAt   time.Time `db:"created_at"`
+	MessageID   uint64    `db:"message_id"`
+	CommunityID uint64    `db:"community_id"`
+	ChannelID   uint64    `db:"channel_id"`
+	MentionType string    `db:"mention_type"`
+	TargetID    uint64    `db:"target_id"`
+	Token       string    `db:"token"`
+}
+
+const (
+	MENTION_USER    = "user"
+	MENTION_ROLE    = "role"
+	MENTION_CHANNEL = "channel"
+)
+
+var MESSAGES_MENTIONS_TYPE = "MessagesMentions"
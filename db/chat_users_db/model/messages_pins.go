@@ -0,0 +1,15 @@
+package model
+
+import (
+	"time"
+)
+
+type MessagesPins struct {
+	CreatedAt   time.Time `db:"created_at"`
+	MessageID   uint64    `db:"message_id"`
+	ChannelID   uint64    `db:"channel_id"`
+	CommunityID uint64    `db:"community_id"`
+	PinnedBy    uint64    `db:"pinned_by"`
+}
+
+var MESSAGES_PINS_TYPE = "MessagesPins"
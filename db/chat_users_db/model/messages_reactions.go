@@ -6,7 +6,8 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-// Stored in redis. This means we can quickly fetch message reactions without hitting the DB.
+// Cached in redis so we can quickly fetch message reactions without hitting the DB.
+// The reactions table is the source of truth, the cache is rebuilt from it when missing.
 
 // Each message can have a number of reactions (emojis, etc).
 // We store a map of unicode strings to users.
@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+)
+
+// The text a message had before one of its edits
+type MessagesRevisions struct {
+	ID          uint64    `db:"id"`
+	CreatedAt   time.Time `db:"created_at"`
+	MessageID   uint64    `db:"message_id"`
+	CommunityID uint64    `db:"community_id"`
+	ChannelID   uint64    `db:"channel_id"`
+	EditedBy    uint64    `db:"edited_by"`
+	Text        string    `db:"text"`
+}
+
+var MESSAGES_REVISIONS_TYPE = "MessagesRevisions"
@@ -0,0 +1,87 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Allows or denies permissions in one channel or channel group, for everyone, a role or a
+// single member. Exactly one of ChannelID and GroupID is set. Allow and Deny are masks of
+// Permission.Bit.
+type PermissionOverwrites struct {
+	ID          uint64       `db:"id"`
+	CreatedAt   time.Time    `db:"created_at"`
+	UpdatedAt   sql.NullTime `db:"updated_at"`
+	Salt        string       `db:"object_salt"`
+	CommunityID uint64       `db:"community_id"`
+	ChannelID   uint64       `db:"channel_id"`
+	GroupID     uint64       `db:"group_id"`
+	TargetType  string       `db:"target_type"`
+	TargetID    uint64       `db:"target_id"`
+	Allow       uint32       `db:"allow"`
+	Deny        uint32       `db:"deny"`
+}
+
+const (
+	OVERWRITE_EVERYONE = "everyone"
+	OVERWRITE_ROLE     = "role"
+	OVERWRITE_USER     = "user"
+)
+
+var PERMISSION_OVERWRITES_TYPE = "PermissionOverwrite"
+
+// Applies one channel's or group's overwrites. Everyone's overwrite goes first, then the
+// member's roles together, then the member's own, each one's denies before its allows.
+func ApplyOverwrites(bits uint32, overwrites []PermissionOverwrites, uId uint64, roleIds map[uint64]bool) uint32 {
+
+	var channelBits uint32
+
+	for _, p := range ChannelPermissions {
+		channelBits |= p.Bit()
+	}
+
+	apply := func(bits uint32, allow uint32, deny uint32) uint32 {
+		return (bits &^ (deny & channelBits)) | (allow & channelBits)
+	}
+
+	var roleAllow, roleDeny uint32
+	var everyone, own *PermissionOverwrites
+
+	for i, o := range overwrites {
+		switch o.TargetType {
+		case OVERWRITE_EVERYONE:
+			everyone = &overwrites[i]
+		case OVERWRITE_ROLE:
+			if roleIds[o.TargetID] {
+				roleAllow |= o.Allow
+				roleDeny |= o.Deny
+			}
+		case OVERWRITE_USER:
+			if uId > 0 && o.TargetID == uId {
+				own = &overwrites[i]
+			}
+		}
+	}
+
+	if everyone != nil {
+		bits = apply(bits, everyone.Allow, everyone.Deny)
+	}
+
+	bits = apply(bits, roleAllow, roleDeny)
+
+	if own != nil {
+		bits = apply(bits, own.Allow, own.Deny)
+	}
+
+	return bits
+}
+
+// The permissions in a channel, starting from the permissions in its group or the community's when
+// it isn't in one. A private channel is hidden until an overwrite lets the user in.
+func ChannelOverwriteBits(bits uint32, channel Channels, overwrites []PermissionOverwrites, uId uint64, roleIds map[uint64]bool) uint32 {
+	if channel.Private {
+		bits &^= ViewChannels.Bit()
+	}
+
+	return ApplyOverwrites(bits, overwrites, uId, roleIds)
+}
@@ -17,6 +17,7 @@ const (
 	BanMembers
 	SendMessages
 	AttachMedia
+	MentionRoles
 )
 
 func (w Permission) String() string {
@@ -28,13 +29,45 @@ func (w Permission) String() string {
 		"kick_members",
 		"ban_members",
 		"send_messages",
-		"attach_media"}[w-1]
+		"attach_media",
+		"mention_roles"}[w-1]
 }
 
 func (w Permission) EnumIndex() int {
 	return int(w)
 }
 
+// The permission's bit in a permission overwrite's allow and deny masks
+func (w Permission) Bit() uint32 {
+	return 1 << (w - 1)
+}
+
+// The permissions a channel or channel group can override, the rest only apply community wide
+var ChannelPermissions = []Permission{ViewChannels, ManageChannels, SendMessages, AttachMedia, MentionRoles}
+
+// Names of the channel permissions set in an overwrite mask
+func ChannelPermissionNames(bits uint32) []string {
+	names := []string{}
+
+	for _, p := range ChannelPermissions {
+		if bits&p.Bit() != 0 {
+			names = append(names, p.String())
+		}
+	}
+
+	return names
+}
+
+func ChannelPermissionFromString(s string) (Permission, bool) {
+	for _, p := range ChannelPermissions {
+		if p.String() == s {
+			return p, true
+		}
+	}
+
+	return 0, false
+}
+
 type Permissions struct {
 	ViewChannels    bool `db:"view_channels"`
 	ManageChannels  bool `db:"manage_channels"`
@@ -44,6 +77,7 @@ type Permissions struct {
 	BanMembers      bool `db:"ban_members"`
 	SendMessages    bool `db:"send_messages"`
 	AttachMedia     bool `db:"attach_media"`
+	MentionRoles    bool `db:"mention_roles"`
 }
 
 func (c Permissions) ToFiberMap() fiber.Map {
@@ -56,9 +90,49 @@ func (c Permissions) ToFiberMap() fiber.Map {
 		"ban_members":      c.BanMembers,
 		"send_messages":    c.SendMessages,
 		"attach_media":     c.AttachMedia,
+		"mention_roles":    c.MentionRoles,
+	}
+}
+
+func (c Permissions) Has(permission Permission) bool {
+	return c.Bits()&permission.Bit() != 0
+}
+
+func (c Permissions) Bits() uint32 {
+	flags := []bool{c.ViewChannels, c.ManageChannels, c.ManageCommunity, c.CreateInvite, c.KickMembers,
+		c.BanMembers, c.SendMessages, c.AttachMedia, c.MentionRoles}
+
+	var bits uint32
+
+	for i, set := range flags {
+		if set {
+			bits |= Permission(i + 1).Bit()
+		}
+	}
+
+	return bits
+}
+
+func PermissionsFromBits(bits uint32) Permissions {
+	return Permissions{
+		ViewChannels:    bits&ViewChannels.Bit() != 0,
+		ManageChannels:  bits&ManageChannels.Bit() != 0,
+		ManageCommunity: bits&ManageCommunity.Bit() != 0,
+		CreateInvite:    bits&CreateInvite.Bit() != 0,
+		KickMembers:     bits&KickMembers.Bit() != 0,
+		BanMembers:      bits&BanMembers.Bit() != 0,
+		SendMessages:    bits&SendMessages.Bit() != 0,
+		AttachMedia:     bits&AttachMedia.Bit() != 0,
+		MentionRoles:    bits&MentionRoles.Bit() != 0,
 	}
 }
 
 func PermissionRedisKey(uId uint64, cId uint64) string {
 	return fmt.Sprintf("user-%d-%d-permissions", uId, cId)
 }
+
+// Hash of the member's permissions in each channel and channel group of the community,
+// with the permission overwrites applied
+func ChannelPermissionsRedisKey(uId uint64, cId uint64) string {
+	return fmt.Sprintf("user-%d-%d-channel-permissions", uId, cId)
+}
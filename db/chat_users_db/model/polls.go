@@ -0,0 +1,29 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// A poll is attached to the message it was posted with
+type Polls struct {
+	ID             uint64       `db:"id"`
+	CreatedAt      time.Time    `db:"created_at"`
+	Salt           string       `db:"object_salt"`
+	MessageID      uint64       `db:"message_id"`
+	CommunityID    uint64       `db:"community_id"`
+	ChannelID      uint64       `db:"channel_id"`
+	Question       string       `db:"question"`
+	MultipleChoice bool         `db:"multiple_choice"`
+	ClosesAt       sql.NullTime `db:"closes_at"`
+	Closed         bool         `db:"closed"`
+	ClosedAt       sql.NullTime `db:"closed_at"`
+}
+
+// Voting is over once the poll is closed or its close time has passed, even if
+// the task that closes it hasn't run yet
+func (p Polls) IsClosed() bool {
+	return p.Closed || (p.ClosesAt.Valid && !p.ClosesAt.Time.After(time.Now()))
+}
+
+var POLLS_TYPE = "Polls"
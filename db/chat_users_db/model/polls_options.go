@@ -0,0 +1,11 @@
+package model
+
+type PollsOptions struct {
+	ID       uint64 `db:"id"`
+	Salt     string `db:"object_salt"`
+	PollID   uint64 `db:"poll_id"`
+	Position uint32 `db:"position"`
+	Text     string `db:"text"`
+}
+
+var POLLS_OPTIONS_TYPE = "PollsOptions"
@@ -0,0 +1,14 @@
+package model
+
+import (
+	"time"
+)
+
+type PollsVotes struct {
+	CreatedAt time.Time `db:"created_at"`
+	PollID    uint64    `db:"poll_id"`
+	OptionID  uint64    `db:"option_id"`
+	UserID    uint64    `db:"user_id"`
+}
+
+var POLLS_VOTES_TYPE = "PollsVotes"
@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+)
+
+// One user's reaction to a message, the cached MessagesReactions are built from these
+type Reactions struct {
+	ID          uint64    `db:"id"`
+	CreatedAt   time.Time `db:"created_at"`
+	MessageID   uint64    `db:"message_id"`
+	CommunityID uint64    `db:"community_id"`
+	ChannelID   uint64    `db:"channel_id"`
+	UserID      uint64    `db:"user_id"`
+	Reaction    string    `db:"reaction"`
+}
+
+var REACTIONS_TYPE = "Reactions"
@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+)
+
+// How far a user has read a channel.
+// message_id and seq are the message they read up to, unread is the channel's last_seq minus seq.
+type ReadMarkers struct {
+	UserID      uint64    `db:"user_id"`
+	ChannelID   uint64    `db:"channel_id"`
+	CommunityID uint64    `db:"community_id"`
+	MessageID   uint64    `db:"message_id"`
+	ReadAt      time.Time `db:"read_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+	Seq         uint64    `db:"seq"`
+}
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// A member flagging a message or another member for the community's moderators. Reports on a
+// message keep a copy of its text, so there's still something to review once it's deleted.
+type Reports struct {
+	ID           uint64         `db:"id"`
+	CreatedAt    time.Time      `db:"created_at"`
+	UpdatedAt    sql.NullTime   `db:"updated_at"`
+	Salt         string         `db:"object_salt"`
+	CommunityID  uint64         `db:"community_id"`
+	ReporterID   uint64         `db:"reporter_id"`
+	TargetUserID uint64         `db:"target_user_id"`
+	MessageID    uint64         `db:"message_id"`
+	ChannelID    uint64         `db:"channel_id"`
+	MessageText  sql.NullString `db:"message_text"`
+	Category     string         `db:"category"`
+	Details      sql.NullString `db:"details"`
+	Status       string         `db:"status"`
+	Resolution   sql.NullString `db:"resolution"`
+	ResolvedBy   uint64         `db:"resolved_by"`
+	ResolvedAt   sql.NullTime   `db:"resolved_at"`
+}
+
+const (
+	REPORT_OPEN      = "open"
+	REPORT_RESOLVED  = "resolved"
+	REPORT_DISMISSED = "dismissed"
+)
+
+const (
+	REPORT_KICK           = "kick"
+	REPORT_BAN            = "ban"
+	REPORT_DELETE_MESSAGE = "delete_message"
+	REPORT_NO_ACTION      = "none"
+)
+
+var REPORTS_TYPE = "Reports"
+
+// Topics for events only the community's moderators should get
+var MODERATORS_TYPE = "Moderators"
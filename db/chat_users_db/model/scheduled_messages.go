@@ -0,0 +1,61 @@
+package model
+
+import (
+	"database/sql"
+	"maps"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/macwilko/exotic-auth/security_helpers"
+)
+
+// A message written now to be sent later. Once sent it points at the message it became,
+// if it couldn't be sent the reason is kept so the author can see what happened.
+type ScheduledMessages struct {
+	ID          uint64         `db:"id"`
+	CreatedAt   time.Time      `db:"created_at"`
+	UpdatedAt   sql.NullTime   `db:"updated_at"`
+	Salt        string         `db:"object_salt"`
+	CommunityID uint64         `db:"community_id"`
+	ChannelID   uint64         `db:"channel_id"`
+	UserID      uint64         `db:"user_id"`
+	ParentID    uint64         `db:"parent_id"`
+	Text        string         `db:"text"`
+	SendAt      time.Time      `db:"send_at"`
+	SentAt      sql.NullTime   `db:"sent_at"`
+	MessageID   uint64         `db:"message_id"`
+	FailedAt    sql.NullTime   `db:"failed_at"`
+	Failure     sql.NullString `db:"failure"`
+}
+
+// Still waiting to be sent, so it can be edited or cancelled
+func (c ScheduledMessages) IsPending() bool {
+	return !c.SentAt.Valid && !c.FailedAt.Valid
+}
+
+func (c ScheduledMessages) ToFiberMap() fiber.Map {
+	m := fiber.Map{
+		"id":         security_helpers.Encode(c.ID, SCHEDULED_MESSAGES_TYPE, c.Salt),
+		"created_at": c.CreatedAt.Format(time.RFC3339),
+		"text":       c.Text,
+		"send_at":    c.SendAt.Format(time.RFC3339),
+		"failed":     c.FailedAt.Valid,
+	}
+
+	if c.UpdatedAt.Valid {
+		maps.Copy(m, fiber.Map{
+			"updated_at": c.UpdatedAt.Time.Format(time.RFC3339),
+		})
+	}
+
+	if c.FailedAt.Valid {
+		maps.Copy(m, fiber.Map{
+			"failed_at": c.FailedAt.Time.Format(time.RFC3339),
+			"failure":   c.Failure.String,
+		})
+	}
+
+	return m
+}
+
+var SCHEDULED_MESSAGES_TYPE = "ScheduledMessages"
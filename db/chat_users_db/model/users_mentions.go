@@ -0,0 +1,19 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// A mention fanned out to each user it pings, roles included, so every user has an inbox
+type UsersMentions struct {
+	CreatedAt       time.Time    `db:"created_at"`
+	ReadAt          sql.NullTime `db:"read_at"`
+	UserID          uint64       `db:"user_id"`
+	MessageID       uint64       `db:"message_id"`
+	CommunityID     uint64       `db:"community_id"`
+	ChannelID       uint64       `db:"channel_id"`
+	CommunityRoleID uint64       `db:"community_role_id"`
+}
+
+var USERS_MENTIONS_TYPE = "UsersMentions"
@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN deleted_at DATETIME;
+ALTER TABLE messages ADD COLUMN deleted_by BIGINT unsigned NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+CREATE FULLTEXT INDEX messages_text_ft_idx ON messages (text);
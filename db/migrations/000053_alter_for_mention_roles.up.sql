@@ -0,0 +1,13 @@
+ALTER TABLE community_roles
+    ADD COLUMN mention_roles BOOLEAN DEFAULT 0;
+
+ALTER TABLE communities_users
+    ADD COLUMN mention_roles BOOLEAN DEFAULT 0;
+
+ALTER TABLE communities
+    ADD COLUMN mention_roles BOOLEAN DEFAULT 0;
+
+UPDATE communities_users
+JOIN communities ON communities.id = communities_users.community_id
+SET communities_users.mention_roles = 1
+WHERE communities_users.user_id = communities.owner_id;
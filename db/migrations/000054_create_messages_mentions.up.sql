@@ -0,0 +1,12 @@
+CREATE TABLE messages_mentions (
+    created_at DATETIME NOT NULL,
+    message_id BIGINT unsigned NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    mention_type VARCHAR(16) NOT NULL,
+    target_id BIGINT unsigned NOT NULL,
+    token VARCHAR(255) NOT NULL
+);
+
+CREATE INDEX messages_mentions_message_id_idx ON messages_mentions (message_id);
+CREATE INDEX messages_mentions_target_idx ON messages_mentions (mention_type, target_id);
@@ -0,0 +1,13 @@
+CREATE TABLE users_mentions (
+    created_at DATETIME NOT NULL,
+    read_at DATETIME,
+    user_id BIGINT unsigned NOT NULL,
+    message_id BIGINT unsigned NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    community_role_id BIGINT unsigned NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX users_mentions_user_id_message_id_idx ON users_mentions (user_id, message_id);
+CREATE INDEX users_mentions_message_id_idx ON users_mentions (message_id);
+CREATE INDEX users_mentions_user_id_read_at_idx ON users_mentions (user_id, read_at);
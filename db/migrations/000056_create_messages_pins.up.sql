@@ -0,0 +1,12 @@
+ALTER TABLE channels ADD COLUMN max_pins INT unsigned NOT NULL DEFAULT 50;
+
+CREATE TABLE messages_pins (
+    created_at DATETIME NOT NULL,
+    message_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    pinned_by BIGINT unsigned NOT NULL
+);
+
+CREATE UNIQUE INDEX messages_pins_message_id_idx ON messages_pins (message_id);
+CREATE INDEX messages_pins_channel_id_idx ON messages_pins (channel_id);
@@ -0,0 +1,12 @@
+CREATE TABLE messages_revisions (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    message_id BIGINT unsigned NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    edited_by BIGINT unsigned NOT NULL,
+    text TEXT NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX messages_revisions_message_id_idx ON messages_revisions (message_id);
@@ -0,0 +1,14 @@
+CREATE TABLE reactions (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    message_id BIGINT unsigned NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    user_id BIGINT unsigned NOT NULL,
+    reaction VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX reactions_message_id_user_id_reaction_idx ON reactions (message_id, user_id, reaction);
+CREATE INDEX reactions_channel_id_idx ON reactions (channel_id);
+CREATE INDEX reactions_community_id_idx ON reactions (community_id);
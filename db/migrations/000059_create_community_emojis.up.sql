@@ -0,0 +1,14 @@
+CREATE TABLE community_emojis (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME,
+    object_salt VARCHAR(255) NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    name VARCHAR(32) NOT NULL,
+    file_id BIGINT unsigned NOT NULL,
+    cf_images_id VARCHAR(255) NOT NULL,
+    created_by BIGINT unsigned NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX community_emojis_community_id_name_idx ON community_emojis (community_id, name);
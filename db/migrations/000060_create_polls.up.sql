@@ -0,0 +1,37 @@
+CREATE TABLE polls (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    object_salt VARCHAR(255) NOT NULL,
+    message_id BIGINT unsigned NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    question VARCHAR(300) NOT NULL,
+    multiple_choice BOOLEAN NOT NULL DEFAULT FALSE,
+    closes_at DATETIME,
+    closed BOOLEAN NOT NULL DEFAULT FALSE,
+    closed_at DATETIME,
+    PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX polls_message_id_idx ON polls (message_id);
+
+CREATE TABLE polls_options (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    object_salt VARCHAR(255) NOT NULL,
+    poll_id BIGINT unsigned NOT NULL,
+    position INT unsigned NOT NULL,
+    text VARCHAR(100) NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX polls_options_poll_id_idx ON polls_options (poll_id);
+
+CREATE TABLE polls_votes (
+    created_at DATETIME NOT NULL,
+    poll_id BIGINT unsigned NOT NULL,
+    option_id BIGINT unsigned NOT NULL,
+    user_id BIGINT unsigned NOT NULL
+);
+
+CREATE UNIQUE INDEX polls_votes_poll_id_option_id_user_id_idx ON polls_votes (poll_id, option_id, user_id);
+CREATE INDEX polls_votes_poll_id_user_id_idx ON polls_votes (poll_id, user_id);
@@ -0,0 +1,20 @@
+CREATE TABLE scheduled_messages (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME,
+    object_salt VARCHAR(255) NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    user_id BIGINT unsigned NOT NULL,
+    parent_id BIGINT unsigned NOT NULL DEFAULT 0,
+    text VARCHAR(2000) NOT NULL,
+    send_at DATETIME NOT NULL,
+    sent_at DATETIME,
+    message_id BIGINT unsigned NOT NULL DEFAULT 0,
+    failed_at DATETIME,
+    failure VARCHAR(255),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX scheduled_messages_user_id_community_id_idx ON scheduled_messages (user_id, community_id);
+CREATE INDEX scheduled_messages_channel_id_idx ON scheduled_messages (channel_id);
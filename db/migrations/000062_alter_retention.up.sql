@@ -0,0 +1,4 @@
+ALTER TABLE channels ADD COLUMN retention_days INT unsigned NOT NULL DEFAULT 0;
+ALTER TABLE communities ADD COLUMN retention_days INT unsigned NOT NULL DEFAULT 0;
+
+CREATE INDEX messages_channel_id_created_at_idx ON messages (channel_id, created_at);
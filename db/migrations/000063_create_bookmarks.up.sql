@@ -0,0 +1,17 @@
+CREATE TABLE bookmarks (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME,
+    object_salt VARCHAR(255) NOT NULL,
+    user_id BIGINT unsigned NOT NULL,
+    message_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    note VARCHAR(500),
+    PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX bookmarks_user_id_message_id_idx ON bookmarks (user_id, message_id);
+CREATE INDEX bookmarks_user_id_community_id_idx ON bookmarks (user_id, community_id);
+CREATE INDEX bookmarks_message_id_idx ON bookmarks (message_id);
+CREATE INDEX bookmarks_channel_id_idx ON bookmarks (channel_id);
@@ -0,0 +1,12 @@
+CREATE TABLE read_markers (
+    user_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    message_id BIGINT unsigned NOT NULL DEFAULT 0,
+    read_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, channel_id)
+);
+
+CREATE INDEX read_markers_user_id_community_id_idx ON read_markers (user_id, community_id);
+CREATE INDEX read_markers_channel_id_idx ON read_markers (channel_id);
@@ -0,0 +1,23 @@
+ALTER TABLE channels ADD COLUMN last_seq BIGINT unsigned NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN seq BIGINT unsigned NOT NULL DEFAULT 0;
+ALTER TABLE read_markers ADD COLUMN seq BIGINT unsigned NOT NULL DEFAULT 0;
+
+UPDATE messages
+JOIN (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY channel_id ORDER BY id) AS seq
+    FROM messages
+) numbered ON numbered.id = messages.id
+SET messages.seq = numbered.seq;
+
+UPDATE channels
+SET last_seq = (SELECT COALESCE(MAX(seq), 0) FROM messages WHERE messages.channel_id = channels.id);
+
+UPDATE read_markers
+SET seq = (
+    SELECT COALESCE(MAX(seq), 0)
+    FROM messages
+    WHERE messages.channel_id = read_markers.channel_id
+    AND messages.created_at <= read_markers.read_at
+);
+
+CREATE INDEX messages_channel_id_seq_idx ON messages (channel_id, seq);
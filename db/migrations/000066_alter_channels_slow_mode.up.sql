@@ -0,0 +1 @@
+ALTER TABLE channels ADD COLUMN slow_mode_seconds INT unsigned NOT NULL DEFAULT 0;
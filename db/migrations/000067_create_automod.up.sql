@@ -0,0 +1,36 @@
+CREATE TABLE automod_rules (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME,
+    object_salt VARCHAR(255) NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    created_by BIGINT unsigned NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    action VARCHAR(16) NOT NULL,
+    patterns TEXT NOT NULL,
+    threshold INT unsigned NOT NULL DEFAULT 0,
+    timeout_seconds INT unsigned NOT NULL DEFAULT 0,
+    enabled TINYINT(1) NOT NULL DEFAULT 1,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX automod_rules_community_id_idx ON automod_rules (community_id);
+
+CREATE TABLE automod_flags (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    object_salt VARCHAR(255) NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL,
+    message_id BIGINT unsigned NOT NULL,
+    user_id BIGINT unsigned NOT NULL,
+    rule_id BIGINT unsigned NOT NULL,
+    text VARCHAR(2000) NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX automod_flags_community_id_idx ON automod_flags (community_id);
+CREATE INDEX automod_flags_message_id_idx ON automod_flags (message_id);
+
+ALTER TABLE communities_users ADD COLUMN timed_out_until DATETIME;
@@ -0,0 +1,24 @@
+CREATE TABLE reports (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME,
+    object_salt VARCHAR(255) NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    reporter_id BIGINT unsigned NOT NULL,
+    target_user_id BIGINT unsigned NOT NULL,
+    message_id BIGINT unsigned NOT NULL DEFAULT 0,
+    channel_id BIGINT unsigned NOT NULL DEFAULT 0,
+    message_text VARCHAR(2000),
+    category VARCHAR(32) NOT NULL,
+    details VARCHAR(1000),
+    status VARCHAR(16) NOT NULL DEFAULT 'open',
+    resolution VARCHAR(32),
+    resolved_by BIGINT unsigned NOT NULL DEFAULT 0,
+    resolved_at DATETIME,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX reports_community_id_status_idx ON reports (community_id, status, id);
+CREATE INDEX reports_target_user_id_idx ON reports (target_user_id, community_id);
+CREATE INDEX reports_message_id_idx ON reports (message_id);
+CREATE INDEX reports_channel_id_idx ON reports (channel_id);
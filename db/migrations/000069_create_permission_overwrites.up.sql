@@ -0,0 +1,17 @@
+CREATE TABLE permission_overwrites (
+    id BIGINT unsigned NOT NULL AUTO_INCREMENT,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME,
+    object_salt VARCHAR(255) NOT NULL,
+    community_id BIGINT unsigned NOT NULL,
+    channel_id BIGINT unsigned NOT NULL DEFAULT 0,
+    group_id BIGINT unsigned NOT NULL DEFAULT 0,
+    target_type VARCHAR(16) NOT NULL,
+    target_id BIGINT unsigned NOT NULL DEFAULT 0,
+    allow INT unsigned NOT NULL DEFAULT 0,
+    deny INT unsigned NOT NULL DEFAULT 0,
+    PRIMARY KEY (id),
+    UNIQUE KEY permission_overwrites_target_idx (channel_id, group_id, target_type, target_id)
+);
+
+CREATE INDEX permission_overwrites_community_id_idx ON permission_overwrites (community_id);
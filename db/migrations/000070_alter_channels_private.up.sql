@@ -0,0 +1 @@
+ALTER TABLE channels ADD COLUMN private TINYINT(1) NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE channels ADD COLUMN position INT unsigned NOT NULL DEFAULT 0;
+ALTER TABLE channel_groups ADD COLUMN position INT unsigned NOT NULL DEFAULT 0;
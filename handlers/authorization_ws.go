@@ -151,3 +151,55 @@ func AuthorizationWS(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, rdb *redis.
 
 	return c.Next()
 }
+
+// Whether the user can listen on a topic. Channel and thread topics need the channel to be
+// visible to them, the moderators topic needs them to still moderate the community, a
+// private community's topic needs them to be a member, and a user topic is only its owner's.
+// Anything else is closed until it's given a case here.
+func CanSubscribe(uId uint64, topic string, db *sqlx.DB, rdb *redis.Client, ctx context.Context) bool {
+
+	id, idType := security_helpers.Decode(topic)
+
+	switch idType {
+	case model.CHANNELS_TYPE:
+		return HasChannelPermission(uId, id, model.ViewChannels, db, rdb, rdb, ctx)
+	case model.MESSAGES_TYPE:
+		var channelId uint64
+
+		err := db.Get(&channelId, "SELECT channel_id FROM messages WHERE id = ? LIMIT 1", id)
+
+		if err != nil {
+			slog.Warn("No thread found for topic 💀",
+				slog.String("error", err.Error()))
+
+			return false
+		}
+
+		return HasChannelPermission(uId, channelId, model.ViewChannels, db, rdb, rdb, ctx)
+	case model.MODERATORS_TYPE:
+		return HasCommunityPermission(uId, id, model.ManageChannels, db, rdb, rdb, ctx)
+	case model.COMMUNITIES_TYPE:
+		var private bool
+
+		err := db.Get(&private, "SELECT private FROM communities WHERE id = ? LIMIT 1", id)
+
+		if err != nil {
+			slog.Warn("No community found for topic 💀",
+				slog.String("error", err.Error()))
+
+			return false
+		}
+
+		if !private {
+			return true
+		}
+
+		_, member := communityMember(uId, id, db, rdb, rdb, ctx)
+
+		return member
+	case model.USERS_TYPE:
+		return id == uId
+	default:
+		return false
+	}
+}
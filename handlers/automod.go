@@ -0,0 +1,935 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Every rule runs on every send, so a community can only have so many
+const maxAutomodRules = 50
+
+// How long a timeout rule holds the author back when it doesn't say
+const defaultAutomodTimeout = 10 * time.Minute
+
+// Flags returned per page
+const automodFlagsPageSize = 25
+
+type AutomodRuleInput struct {
+	Name           string   `json:"name" validate:"required,gte=1,lte=64"`
+	Kind           string   `json:"kind" validate:"required,oneof=keyword regex link_allow link_deny mass_mention caps"`
+	Action         string   `json:"action" validate:"required,oneof=block flag timeout"`
+	Patterns       []string `json:"patterns" validate:"lte=100,dive,gte=1,lte=200"`
+	Threshold      *uint32  `json:"threshold" validate:"omitempty,gte=1,lte=100"`
+	TimeoutSeconds *uint32  `json:"timeout_seconds" validate:"omitempty,gte=60,lte=2419200"`
+	Enabled        *bool    `json:"enabled"`
+}
+
+type EditAutomodRuleInput struct {
+	RuleID string `json:"rule_id" validate:"required,gte=3,lte=255"`
+	AutomodRuleInput
+}
+
+type DeleteAutomodRuleInput struct {
+	RuleID string `json:"rule_id" validate:"required,gte=3,lte=255"`
+}
+
+// Checks what the validator can't, each kind of rule needs different settings
+func validateAutomodRule(input *AutomodRuleInput) []fiber.Map {
+
+	var errors []fiber.Map
+
+	switch input.Kind {
+	case model.AUTOMOD_KEYWORD, model.AUTOMOD_REGEX, model.AUTOMOD_LINK_ALLOW, model.AUTOMOD_LINK_DENY:
+		if len(input.Patterns) == 0 {
+			errors = append(errors, fiber.Map{
+				"field":   "Patterns",
+				"message": "Patterns are required for this kind of rule.",
+			})
+		}
+	case model.AUTOMOD_MASS_MENTION, model.AUTOMOD_CAPS:
+		if input.Threshold == nil {
+			errors = append(errors, fiber.Map{
+				"field":   "Threshold",
+				"message": "Threshold is required for this kind of rule.",
+			})
+		}
+	}
+
+	if input.Kind == model.AUTOMOD_REGEX {
+		for _, p := range input.Patterns {
+			if _, err := regexp.Compile(p); err != nil {
+				errors = append(errors, fiber.Map{
+					"field":   "Patterns",
+					"message": "Invalid pattern " + p,
+				})
+			}
+		}
+	}
+
+	return errors
+}
+
+// Works out the rule's columns from the input, filling in the defaults
+func automodRuleColumns(input *AutomodRuleInput) (string, uint32, uint32, bool) {
+	patterns := []string{}
+
+	for _, p := range input.Patterns {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			patterns = append(patterns, p)
+		}
+	}
+
+	p, _ := json.Marshal(patterns)
+
+	var threshold uint32 = 0
+
+	if input.Threshold != nil {
+		threshold = *input.Threshold
+	}
+
+	var timeoutSeconds uint32 = 0
+
+	if input.Action == model.AUTOMOD_TIMEOUT {
+		timeoutSeconds = uint32(defaultAutomodTimeout.Seconds())
+
+		if input.TimeoutSeconds != nil {
+			timeoutSeconds = *input.TimeoutSeconds
+		}
+	}
+
+	enabled := true
+
+	if input.Enabled != nil {
+		enabled = *input.Enabled
+	}
+
+	return string(p), threshold, timeoutSeconds, enabled
+}
+
+// Lists every rule in the community, disabled ones too
+func AutomodRules(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Fetching automod rules ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	rules := []model.AutomodRules{}
+
+	err = db.Select(&rules, "SELECT * FROM automod_rules WHERE community_id = ? ORDER BY id ASC", community.ID)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "selecting automod rules"))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	mr := []fiber.Map{}
+
+	for _, r := range rules {
+		mr = append(mr, r.ToFiberMap())
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"rules": mr,
+	})
+}
+
+// Adds a rule to the community, it applies from the next message sent
+func CreateAutomodRule(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Creating automod rule ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(AutomodRuleInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to create automod rule, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	} else {
+		errors = validateAutomodRule(input)
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to create automod rule, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	handleCantCreateError := func(err error) error {
+		slog.Error("Unable to create automod rule 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to create automod rule.",
+			}},
+		})
+	}
+
+	var count int
+
+	err = db.Get(&count, "SELECT COUNT(*) FROM automod_rules WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleCantCreateError(err)
+	}
+
+	if count >= maxAutomodRules {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Too many automod rules.",
+			}},
+		})
+	}
+
+	patterns, threshold, timeoutSeconds, enabled := automodRuleColumns(input)
+
+	rule := model.AutomodRules{
+		CreatedAt:      time.Now().Truncate(time.Second),
+		Salt:           uuid.New().String(),
+		CommunityID:    community.ID,
+		CreatedBy:      user.ID,
+		Name:           strings.TrimSpace(input.Name),
+		Kind:           input.Kind,
+		Action:         input.Action,
+		Patterns:       patterns,
+		Threshold:      threshold,
+		TimeoutSeconds: timeoutSeconds,
+		Enabled:        enabled,
+	}
+
+	iq := `
+	INSERT INTO automod_rules
+	(created_at, object_salt, community_id, created_by, name, kind, action, patterns, threshold, timeout_seconds, enabled)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	res, err := db.Exec(iq, rule.CreatedAt, rule.Salt, rule.CommunityID, rule.CreatedBy, rule.Name, rule.Kind, rule.Action,
+		rule.Patterns, rule.Threshold, rule.TimeoutSeconds, rule.Enabled)
+
+	if err != nil {
+		return handleCantCreateError(err)
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return handleCantCreateError(err)
+	}
+
+	rule.ID = uint64(id)
+
+	message_helpers.InvalidateAutomodRules(community.ID, wRdb, ctx)
+
+	return c.Status(fiber.StatusOK).JSON(rule.ToFiberMap())
+}
+
+// Replaces a rule's settings
+func EditAutomodRule(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Editing automod rule ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(EditAutomodRuleInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to edit automod rule, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	} else {
+		errors = validateAutomodRule(&input.AutomodRuleInput)
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to edit automod rule, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	ruleId, ruleOk := security_helpers.Decode(input.RuleID)
+
+	if ruleId == 0 || ruleOk != model.AUTOMOD_RULES_TYPE {
+		slog.Error("Automod rule security ID failure 💀")
+
+		return notFound()
+	}
+
+	rule := model.AutomodRules{}
+
+	err = db.Get(&rule, "SELECT * FROM automod_rules WHERE id = ? AND community_id = ? LIMIT 1", ruleId, community.ID)
+
+	if err != nil {
+		slog.Error("No automod rule found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	patterns, threshold, timeoutSeconds, enabled := automodRuleColumns(&input.AutomodRuleInput)
+
+	updatedAt := time.Now()
+
+	uq := `
+	UPDATE automod_rules
+	SET updated_at = ?, name = ?, kind = ?, action = ?, patterns = ?, threshold = ?, timeout_seconds = ?, enabled = ?
+	WHERE id = ?`
+
+	_, err = db.Exec(uq, updatedAt, strings.TrimSpace(input.Name), input.Kind, input.Action, patterns, threshold, timeoutSeconds, enabled, rule.ID)
+
+	if err != nil {
+		slog.Error("Unable to edit automod rule 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to edit automod rule.",
+			}},
+		})
+	}
+
+	message_helpers.InvalidateAutomodRules(community.ID, wRdb, ctx)
+
+	rule.UpdatedAt.Time = updatedAt
+	rule.UpdatedAt.Valid = true
+	rule.Name = strings.TrimSpace(input.Name)
+	rule.Kind = input.Kind
+	rule.Action = input.Action
+	rule.Patterns = patterns
+	rule.Threshold = threshold
+	rule.TimeoutSeconds = timeoutSeconds
+	rule.Enabled = enabled
+
+	return c.Status(fiber.StatusOK).JSON(rule.ToFiberMap())
+}
+
+// Removes a rule, flags it already raised are kept
+func DeleteAutomodRule(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Deleting automod rule ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(DeleteAutomodRuleInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to delete automod rule, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to delete automod rule, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	ruleId, ruleOk := security_helpers.Decode(input.RuleID)
+
+	if ruleId == 0 || ruleOk != model.AUTOMOD_RULES_TYPE {
+		slog.Error("Automod rule security ID failure 💀")
+
+		return notFound()
+	}
+
+	res, err := db.Exec("DELETE FROM automod_rules WHERE id = ? AND community_id = ?", ruleId, community.ID)
+
+	if err != nil {
+		slog.Error("Unable to delete automod rule 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to delete automod rule.",
+			}},
+		})
+	}
+
+	if deleted, _ := res.RowsAffected(); deleted == 0 {
+		return notFound()
+	}
+
+	message_helpers.InvalidateAutomodRules(community.ID, wRdb, ctx)
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"id":      input.RuleID,
+		"deleted": true,
+	})
+}
+
+// Lists messages flagged by automod for moderators to look at, newest first
+func AutomodFlags(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Fetching automod flags ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		return notFound(err, "selecting community")
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	var beforeId uint64 = 0
+
+	if cursor := c.Query("before"); len(cursor) > 0 {
+		id, idType := security_helpers.Decode(Truncate(cursor, 255))
+
+		if id == 0 || idType != model.AUTOMOD_FLAGS_TYPE {
+			slog.Warn("Invalid automod flag cursor 💀")
+
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Invalid input.",
+				}},
+			})
+		}
+
+		beforeId = id
+	}
+
+	q := "SELECT * FROM automod_flags WHERE community_id = ?"
+
+	args := []interface{}{community.ID}
+
+	if beforeId > 0 {
+		q += " AND id < ?"
+		args = append(args, beforeId)
+	}
+
+	q += " ORDER BY id DESC LIMIT ?"
+	args = append(args, automodFlagsPageSize+1)
+
+	flags := []model.AutomodFlags{}
+
+	err = db.Select(&flags, q, args...)
+
+	if err != nil {
+		return notFound(err, "selecting automod flags")
+	}
+
+	hasMore := len(flags) > automodFlagsPageSize
+
+	if hasMore {
+		flags = flags[:automodFlagsPageSize]
+	}
+
+	if len(flags) == 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"flags":    []fiber.Map{},
+			"has_more": false,
+		})
+	}
+
+	var userIds = []uint64{}
+	var channelIds = []uint64{}
+	var messageIds = []uint64{}
+	var ruleIds = []uint64{}
+
+	for _, f := range flags {
+		userIds = append(userIds, f.UserID)
+		channelIds = append(channelIds, f.ChannelID)
+		messageIds = append(messageIds, f.MessageID)
+		ruleIds = append(ruleIds, f.RuleID)
+	}
+
+	uq, uArgs, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIds)
+
+	if err != nil {
+		return notFound(err, "building users query")
+	}
+
+	users := []model.Users{}
+
+	err = db.Select(&users, db.Rebind(uq), uArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting users")
+	}
+
+	cq, cArgs, err := sqlx.In("SELECT * FROM channels WHERE id IN (?)", channelIds)
+
+	if err != nil {
+		return notFound(err, "building channels query")
+	}
+
+	channels := []model.Channels{}
+
+	err = db.Select(&channels, db.Rebind(cq), cArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting channels")
+	}
+
+	mq, mArgs, err := sqlx.In("SELECT * FROM messages WHERE id IN (?) AND deleted = 0", messageIds)
+
+	if err != nil {
+		return notFound(err, "building messages query")
+	}
+
+	messages := []model.Messages{}
+
+	err = db.Select(&messages, db.Rebind(mq), mArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting messages")
+	}
+
+	rq, rArgs, err := sqlx.In("SELECT * FROM automod_rules WHERE id IN (?)", ruleIds)
+
+	if err != nil {
+		return notFound(err, "building automod rules query")
+	}
+
+	rules := []model.AutomodRules{}
+
+	err = db.Select(&rules, db.Rebind(rq), rArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting automod rules")
+	}
+
+	usersMap := make(map[uint64]model.Users)
+
+	for _, u := range users {
+		usersMap[u.ID] = u
+	}
+
+	channelsMap := make(map[uint64]model.Channels)
+
+	for _, ch := range channels {
+		channelsMap[ch.ID] = ch
+	}
+
+	messagesMap := make(map[uint64]model.Messages)
+
+	for _, m := range messages {
+		messagesMap[m.ID] = m
+	}
+
+	rulesMap := make(map[uint64]model.AutomodRules)
+
+	for _, r := range rules {
+		rulesMap[r.ID] = r
+	}
+
+	mf := []fiber.Map{}
+
+	for _, f := range flags {
+		flag := fiber.Map{
+			"id":         security_helpers.Encode(f.ID, model.AUTOMOD_FLAGS_TYPE, f.Salt),
+			"created_at": f.CreatedAt.Format(time.RFC3339),
+			"text":       f.Text,
+			"user":       nil,
+			"channel_id": nil,
+			"message_id": nil,
+			"rule":       nil,
+		}
+
+		if u, found := usersMap[f.UserID]; found {
+			flag["user"] = u.ToFiberMap()
+		}
+
+		if ch, found := channelsMap[f.ChannelID]; found {
+			flag["channel_id"] = security_helpers.Encode(ch.ID, model.CHANNELS_TYPE, ch.Salt)
+		}
+
+		// Left out once the message has been deleted
+		if m, found := messagesMap[f.MessageID]; found {
+			flag["message_id"] = security_helpers.Encode(m.ID, model.MESSAGES_TYPE, m.Salt)
+		}
+
+		if r, found := rulesMap[f.RuleID]; found {
+			flag["rule"] = automodRuleSummary(r)
+		}
+
+		mf = append(mf, flag)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"flags":    mf,
+		"has_more": hasMore,
+	})
+}
+
+// What clients are told about a rule that caught a message
+func automodRuleSummary(rule model.AutomodRules) fiber.Map {
+	return fiber.Map{
+		"id":     security_helpers.Encode(rule.ID, model.AUTOMOD_RULES_TYPE, rule.Salt),
+		"name":   rule.Name,
+		"kind":   rule.Kind,
+		"action": rule.Action,
+	}
+}
+
+// Turns away a member who's timed out of the community
+func timedOutError(c *fiber.Ctx, remaining time.Duration) error {
+	slog.Warn("Timed out")
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"errors": []fiber.Map{{
+			"code":        "timed_out",
+			"message":     "You're timed out of this community.",
+			"retry_after": message_helpers.RetryAfterSeconds(remaining),
+		}},
+	})
+}
+
+// Runs the community's rules over the text. Members who can manage the community aren't checked.
+// When a rule stops the send the rule is returned, otherwise the flag rules that matched.
+func checkAutomod(user model.Users, community model.Communities, text string, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) (*model.AutomodRules, []model.AutomodRules) {
+
+	if HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx) {
+		return nil, nil
+	}
+
+	rules, err := message_helpers.LoadAutomodRules(community.ID, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		// Without the rules the send goes ahead, same as when redis is down for slow mode
+		slog.Error("Couldn't load automod rules 💀",
+			slog.String("error", err.Error()))
+
+		return nil, nil
+	}
+
+	strongest, flagged := message_helpers.EvaluateAutomod(rules, text)
+
+	if strongest != nil && strongest.Action != model.AUTOMOD_FLAG {
+		return strongest, nil
+	}
+
+	return nil, flagged
+}
+
+// Rejects a send stopped by a rule, timing the author out first when the rule says to
+func automodError(c *fiber.Ctx, user model.Users, community model.Communities, rule model.AutomodRules, db *sqlx.DB, wRdb *redis.Client, ctx context.Context) error {
+	slog.Warn("Blocked by automod",
+		slog.Uint64("rId", rule.ID))
+
+	if rule.Action != model.AUTOMOD_TIMEOUT {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"code":    "automod_blocked",
+				"message": "Your message was blocked by automod.",
+				"rule":    automodRuleSummary(rule),
+			}},
+		})
+	}
+
+	duration := time.Duration(rule.TimeoutSeconds) * time.Second
+
+	_, err := message_helpers.TimeoutMember(user.ID, community.ID, duration, db, wRdb, ctx)
+
+	if err != nil {
+		slog.Error("Couldn't time out member 💀",
+			slog.String("error", err.Error()))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"errors": []fiber.Map{{
+			"code":        "automod_timeout",
+			"message":     "Your message was removed by automod and you've been timed out.",
+			"rule":        automodRuleSummary(rule),
+			"retry_after": message_helpers.RetryAfterSeconds(duration),
+		}},
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"strings"
+	"time"
 
 	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
 	"github.com/macwilko/exotic-auth/security_helpers"
@@ -151,47 +152,50 @@ func BanUser(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client,
 		})
 	}
 
-	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+	err = BanMember(banedUserId, community, db, wRdb, ctx)
 
 	if err != nil {
-		slog.Error("Couldn't begin tx, db error 💀")
-
 		return handleError(err)
 	}
 
-	handleTxError := func(err error) error {
-		tx.Rollback()
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"updated": true,
+	})
+}
 
-		return handleError(err)
+// Removes the member like a kick and keeps them from joining again. Used by the ban
+// endpoint and when a moderator resolves a report with a ban.
+func BanMember(userId uint64, community model.Communities, db *sqlx.DB, wRdb *redis.Client, ctx context.Context) error {
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM communities_users WHERE user_id = ? AND community_id = ?", banedUserId, community.ID)
+	err = removeMember(tx, userId, community.ID)
 
 	if err != nil {
-		slog.Error("Couldn't ban user, db error 💀",
-			slog.String("error", err.Error()))
+		tx.Rollback()
 
-		return handleTxError(err)
+		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM communiy_roles_users WHERE user_id = ? AND community_id = ?", banedUserId, community.ID)
+	_, err = tx.Exec("INSERT INTO communities_banned_users (created_at, community_id, user_id) VALUES (?, ?, ?)", time.Now(), community.ID, userId)
 
 	if err != nil {
-		slog.Error("Couldn't ban user, db error 💀",
-			slog.String("error", err.Error()))
+		tx.Rollback()
 
-		return handleTxError(err)
+		return err
 	}
 
 	err = tx.Commit()
 
 	if err != nil {
-		slog.Error("Couldn't commit channel")
-
-		return handleError(err)
+		return err
 	}
 
-	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-		"updated": true,
-	})
+	wRdb.Del(ctx, model.PermissionRedisKey(userId, community.ID), model.ChannelPermissionsRedisKey(userId, community.ID))
+
+	return nil
 }
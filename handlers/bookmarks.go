@@ -0,0 +1,496 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Bookmarks returned per page
+const bookmarksPageSize = 25
+
+type SaveBookmarkInput struct {
+	MessageID string  `json:"message_id" validate:"required,gte=3,lte=255"`
+	Note      *string `json:"note" validate:"omitempty,lte=500"`
+}
+
+type UnsaveBookmarkInput struct {
+	MessageID string `json:"message_id" validate:"required,gte=3,lte=255"`
+}
+
+// Lists the viewer's saved messages across every community, most recently saved first.
+// Bookmarks in communities they've left, or channels they can no longer see, are left out.
+func Bookmarks(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Starting fetch bookmarks ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	var beforeId uint64 = 0
+
+	if cursor := c.Query("before"); len(cursor) > 0 {
+		id, idType := security_helpers.Decode(Truncate(cursor, 255))
+
+		if id == 0 || idType != model.BOOKMARKS_TYPE {
+			slog.Warn("Invalid bookmark cursor 💀")
+
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Invalid input.",
+				}},
+			})
+		}
+
+		beforeId = id
+	}
+
+	channelPermissions, visibleChannelIds, err := MemberChannelPermissions(user.ID, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		return notFound(err, "selecting channel permissions")
+	}
+
+	if len(visibleChannelIds) == 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"bookmarks": []fiber.Map{},
+			"has_more":  false,
+		})
+	}
+
+	// Deleted messages and channels the user can't see are filtered here, not after the limit
+	q := `
+	SELECT bookmarks.*
+	FROM bookmarks
+	JOIN messages ON messages.id = bookmarks.message_id
+	WHERE bookmarks.user_id = ?
+	AND bookmarks.channel_id IN (?)
+	AND messages.deleted = 0`
+
+	args := []interface{}{user.ID, visibleChannelIds}
+
+	if beforeId > 0 {
+		q += " AND bookmarks.id < ?"
+		args = append(args, beforeId)
+	}
+
+	q += " ORDER BY bookmarks.id DESC LIMIT ?"
+	args = append(args, bookmarksPageSize+1)
+
+	bq, bArgs, err := sqlx.In(q, args...)
+
+	if err != nil {
+		return notFound(err, "building bookmarks query")
+	}
+
+	bookmarks := []model.Bookmarks{}
+
+	err = db.Select(&bookmarks, db.Rebind(bq), bArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting bookmarks")
+	}
+
+	hasMore := len(bookmarks) > bookmarksPageSize
+
+	if hasMore {
+		bookmarks = bookmarks[:bookmarksPageSize]
+	}
+
+	if len(bookmarks) == 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"bookmarks": []fiber.Map{},
+			"has_more":  false,
+		})
+	}
+
+	var messageIds = []uint64{}
+	var channelIds = []uint64{}
+	var communityIds = []uint64{}
+
+	for _, b := range bookmarks {
+		messageIds = append(messageIds, b.MessageID)
+		channelIds = append(channelIds, b.ChannelID)
+		communityIds = append(communityIds, b.CommunityID)
+	}
+
+	mq, mArgs, err := sqlx.In("SELECT * FROM messages WHERE id IN (?) AND deleted = 0", messageIds)
+
+	if err != nil {
+		return notFound(err, "building messages query")
+	}
+
+	messages := []model.Messages{}
+
+	err = db.Select(&messages, db.Rebind(mq), mArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting messages")
+	}
+
+	cq, cArgs, err := sqlx.In("SELECT * FROM channels WHERE id IN (?)", channelIds)
+
+	if err != nil {
+		return notFound(err, "building channels query")
+	}
+
+	channels := []model.Channels{}
+
+	err = db.Select(&channels, db.Rebind(cq), cArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting channels")
+	}
+
+	cmq, cmArgs, err := sqlx.In("SELECT * FROM communities WHERE id IN (?)", communityIds)
+
+	if err != nil {
+		return notFound(err, "building communities query")
+	}
+
+	communities := []model.Communities{}
+
+	err = db.Select(&communities, db.Rebind(cmq), cmArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting communities")
+	}
+
+	// Bookmarks in channels the user can no longer see are left out
+	channelsMap := make(map[uint64]model.Channels)
+
+	for _, ch := range channels {
+		if channelPermissions[ch.CommunityID].Has(ch.ID, model.ViewChannels) {
+			channelsMap[ch.ID] = ch
+		}
+	}
+
+	communitiesMap := make(map[uint64]model.Communities)
+
+	for _, cm := range communities {
+		communitiesMap[cm.ID] = cm
+	}
+
+	// Messages are mapped a community at a time, so authors show their roles from that community
+	messagesByCommunity := make(map[uint64][]model.Messages)
+
+	for _, m := range messages {
+		if _, found := channelsMap[m.ChannelID]; !found {
+			continue
+		}
+
+		messagesByCommunity[m.CommunityID] = append(messagesByCommunity[m.CommunityID], m)
+	}
+
+	mappedMessages := make(map[uint64]fiber.Map)
+
+	for communityId, cms := range messagesByCommunity {
+		mapped, err := message_helpers.MapMessages(cms, communityId, channelPermissions[communityId].CanView, db, wRdb, rRdb, ctx)
+
+		if err != nil {
+			return notFound(err, "mapping messages")
+		}
+
+		for i, m := range cms {
+			mappedMessages[m.ID] = mapped[i]
+		}
+	}
+
+	mb := []fiber.Map{}
+
+	for _, b := range bookmarks {
+		message, mok := mappedMessages[b.MessageID]
+		channel, chok := channelsMap[b.ChannelID]
+		community, cmok := communitiesMap[b.CommunityID]
+
+		if !mok || !chok || !cmok {
+			continue
+		}
+
+		bookmark := b.ToFiberMap()
+
+		bookmark["channel"] = channel.ToFiberMap()
+		bookmark["community"] = fiber.Map{
+			"id":     security_helpers.Encode(community.ID, model.COMMUNITIES_TYPE, community.Salt),
+			"name":   community.Name,
+			"handle": community.Handle,
+		}
+		bookmark["message"] = message
+
+		mb = append(mb, bookmark)
+	}
+
+	var nextCursor *string = nil
+
+	if hasMore {
+		last := bookmarks[len(bookmarks)-1]
+		s := security_helpers.Encode(last.ID, model.BOOKMARKS_TYPE, last.Salt)
+		nextCursor = &s
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"bookmarks": mb,
+		"has_more":  hasMore,
+		"before":    nextCursor,
+	})
+}
+
+// Saves a message for the viewer. Saving one that's already saved replaces its note.
+func SaveBookmark(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Saving bookmark ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(SaveBookmarkInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to save bookmark, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to save bookmark, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	messageId, messageOk := security_helpers.Decode(input.MessageID)
+
+	if messageId == 0 || messageOk != model.MESSAGES_TYPE {
+		slog.Error("Message security ID failure 💀")
+
+		return notFound()
+	}
+
+	message := model.Messages{}
+
+	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND deleted = 0 LIMIT 1", messageId)
+
+	if err != nil {
+		slog.Error("No message found 💀",
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	_, member := communityMember(user.ID, message.CommunityID, db, wRdb, rRdb, ctx)
+
+	canView := member && HasChannelPermission(user.ID, message.ChannelID, model.ViewChannels, db, wRdb, rRdb, ctx)
+
+	// Looks the same as a message that doesn't exist
+	if !canView {
+		slog.Warn("Not allowed")
+
+		return notFound()
+	}
+
+	handleCantSaveError := func(err error) error {
+		slog.Error("Unable to save bookmark 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to save bookmark.",
+			}},
+		})
+	}
+
+	note := sql.NullString{}
+
+	if input.Note != nil && len(*input.Note) > 0 {
+		note = sql.NullString{String: *input.Note, Valid: true}
+	}
+
+	now := time.Now()
+
+	iq := `
+	INSERT INTO bookmarks
+	(created_at, object_salt, user_id, message_id, channel_id, community_id, note)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE note = VALUES(note), updated_at = ?`
+
+	_, err = db.Exec(iq, now, uuid.New().String(), user.ID, message.ID, message.ChannelID, message.CommunityID, note, now)
+
+	if err != nil {
+		return handleCantSaveError(err)
+	}
+
+	bookmark := model.Bookmarks{}
+
+	err = db.Get(&bookmark, "SELECT * FROM bookmarks WHERE user_id = ? AND message_id = ? LIMIT 1", user.ID, message.ID)
+
+	if err != nil {
+		return handleCantSaveError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(bookmark.ToFiberMap())
+}
+
+func UnsaveBookmark(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Removing bookmark ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(UnsaveBookmarkInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to remove bookmark, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to remove bookmark, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	messageId, messageOk := security_helpers.Decode(input.MessageID)
+
+	if messageId == 0 || messageOk != model.MESSAGES_TYPE {
+		slog.Error("Message security ID failure 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	_, err = db.Exec("DELETE FROM bookmarks WHERE user_id = ? AND message_id = ?", user.ID, messageId)
+
+	if err != nil {
+		slog.Error("Unable to remove bookmark 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to remove bookmark.",
+			}},
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"deleted": true,
+	})
+}
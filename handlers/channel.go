@@ -3,15 +3,16 @@ package handlers
 import (
 	"cmp"
 	"context"
-	"encoding/json"
 	"fmt"
 	"maps"
+	"math"
 	"os"
 	"slices"
 	"strings"
 	"time"
 
 	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
 	"github.com/macwilko/exotic-auth/security_helpers"
 
 	"github.com/gofiber/fiber/v2"
@@ -21,10 +22,43 @@ import (
 	"golang.org/x/exp/slog"
 )
 
+// Messages returned per page of a channel
+const channelPageSize = 50
+
+// Decodes an optional message cursor from the query string.
+// An empty cursor returns 0, a cursor that isn't a message returns false.
+func decodeMessageCursor(c *fiber.Ctx, key string) (uint64, bool) {
+	cursor := c.Query(key)
+
+	if len(cursor) == 0 {
+		return 0, true
+	}
+
+	id, idType := security_helpers.Decode(Truncate(cursor, 255))
+
+	if id == 0 || idType != model.MESSAGES_TYPE {
+		return 0, false
+	}
+
+	return id, true
+}
+
 func Channel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
 	slog.Info("Starting fetch channel ✅")
 
-	pageNumber := c.QueryInt("page", 0)
+	beforeId, beforeOk := decodeMessageCursor(c, "before")
+	afterId, afterOk := decodeMessageCursor(c, "after")
+	aroundId, aroundOk := decodeMessageCursor(c, "around")
+
+	if !beforeOk || !afterOk || !aroundOk {
+		slog.Warn("Invalid message cursor 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Invalid input.",
+			}},
+		})
+	}
 
 	user, userOk := c.Locals("viewer").(model.Users)
 
@@ -72,7 +106,7 @@ func Channel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client,
 
 		pq := `
 		SELECT view_channels, manage_channels, manage_community, create_invite, kick_members,
-		ban_members, send_messages, attach_media, selected_channel_id
+		ban_members, send_messages, attach_media, mention_roles, selected_channel_id
 		FROM communities_users
 		WHERE community_id = ?
 		AND user_id = ?
@@ -184,6 +218,21 @@ func Channel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client,
 		})
 	}
 
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !ok || !channelPermissions.Has(channel.ID, model.ViewChannels) {
+		slog.Warn("Not allowed to view channel")
+
+		return c.Status(fiber.StatusNotFound).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	// What the viewer can do here, rather than across the community
+	permissions = channelPermissions.Channels[channel.ID]
+
 	communityUsers := []model.CommunitiesUsers{}
 
 	err = db.Select(&communityUsers, "SELECT * FROM communities_users WHERE community_id = ?", community.ID)
@@ -234,15 +283,9 @@ func Channel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client,
 
 	messages := []model.Messages{}
 
-	offset := 0
+	var hasMoreBefore, hasMoreAfter bool
 
-	if pageNumber > 0 {
-		offset = pageNumber * 50
-	}
-
-	err = db.Select(&messages, "SELECT * FROM messages WHERE channel_id = ? ORDER BY id DESC LIMIT 50 OFFSET ?", channel.ID, offset)
-
-	if err != nil {
+	handleMessagesError := func(err error) error {
 		slog.Error("Database problem 💀", slog.String("error", err.Error()), slog.String("area", "can't select messages"))
 
 		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
@@ -252,129 +295,110 @@ func Channel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client,
 		})
 	}
 
-	slices.Reverse(messages)
-
-	var messageIds = []uint64{}
-
-	// map of message ids to files
-	filesMap := make(map[uint64][]model.Files)
+	olderQuery := `
+	SELECT *
+	FROM messages
+	WHERE channel_id = ?
+	AND deleted = 0
+	AND id < ?
+	ORDER BY id DESC
+	LIMIT ?`
+
+	newerQuery := `
+	SELECT *
+	FROM messages
+	WHERE channel_id = ?
+	AND deleted = 0
+	AND id > ?
+	ORDER BY id ASC
+	LIMIT ?`
+
+	existsQuery := `
+	SELECT EXISTS (
+		SELECT 1
+		FROM messages
+		WHERE channel_id = ?
+		AND deleted = 0
+		AND id %s ?
+	)`
+
+	// Each page asks for one extra message, if it comes back there's more to load in that direction
+	if aroundId > 0 {
+		older := []model.Messages{}
+		newer := []model.Messages{}
+
+		half := channelPageSize / 2
+
+		// The target message is included in the older half
+		err = db.Select(&older, olderQuery, channel.ID, aroundId+1, half+1)
 
-	var parentIDs = []uint64{}
-	parentsMap := make(map[uint64]model.Messages)
-
-	for _, m := range messages {
-		messageIds = append(messageIds, m.ID)
-
-		if m.ParentID > 0 {
-			parentIDs = append(parentIDs, m.ParentID)
+		if err != nil {
+			return handleMessagesError(err)
 		}
-	}
 
-	if len(messageIds) > 0 {
-		pmq, mpqArgs, err := sqlx.In("SELECT * FROM files WHERE message_id IN (?)", messageIds)
+		err = db.Select(&newer, newerQuery, channel.ID, aroundId, half+1)
 
 		if err != nil {
-			slog.Error("Database problem 💀",
-				slog.String("error", err.Error()),
-				slog.String("area", "selecting message ids IN"))
+			return handleMessagesError(err)
+		}
 
-			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-				"errors": []fiber.Map{{
-					"message": "Not found",
-				}},
-			})
+		if len(older) > half {
+			hasMoreBefore = true
+			older = older[:half]
 		}
 
-		pmq = db.Rebind(pmq)
+		if len(newer) > half {
+			hasMoreAfter = true
+			newer = newer[:half]
+		}
 
-		files := []model.Files{}
+		slices.Reverse(older)
 
-		err = db.Select(&files, pmq, mpqArgs...)
+		messages = append(older, newer...)
+	} else if afterId > 0 {
+		err = db.Select(&messages, newerQuery, channel.ID, afterId, channelPageSize+1)
 
 		if err != nil {
-			slog.Error("Database problem 💀",
-				slog.String("error", err.Error()),
-				slog.String("area", "after the bind to parentIds query"))
-
-			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-				"errors": []fiber.Map{{
-					"message": "Not found",
-				}},
-			})
+			return handleMessagesError(err)
 		}
 
-		for _, m := range files {
-			if m.MessageID.Valid {
-				fs, ok := filesMap[uint64(m.MessageID.Int64)]
-
-				if !ok {
-					filesMap[uint64(m.MessageID.Int64)] = []model.Files{m}
-				} else {
-					filesMap[uint64(m.MessageID.Int64)] = append(fs, m)
-				}
-
-			}
+		if len(messages) > channelPageSize {
+			hasMoreAfter = true
+			messages = messages[:channelPageSize]
 		}
-	}
 
-	if len(parentIDs) > 0 {
-		pmq, mpqArgs, err := sqlx.In("SELECT * FROM messages WHERE id IN (?)", parentIDs)
+		err = db.Get(&hasMoreBefore, fmt.Sprintf(existsQuery, "<="), channel.ID, afterId)
 
 		if err != nil {
-			slog.Error("Database problem 💀",
-				slog.String("error", err.Error()),
-				slog.String("area", "selecting parent ids IN"))
-
-			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-				"errors": []fiber.Map{{
-					"message": "Not found",
-				}},
-			})
+			return handleMessagesError(err)
 		}
+	} else {
+		var cursor uint64 = math.MaxInt64
 
-		pmq = db.Rebind(pmq)
-
-		parents := []model.Messages{}
+		if beforeId > 0 {
+			cursor = beforeId
+		}
 
-		err = db.Select(&parents, pmq, mpqArgs...)
+		err = db.Select(&messages, olderQuery, channel.ID, cursor, channelPageSize+1)
 
 		if err != nil {
-			slog.Error("Database problem 💀",
-				slog.String("error", err.Error()),
-				slog.String("area", "after the bind to parentIds query"))
-
-			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-				"errors": []fiber.Map{{
-					"message": "Not found",
-				}},
-			})
+			return handleMessagesError(err)
 		}
 
-		for _, m := range parents {
-			parentsMap[m.ID] = m
+		if len(messages) > channelPageSize {
+			hasMoreBefore = true
+			messages = messages[:channelPageSize]
 		}
-	}
 
-	var remaining uint64
-
-	err = db.Get(&remaining, "SELECT count(*) FROM messages WHERE channel_id = ? ORDER BY id DESC", channel.ID)
-
-	if err != nil {
-		slog.Error("Database problem 💀", slog.String("error", err.Error()), slog.String("area", "can't select count of messages"))
-
-		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-			"errors": []fiber.Map{{
-				"message": "Not found",
-			}},
-		})
-	}
+		slices.Reverse(messages)
 
-	nextPageAmount := (uint64(pageNumber) + 1) * 50
+		if beforeId > 0 {
+			err = db.Get(&hasMoreAfter, fmt.Sprintf(existsQuery, ">="), channel.ID, beforeId)
 
-	if remaining > nextPageAmount {
-		remaining = remaining - nextPageAmount
-	} else {
-		remaining = 0
+			if err != nil {
+				return handleMessagesError(err)
+			}
+		}
 	}
 
 	/* Got messages */
@@ -599,129 +623,48 @@ func Channel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client,
 		}
 	}
 
-	usersMap := make(map[uint64]model.Users)
-
-	for _, u := range users {
-		if _, found := usersMap[u.ID]; found {
-			continue
-		}
-		usersMap[u.ID] = u
-	}
-
-	mm := make([]fiber.Map, len(messages))
-
-	for i, m := range messages {
-
-		mu := model.GHOST_USER
-
-		if fu, found := usersMap[m.UserID]; found {
-			mu = fu
-		}
-
-		var uhr *fiber.Map
-
-		if hr, found := urhMap[m.UserID]; found && hr != nil {
-			uhr = &fiber.Map{
-				"name":  hr.Name,
-				"color": hr.Color,
-			}
-		}
-
-		reactions := model.MessagesReactions{}
-
-		rkey := fmt.Sprintf("message-reactions-%d", m.ID)
-
-		val, err := rRdb.Get(ctx, rkey).Result()
-
-		if err == nil {
-			json.Unmarshal([]byte(val), &reactions)
-		}
-
-		var avatarUrl *string = nil
-
-		if mu.CFAvatarImagesID.Valid {
-			s := os.Getenv("CLOUDFLARE_IMAGES_PROXY") + mu.CFAvatarImagesID.String + "/public"
-			avatarUrl = &s
-		}
-
-		mappedMessage := fiber.Map{
-			"id":         security_helpers.Encode(m.ID, model.MESSAGES_TYPE, m.Salt),
-			"created_at": m.CreatedAt.Format(time.RFC3339),
-			"text":       m.Text,
-			"edited":     m.Edited,
-			"user": fiber.Map{
-				"name":          mu.Name.String,
-				"handle":        mu.Handle.String,
-				"powerful_role": uhr,
-				"avatar_url":    avatarUrl,
-			},
-		}
-
-		if m.UpdatedAt.Valid {
-			maps.Copy(mappedMessage, fiber.Map{
-				"updated_at": m.UpdatedAt.Time.Format(time.RFC3339),
-			})
-		}
-
-		if reactions.MessageID == m.ID {
-			maps.Copy(mappedMessage, fiber.Map{
-				"reactions": reactions.ToFiberMap(),
-			})
-		}
-
-		files, fok := filesMap[m.ID]
+	mm, err := message_helpers.MapMessages(messages, community.ID, channelPermissions.CanView, db, wRdb, rRdb, ctx)
 
-		if fok && len(files) > 0 {
-			mfs := make([]fiber.Map, len(files))
-			for i, f := range files {
-				mfs[i] = f.ToFiberMap()
-			}
-			maps.Copy(mappedMessage, fiber.Map{
-				"files": mfs,
-			})
-		}
-
-		if p, pok := parentsMap[m.ParentID]; pok {
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "mapping messages"))
 
-			mu := model.GHOST_USER
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
 
-			if fu, found := usersMap[p.UserID]; found {
-				mu = fu
-			}
+	err = message_helpers.MarkContinuations(messages, mm, db)
 
-			var uhr *fiber.Map
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "grouping messages"))
 
-			if hr, found := urhMap[p.UserID]; found && hr != nil {
-				uhr = &fiber.Map{
-					"name":  hr.Name,
-					"color": hr.Color,
-				}
-			}
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
 
-			var avatarUrl *string = nil
+	if userOk {
+		err = message_helpers.MarkPollVotes(user.ID, messages, mm, db)
 
-			if mu.CFAvatarImagesID.Valid {
-				s := os.Getenv("CLOUDFLARE_IMAGES_PROXY") + mu.CFAvatarImagesID.String + "/public"
-				avatarUrl = &s
-			}
+		if err != nil {
+			slog.Error("Database problem 💀",
+				slog.String("error", err.Error()),
+				slog.String("area", "marking poll votes"))
 
-			maps.Copy(mappedMessage, fiber.Map{
-				"parent": fiber.Map{
-					"id":         security_helpers.Encode(p.ID, model.MESSAGES_TYPE, p.Salt),
-					"created_at": p.CreatedAt.Format(time.RFC3339),
-					"text":       p.Text,
-					"edited":     p.Edited,
-					"user": fiber.Map{
-						"name":          mu.Name.String,
-						"handle":        mu.Handle.String,
-						"powerful_role": uhr,
-						"avatar_url":    avatarUrl,
-					},
-				},
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Not found",
+				}},
 			})
 		}
-
-		mm[i] = mappedMessage
 	}
 
 	if userOk {
@@ -737,11 +680,28 @@ func Channel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client,
 		}
 	}
 
+	// Counts down on the client until the viewer can send again, moderators aren't held back
+	var retryAfter uint64 = 0
+
+	if userOk && channel.SlowModeSeconds > 0 && !permissions.ManageChannels {
+		retryAfter = message_helpers.RetryAfterSeconds(message_helpers.SlowModeRetryAfter(user.ID, channel, rRdb, ctx))
+	}
+
+	// Paging forward asks whether there's anything newer, everything else pages back in time
+	hasMore := hasMoreBefore
+
+	if afterId > 0 {
+		hasMore = hasMoreAfter
+	}
+
 	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-		"id":         security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt),
-		"created_at": channel.CreatedAt.Format(time.RFC3339),
-		"name":       channel.Name,
-		"handle":     channel.Handle,
+		"id":                security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt),
+		"created_at":        channel.CreatedAt.Format(time.RFC3339),
+		"name":              channel.Name,
+		"handle":            channel.Handle,
+		"slow_mode_seconds": channel.SlowModeSeconds,
+		"private":           channel.Private,
+		"retry_after":       retryAfter,
 		"community": fiber.Map{
 			"id":              security_helpers.Encode(community.ID, model.COMMUNITIES_TYPE, community.Salt),
 			"created_at":      community.CreatedAt.Format(time.RFC3339),
@@ -751,12 +711,14 @@ func Channel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client,
 			"server_owner":    severOwner,
 			"default_channel": defaultChannel,
 		},
-		"user":               mu,
-		"prominent_roles":    mvcr,
-		"others_online":      monline,
-		"others_offline":     moffline,
-		"messages":           mm,
-		"message_count":      len(mm),
-		"remaining_messages": remaining,
+		"user":            mu,
+		"prominent_roles": mvcr,
+		"others_online":   monline,
+		"others_offline":  moffline,
+		"messages":        mm,
+		"message_count":   len(mm),
+		"has_more":        hasMore,
+		"has_more_before": hasMoreBefore,
+		"has_more_after":  hasMoreAfter,
 	})
 }
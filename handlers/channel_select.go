@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"context"
-	"fmt"
 	"strings"
 	"time"
 
@@ -11,6 +10,7 @@ import (
 	"github.com/go-playground/validator/v10"
 	en_translations "github.com/go-playground/validator/v10/translations/en"
 	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/hibiken/asynq"
@@ -135,12 +135,21 @@ func ChannelSelect(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 	}
 
 	go func() {
-		_, err = wRdb.Set(ctx, fmt.Sprintf("user-%d-channel-%d", user.ID, channel.ID), time.Now().Format(time.RFC3339), 0).Result()
+		messageId, seq, err := message_helpers.LatestMessage(channel.ID, db)
+
+		if err == nil {
+			_, err = message_helpers.MoveReadMarkers(user, []model.ReadMarkers{{
+				ChannelID:   channel.ID,
+				CommunityID: community.ID,
+				MessageID:   messageId,
+				Seq:         seq,
+				ReadAt:      time.Now(),
+			}}, db, wRdb, ctx)
+		}
 
 		if err != nil {
-			slog.Error("Couldn't update communities redis for channel 💀",
-				slog.String("error", err.Error()),
-				slog.String("area", "not sure"))
+			slog.Error("Couldn't move read marker 💀",
+				slog.String("error", err.Error()))
 		}
 	}()
 
@@ -2,12 +2,12 @@ package handlers
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
 	"github.com/macwilko/exotic-auth/security_helpers"
 
 	"github.com/gofiber/fiber/v2"
@@ -82,7 +82,7 @@ func Community(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Clien
 
 	var topChannels []model.Channels
 
-	err = db.Select(&topChannels, "SELECT * FROM channels WHERE community_id = ? AND group_id = ?", community.ID, 0)
+	err = db.Select(&topChannels, "SELECT * FROM channels WHERE community_id = ? AND group_id = ? ORDER BY position, id", community.ID, 0)
 
 	if err != nil {
 		slog.Info("Database problem 💀")
@@ -94,55 +94,91 @@ func Community(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Clien
 		})
 	}
 
+	// Guests get the community's defaults with the everyone overwrites applied
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !ok {
+		slog.Error("Couldn't load channel permissions 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
 	filteredTopChannels := []model.Channels{}
 
 	for _, channel := range topChannels {
-		hasPermission := HasChannelPermission(user.ID, channel.ID, model.ViewChannels, db, wRdb, rRdb, ctx)
-
-		if hasPermission {
+		if channelPermissions.Has(channel.ID, model.ViewChannels) {
 			filteredTopChannels = append(filteredTopChannels, channel)
 		}
 	}
 
 	topChannels = filteredTopChannels
 
-	mtc := make([]fiber.Map, len(topChannels))
+	// Map of channel ids to unread mentions
+	mentionsMap := make(map[uint64]uint64)
 
-	for i, ch := range topChannels {
+	if userOk {
+		mentionCounts := []struct {
+			ChannelID    uint64 `db:"channel_id"`
+			MentionCount uint64 `db:"mention_count"`
+		}{}
 
-		var unreadMessages int = 0
+		mcq := `
+		SELECT channel_id, COUNT(*) AS mention_count
+		FROM users_mentions
+		WHERE user_id = ?
+		AND community_id = ?
+		AND read_at IS NULL
+		GROUP BY channel_id`
 
-		rk := fmt.Sprintf("user-%d-channel-%d", user.ID, ch.ID)
+		err = db.Select(&mentionCounts, mcq, user.ID, community.ID)
 
-		if val, err := rRdb.Get(ctx, rk).Result(); err == nil {
-			if tm, err := time.Parse(time.RFC3339, val); err == nil {
+		if err != nil {
+			slog.Error("Database problem 💀",
+				slog.String("err", err.Error()))
+		}
 
-				q := `SELECT count(*)
-				      FROM messages
-				      WHERE channel_id = ?
-				      AND NOT user_id = ?
-				      AND created_at > ?`
+		for _, mc := range mentionCounts {
+			mentionsMap[mc.ChannelID] = mc.MentionCount
+		}
+	}
 
-				err = db.Get(&unreadMessages, q, ch.ID, user.ID, tm)
+	// Map of channel ids to unread messages
+	unreadMap := make(map[uint64]uint64)
 
-				if err != nil {
-					slog.Error("Database problem 💀",
-						slog.String("err", err.Error()))
-				}
-			}
+	if userOk {
+		var channelIds = []uint64{}
+
+		err = db.Select(&channelIds, "SELECT id FROM channels WHERE community_id = ?", community.ID)
+
+		if err != nil {
+			slog.Error("Database problem 💀",
+				slog.String("err", err.Error()))
 		}
 
+		unreadMap = message_helpers.UnreadCounts(user.ID, channelIds, db, wRdb, rRdb, ctx)
+	}
+
+	mtc := make([]fiber.Map, len(topChannels))
+
+	for i, ch := range topChannels {
+
 		mtc[i] = fiber.Map{
-			"id":           security_helpers.Encode(ch.ID, model.CHANNELS_TYPE, ch.Salt),
-			"name":         ch.Name,
-			"handle":       ch.Handle,
-			"unread_count": unreadMessages,
+			"id":            security_helpers.Encode(ch.ID, model.CHANNELS_TYPE, ch.Salt),
+			"name":          ch.Name,
+			"handle":        ch.Handle,
+			"private":       ch.Private,
+			"unread_count":  unreadMap[ch.ID],
+			"mention_count": mentionsMap[ch.ID],
 		}
 	}
 
 	var channelGroups []model.ChannelGroups
 
-	err = db.Select(&channelGroups, "SELECT * FROM channel_groups WHERE community_id = ?", community.ID)
+	err = db.Select(&channelGroups, "SELECT * FROM channel_groups WHERE community_id = ? ORDER BY position, id", community.ID)
 
 	if err != nil {
 		slog.Info("Database problem 💀")
@@ -154,25 +190,13 @@ func Community(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Clien
 		})
 	}
 
-	filteredChannelGroups := []model.ChannelGroups{}
+	mg := []fiber.Map{}
 
-	for _, group := range channelGroups {
-		hasPermission := HasGroupPermission(user.ID, group.ID, db, wRdb, rRdb, ctx)
-
-		if hasPermission {
-			filteredChannelGroups = append(filteredChannelGroups, group)
-		}
-	}
-
-	channelGroups = filteredChannelGroups
-
-	mg := make([]fiber.Map, len(channelGroups))
-
-	for i, cg := range channelGroups {
+	for _, cg := range channelGroups {
 
 		channels := []model.Channels{}
 
-		err = db.Select(&channels, "SELECT * FROM channels WHERE group_id = ?", cg.ID)
+		err = db.Select(&channels, "SELECT * FROM channels WHERE group_id = ? ORDER BY position, id", cg.ID)
 
 		if err != nil {
 			slog.Info("Database problem 💀")
@@ -184,45 +208,33 @@ func Community(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Clien
 			})
 		}
 
-		mgc := make([]fiber.Map, len(channels))
-
-		for i, ch := range channels {
-
-			var unreadMessages int = 0
-
-			rk := fmt.Sprintf("user-%d-channel-%d", user.ID, ch.ID)
+		mgc := []fiber.Map{}
 
-			if val, err := rRdb.Get(ctx, rk).Result(); err == nil {
-				if tm, err := time.Parse(time.RFC3339, val); err == nil {
-
-					q := `SELECT count(*)
-					      FROM messages
-					      WHERE channel_id = ?
-					      AND NOT user_id = ?
-					      AND created_at > ?`
-
-					err = db.Get(&unreadMessages, q, ch.ID, user.ID, tm)
-
-					if err != nil {
-						slog.Error("Database problem 💀",
-							slog.String("err", err.Error()))
-					}
-				}
+		for _, ch := range channels {
+			if !channelPermissions.Has(ch.ID, model.ViewChannels) {
+				continue
 			}
 
-			mgc[i] = fiber.Map{
-				"id":           security_helpers.Encode(ch.ID, model.CHANNELS_TYPE, ch.Salt),
-				"name":         ch.Name,
-				"handle":       ch.Handle,
-				"unread_count": unreadMessages,
-			}
+			mgc = append(mgc, fiber.Map{
+				"id":            security_helpers.Encode(ch.ID, model.CHANNELS_TYPE, ch.Salt),
+				"name":          ch.Name,
+				"handle":        ch.Handle,
+				"private":       ch.Private,
+				"unread_count":  unreadMap[ch.ID],
+				"mention_count": mentionsMap[ch.ID],
+			})
+		}
+
+		// A hidden group still shows when a channel in it has been opened up
+		if len(mgc) == 0 && !channelPermissions.Groups[cg.ID].Has(model.ViewChannels) {
+			continue
 		}
 
-		mg[i] = fiber.Map{
+		mg = append(mg, fiber.Map{
 			"id":       security_helpers.Encode(cg.ID, model.CHANNEL_GROUPS_TYPE, cg.Salt),
 			"name":     cg.Name,
 			"channels": mgc,
-		}
+		})
 	}
 
 	var mu *fiber.Map = nil
@@ -274,21 +286,31 @@ func Community(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Clien
 
 	severOwner := false
 
+	var moderatorsTopic *string
+
 	if userOk {
 		severOwner = user.ID == community.OwnerID
+
+		if permissions.ManageChannels {
+			t := message_helpers.ModeratorsTopic(community)
+			moderatorsTopic = &t
+		}
 	}
 
 	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-		"id":             security_helpers.Encode(community.ID, model.COMMUNITIES_TYPE, community.Salt),
-		"created_at":     community.CreatedAt.Format(time.RFC3339),
-		"name":           community.Name,
-		"handle":         community.Handle,
-		"top_channels":   mtc,
-		"channel_groups": mg,
-		"user":           mu,
-		"private":        community.Private,
-		"show_can_join":  showCanJoin,
-		"permissions":    permissions.ToFiberMap(),
-		"server_owner":   severOwner,
+		"id":               security_helpers.Encode(community.ID, model.COMMUNITIES_TYPE, community.Salt),
+		"created_at":       community.CreatedAt.Format(time.RFC3339),
+		"name":             community.Name,
+		"handle":           community.Handle,
+		"top_channels":     mtc,
+		"channel_groups":   mg,
+		"user":             mu,
+		"private":          community.Private,
+		"show_can_join":    showCanJoin,
+		"permissions":      permissions.ToFiberMap(),
+		"server_owner":     severOwner,
+		"retention_days":   community.RetentionDays,
+		"moderators_topic": moderatorsTopic,
+		"topic":            CommunityTopic(community),
 	})
 }
@@ -0,0 +1,776 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// How many custom emoji each community can have
+const maxCommunityEmojis = 50
+
+// Emoji are shown small, there's no need for big images
+const maxEmojiFileSize = 256 * 1024
+
+type EditCommunityEmojiInput struct {
+	ID   string `json:"id" validate:"required,gte=3,lte=255"`
+	Name string `json:"name" validate:"required,gte=2,lte=32"`
+}
+
+type DeleteCommunityEmojiInput struct {
+	ID string `json:"id" validate:"required,gte=3,lte=255"`
+}
+
+func CommunityEmojis(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Starting fetch community emojis ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		return notFound(err, "can't find community")
+	}
+
+	hasPermission := HasCommunityPermission(user.ID, community.ID, model.ViewChannels, db, wRdb, rRdb, ctx)
+
+	if !hasPermission {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	emojis := []model.CommunityEmojis{}
+
+	err = db.Select(&emojis, "SELECT * FROM community_emojis WHERE community_id = ? ORDER BY name ASC", community.ID)
+
+	if err != nil {
+		return notFound(err, "selecting emojis")
+	}
+
+	me := make([]fiber.Map, len(emojis))
+
+	for i, e := range emojis {
+		me[i] = e.ToFiberMap()
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"emojis":     me,
+		"max_emojis": maxCommunityEmojis,
+	})
+}
+
+func CreateCommunityEmoji(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Creating community emoji ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	form, err := c.MultipartForm()
+
+	if err != nil {
+		slog.Error("Couldn't validate multipart form create emoji",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Invalid input.",
+			}},
+		})
+	}
+
+	if len(form.Value["name"]) == 0 || len(form.File["image"]) == 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Invalid input.",
+			}},
+		})
+	}
+
+	name := strings.ToLower(strings.TrimSpace(form.Value["name"][0]))
+
+	if !message_helpers.EmojiNamePattern.MatchString(name) {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"field":   "name",
+				"message": "Emoji names are 2 to 32 letters, numbers or underscores.",
+			}},
+		})
+	}
+
+	file := form.File["image"][0]
+
+	if len(file.Header["Content-Type"]) == 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "No files found.",
+			}},
+		})
+	}
+
+	contentType := file.Header["Content-Type"][0]
+	allowedType := (contentType == "image/png" || contentType == "image/jpeg" || contentType == "image/gif" || contentType == "image/webp")
+
+	if !allowedType {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not an allowed type.",
+			}},
+		})
+	}
+
+	if file.Size > maxEmojiFileSize {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "File too big.",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	hasPermission := HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx)
+
+	if !hasPermission {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	handleCantCreateError := func(err error) error {
+		slog.Error("Unable to create emoji 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to create emoji.",
+			}},
+		})
+	}
+
+	// Checks the quota and name before uploading anything, they're checked again under a lock below
+	emojiErrors := func(emojis []model.CommunityEmojis) []fiber.Map {
+		if len(emojis) >= maxCommunityEmojis {
+			return []fiber.Map{{
+				"message":    "Emoji limit reached.",
+				"max_emojis": maxCommunityEmojis,
+			}}
+		}
+
+		for _, e := range emojis {
+			if e.Name == name {
+				return []fiber.Map{{
+					"field":   "name",
+					"message": "Name taken.",
+				}}
+			}
+		}
+
+		return nil
+	}
+
+	existing := []model.CommunityEmojis{}
+
+	err = db.Select(&existing, "SELECT * FROM community_emojis WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleCantCreateError(err)
+	}
+
+	if errors := emojiErrors(existing); len(errors) > 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	cf, err := cloudflare.New(os.Getenv("CLOUDFLARE_API_KEY"), os.Getenv("CLOUDFLARE_API_EMAIL"))
+
+	if err != nil {
+		slog.Error("Couldn't create cf api, cf error 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	opener, err := file.Open()
+
+	if err != nil {
+		slog.Error("Couldn't open file",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Couldn't upload file.",
+			}},
+		})
+	}
+
+	salt := uuid.New().String() + filepath.Ext(file.Filename)
+
+	accountId := cloudflare.AccountIdentifier(os.Getenv("CLOUDFLARE_ACCOUNT_IDENTIFIER"))
+
+	img, err := cf.UploadImage(ctx, accountId, cloudflare.UploadImageParams{
+		File:              opener,
+		Name:              salt,
+		RequireSignedURLs: false,
+	})
+
+	opener.Close()
+
+	if err != nil {
+		slog.Error("Couldn't upload file",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Couldn't upload file.",
+			}},
+		})
+	}
+
+	// Nothing points at the image if the emoji isn't saved
+	removeImage := func() {
+		if err := cf.DeleteImage(ctx, accountId, img.ID); err != nil {
+			slog.Error("Couldn't remove emoji image 💀",
+				slog.String("error", err.Error()))
+		}
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		removeImage()
+
+		return handleCantCreateError(err)
+	}
+
+	handleTxError := func(err error) error {
+		tx.Rollback()
+
+		removeImage()
+
+		return handleCantCreateError(err)
+	}
+
+	// Locks the community's emoji so two uploads can't both take the last slot or the same name
+	err = tx.Select(&existing, "SELECT * FROM community_emojis WHERE community_id = ? FOR UPDATE", community.ID)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	if errors := emojiErrors(existing); len(errors) > 0 {
+		tx.Rollback()
+
+		removeImage()
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	createdAt := time.Now()
+
+	ic := `
+	INSERT INTO files
+	(created_at, object_salt, file_name, user_id, content_size, mime_type, cf_images_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(ic, createdAt, salt, file.Filename, user.ID, file.Size, contentType, img.ID)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	var fileId uint64
+
+	err = tx.Get(&fileId, "SELECT LAST_INSERT_ID()")
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	emoji := model.CommunityEmojis{
+		CreatedAt:   createdAt,
+		Salt:        uuid.New().String(),
+		CommunityID: community.ID,
+		Name:        name,
+		FileID:      fileId,
+		CFImagesID:  img.ID,
+		CreatedBy:   user.ID,
+	}
+
+	eq := `
+	INSERT INTO community_emojis
+	(created_at, object_salt, community_id, name, file_id, cf_images_id, created_by)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(eq, emoji.CreatedAt, emoji.Salt, emoji.CommunityID, emoji.Name, emoji.FileID, emoji.CFImagesID, emoji.CreatedBy)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	err = tx.Get(&emoji.ID, "SELECT LAST_INSERT_ID()")
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		removeImage()
+
+		return handleCantCreateError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(emoji.ToFiberMap())
+}
+
+func EditCommunityEmoji(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Editing community emoji ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(EditCommunityEmojiInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to edit emoji, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	name := strings.ToLower(strings.TrimSpace(input.Name))
+
+	if len(errors) == 0 && !message_helpers.EmojiNamePattern.MatchString(name) {
+		errors = append(errors, fiber.Map{
+			"field":   "name",
+			"message": "Emoji names are 2 to 32 letters, numbers or underscores.",
+		})
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to edit emoji, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	community, emoji, err := findCommunityEmoji(c, input.ID, db)
+
+	if err != nil {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	hasPermission := HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx)
+
+	if !hasPermission {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	if emoji.Name == name {
+		return c.Status(fiber.StatusOK).JSON(emoji.ToFiberMap())
+	}
+
+	handleCantEditError := func(err error) error {
+		slog.Error("Unable to edit emoji 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to edit emoji.",
+			}},
+		})
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return handleCantEditError(err)
+	}
+
+	handleTxError := func(err error) error {
+		tx.Rollback()
+
+		return handleCantEditError(err)
+	}
+
+	var taken uint64
+
+	err = tx.Get(&taken, "SELECT count(*) FROM community_emojis WHERE community_id = ? AND name = ? FOR UPDATE", community.ID, name)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	if taken > 0 {
+		tx.Rollback()
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"field":   "name",
+				"message": "Name taken.",
+			}},
+		})
+	}
+
+	updatedAt := time.Now()
+
+	_, err = tx.Exec("UPDATE community_emojis SET name = ?, updated_at = ? WHERE id = ?", name, updatedAt, emoji.ID)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	oldToken := emoji.Token()
+
+	emoji.Name = name
+
+	// Reactions are keyed by the emoji's token, so they follow it to the new name
+	messageIds, err := emojiReactionMessageIds(tx, community.ID, oldToken)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	_, err = tx.Exec("UPDATE reactions SET reaction = ? WHERE community_id = ? AND reaction = ?", emoji.Token(), community.ID, oldToken)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return handleCantEditError(err)
+	}
+
+	for _, mId := range messageIds {
+		message_helpers.InvalidateReactions(mId, db, wRdb, ctx)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(emoji.ToFiberMap())
+}
+
+func DeleteCommunityEmoji(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Deleting community emoji ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(DeleteCommunityEmojiInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to delete emoji, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to delete emoji, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	community, emoji, err := findCommunityEmoji(c, input.ID, db)
+
+	if err != nil {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	hasPermission := HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx)
+
+	if !hasPermission {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	handleCantDeleteError := func(err error) error {
+		slog.Error("Unable to delete emoji 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to delete emoji.",
+			}},
+		})
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return handleCantDeleteError(err)
+	}
+
+	handleTxError := func(err error) error {
+		tx.Rollback()
+
+		return handleCantDeleteError(err)
+	}
+
+	_, err = tx.Exec("DELETE FROM community_emojis WHERE id = ?", emoji.ID)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	// The image goes with the emoji, it's removed from Cloudflare once the rows are gone
+	files := []model.Files{}
+
+	err = tx.Select(&files, "SELECT * FROM files WHERE id = ?", emoji.FileID)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	_, err = tx.Exec("DELETE FROM files WHERE id = ?", emoji.FileID)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	// Reactions with the emoji would have nothing to show
+	messageIds, err := emojiReactionMessageIds(tx, community.ID, emoji.Token())
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	_, err = tx.Exec("DELETE FROM reactions WHERE community_id = ? AND reaction = ?", community.ID, emoji.Token())
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return handleCantDeleteError(err)
+	}
+
+	message_helpers.DeleteStoredFiles(ctx, files)
+
+	for _, mId := range messageIds {
+		message_helpers.InvalidateReactions(mId, db, wRdb, ctx)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"deleted": true,
+	})
+}
+
+// Finds the community from the route and one of its emoji by encoded id
+func findCommunityEmoji(c *fiber.Ctx, encodedId string, db *sqlx.DB) (model.Communities, model.CommunityEmojis, error) {
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+	emoji := model.CommunityEmojis{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return community, emoji, err
+	}
+
+	emojiId, emojiOk := security_helpers.Decode(encodedId)
+
+	if emojiId == 0 || emojiOk != model.COMMUNITY_EMOJIS_TYPE {
+		slog.Error("Emoji security ID failure 💀")
+
+		return community, emoji, sql.ErrNoRows
+	}
+
+	err = db.Get(&emoji, "SELECT * FROM community_emojis WHERE id = ? AND community_id = ? LIMIT 1", emojiId, community.ID)
+
+	if err != nil {
+		slog.Error("No emoji found 💀 "+handle,
+			slog.String("error", err.Error()))
+	}
+
+	return community, emoji, err
+}
+
+// The messages with a reaction using the token, so their cached reactions can be dropped
+func emojiReactionMessageIds(tx *sqlx.Tx, communityId uint64, token string) ([]uint64, error) {
+	messageIds := []uint64{}
+
+	err := tx.Select(&messageIds, "SELECT DISTINCT message_id FROM reactions WHERE community_id = ? AND reaction = ?", communityId, token)
+
+	return messageIds, err
+}
@@ -23,8 +23,11 @@ import (
 )
 
 type CreateChannelInput struct {
-	Name    string  `json:"name" validate:"required,gte=3,lte=32"`
-	GroupID *string `json:"group_id" validate:"omitempty,lte=255"`
+	Name         string   `json:"name" validate:"required,gte=3,lte=32"`
+	GroupID      *string  `json:"group_id" validate:"omitempty,lte=255"`
+	Private      bool     `json:"private"`
+	AllowedRoles []string `json:"allowed_roles" validate:"omitempty,lte=50,dive,gte=3,lte=255"`
+	AllowedUsers []string `json:"allowed_users" validate:"omitempty,lte=100,dive,gte=3,lte=255"`
 }
 
 func CreateChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
@@ -140,6 +143,24 @@ func CreateChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		})
 	}
 
+	allowedRoles, rolesOk := decodeChannelAccess(model.OVERWRITE_ROLE, input.AllowedRoles, community.ID, db)
+	allowedUsers, usersOk := decodeChannelAccess(model.OVERWRITE_USER, input.AllowedUsers, community.ID, db)
+
+	if !rolesOk || !usersOk {
+		slog.Info("Channel access not found 💀 " + handle)
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	// Whoever makes a private channel is let in, unless they can see every channel anyway
+	if input.Private && !HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx) && user.ID != community.OwnerID {
+		allowedUsers = append(allowedUsers, user.ID)
+	}
+
 	salt := uuid.New().String()
 
 	createdAt := time.Now()
@@ -194,7 +215,15 @@ func CreateChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		return handleTxError(err)
 	}
 
-	_, err = tx.Exec("INSERT INTO channels (created_at, object_salt, community_id, name, handle, group_id) VALUES (?, ?, ?, ?, ?, ?)", createdAt, salt, community.ID, input.Name, channelHandle, group.ID)
+	position, err := nextChannelPosition(tx, community.ID, group.ID)
+
+	if err != nil {
+		slog.Error("Couldn't find channel position, db error 💀")
+
+		return handleTxError(err)
+	}
+
+	_, err = tx.Exec("INSERT INTO channels (created_at, object_salt, community_id, name, handle, group_id, private, position) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", createdAt, salt, community.ID, input.Name, channelHandle, group.ID, input.Private, position)
 
 	if err != nil {
 		slog.Error("Couldn't insert channels, db error 💀")
@@ -212,6 +241,24 @@ func CreateChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		return handleTxError(err)
 	}
 
+	if input.Private {
+		err = setChannelAccess(tx, community.ID, channelId, model.OVERWRITE_ROLE, allowedRoles)
+
+		if err != nil {
+			slog.Error("Couldn't let roles into channel, db error 💀")
+
+			return handleTxError(err)
+		}
+
+		err = setChannelAccess(tx, community.ID, channelId, model.OVERWRITE_USER, allowedUsers)
+
+		if err != nil {
+			slog.Error("Couldn't let users into channel, db error 💀")
+
+			return handleTxError(err)
+		}
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
@@ -220,10 +267,17 @@ func CreateChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		return handleCantCreateError(err)
 	}
 
+	// Cached channel permissions don't know about the new channel yet
+	if err := ClearChannelPermissions(community.ID, db, wRdb, ctx); err != nil {
+		slog.Error("Couldn't clear channel permissions 💀",
+			slog.String("error", err.Error()))
+	}
+
 	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 		"id":         security_helpers.Encode(channelId, model.CHANNELS_TYPE, salt),
 		"created_at": createdAt.Format(time.RFC3339),
 		"name":       input.Name,
 		"handle":     channelHandle,
+		"private":    input.Private,
 	})
 }
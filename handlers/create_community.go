@@ -216,10 +216,10 @@ func CreateCommunity(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, rdb *redis.
 
 	ud := `INSERT INTO communities_users
 	(created_at, user_id, community_id, view_channels, manage_channels, manage_community, create_invite,
-	kick_members, ban_members, send_messages, attach_media, selected_channel_id)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	kick_members, ban_members, send_messages, attach_media, mention_roles, selected_channel_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	_, err = tx.Exec(ud, createdAt, user.ID, communityId, true, true, true, true, true, true, true, true, channelId)
+	_, err = tx.Exec(ud, createdAt, user.ID, communityId, true, true, true, true, true, true, true, true, true, channelId)
 
 	if err != nil {
 		slog.Error("Couldn't insert into communities users, db error 💀")
@@ -34,6 +34,7 @@ type CreateCommunityRoleInput struct {
 	BanMembers            *bool    `json:"ban_members" validate:"required"`
 	SendMessages          *bool    `json:"send_messages" validate:"required"`
 	AttachMedia           *bool    `json:"attach_media" validate:"required"`
+	MentionRoles          *bool    `json:"mention_roles"`
 	Members               []string `json:"members" validate:"required"`
 }
 
@@ -100,6 +101,12 @@ func CreateCommunityRole(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *r
 		})
 	}
 
+	// Clients from before role pings were gated don't send it
+	if input.MentionRoles == nil {
+		mentionRoles := false
+		input.MentionRoles = &mentionRoles
+	}
+
 	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
 
 	community := model.Communities{}
@@ -171,12 +178,12 @@ func CreateCommunityRole(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *r
 	insertStmt := `
 		INSERT INTO community_roles
 		(created_at, object_salt, community_id, show_online_differently, priority, name, view_channels, manage_channels,
-		manage_community, create_invite, kick_members, ban_members, send_messages, attach_media, color)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		manage_community, create_invite, kick_members, ban_members, send_messages, attach_media, mention_roles, color)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	_, err = tx.Exec(insertStmt, createdAt, salt, community.ID, input.ShowOnlineDifferently, roleCount, input.Name,
 		input.ViewChannels, input.ManageChannels, input.ManageCommunity, input.CreateInvite, input.KickMembers,
-		input.BanMembers, input.SendMessages, input.AttachMedia, input.Color)
+		input.BanMembers, input.SendMessages, input.AttachMedia, input.MentionRoles, input.Color)
 
 	if err != nil {
 		return handleTxError(err, "Couldn't insert roles, db error 💀")
@@ -217,9 +224,7 @@ func CreateCommunityRole(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *r
 		}
 
 		for _, roleUser := range rolesUsers {
-			rk := model.PermissionRedisKey(roleUser.UserID, community.ID)
-
-			_, err = wRdb.Del(ctx, rk).Result()
+			_, err = wRdb.Del(ctx, model.PermissionRedisKey(roleUser.UserID, community.ID), model.ChannelPermissionsRedisKey(roleUser.UserID, community.ID)).Result()
 
 			if err != nil {
 				return handleTxError(err, "Couldn't delete roles, redis error 💀")
@@ -264,6 +269,10 @@ func CreateCommunityRole(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *r
 				_, err = tx.Exec("UPDATE communities_users SET attach_media = ? WHERE user_id = ? AND community_id =?", true, roleUser.UserID, roleUser.CommunityID)
 			}
 
+			if input.MentionRoles != nil && *input.MentionRoles && !roleUser.MentionRoles {
+				_, err = tx.Exec("UPDATE communities_users SET mention_roles = ? WHERE user_id = ? AND community_id =?", true, roleUser.UserID, roleUser.CommunityID)
+			}
+
 			if err != nil {
 				return handleTxError(err, "Couldn't insert roles, db error 💀")
 			}
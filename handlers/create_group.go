@@ -152,17 +152,27 @@ func CreateGroup(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		return handleCantCreateError(err)
 	}
 
+	var position uint32
+
+	err = tx.Get(&position, "SELECT COALESCE(MAX(position) + 1, 0) FROM channel_groups WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		slog.Error("Couldn't find group position, db error 💀")
+
+		return handleTxError(err)
+	}
+
 	iq := `
 	INSERT INTO channel_groups
-	(created_at, object_salt, community_id, name)
-	VALUES (?, ?, ?, ?)
+	(created_at, object_salt, community_id, name, position)
+	VALUES (?, ?, ?, ?, ?)
 	`
 
 	salt := uuid.New().String()
 
 	createdAt := time.Now()
 
-	_, err = tx.Exec(iq, createdAt, salt, community.ID, input.Name)
+	_, err = tx.Exec(iq, createdAt, salt, community.ID, input.Name, position)
 
 	if err != nil {
 		slog.Error("Couldn't insert channels, db error 💀")
@@ -188,6 +198,12 @@ func CreateGroup(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		return handleCantCreateError(err)
 	}
 
+	// Cached channel permissions don't know about the new group yet
+	if err := ClearChannelPermissions(community.ID, db, wRdb, ctx); err != nil {
+		slog.Error("Couldn't clear channel permissions 💀",
+			slog.String("error", err.Error()))
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"id":         security_helpers.Encode(groupId, model.CHANNEL_GROUPS_TYPE, salt),
 		"created_at": createdAt.Format(time.RFC3339),
@@ -5,9 +5,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"maps"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,22 +17,49 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
-	"github.com/imroc/req/v3"
 	"github.com/jmoiron/sqlx"
 	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
-	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/message_helpers"
 	"github.com/macwilko/exotic-auth/security_helpers"
+	"github.com/macwilko/exotic-auth/tasks"
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/exp/slog"
 )
 
 type CreateMessageInput struct {
-	Text      string  `json:"text" validate:"required,lte=2000"`
-	ChannelID string  `json:"channel_id" validate:"required,lte=255"`
-	ParentID  *string `json:"parent_id" validate:"omitempty,lte=255"`
+	Text      string                  `json:"text" validate:"required,lte=2000"`
+	ChannelID string                  `json:"channel_id" validate:"required,lte=255"`
+	ParentID  *string                 `json:"parent_id" validate:"omitempty,lte=255"`
+	Poll      *CreateMessagePollInput `json:"poll" validate:"omitempty"`
+	Nonce     *string                 `json:"nonce" validate:"omitempty,lte=64"`
+}
+
+// Sent as a JSON string in the poll form field
+type CreateMessagePollInput struct {
+	Question       string   `json:"question" validate:"required,lte=300"`
+	Options        []string `json:"options" validate:"required,min=2,max=10,dive,required,lte=100"`
+	MultipleChoice bool     `json:"multiple_choice"`
+	ClosesAt       *string  `json:"closes_at" validate:"omitempty,lte=64"`
+}
+
+// The longest a poll can stay open for
+const maxPollDuration = 30 * 24 * time.Hour
+
+// How long a client's nonce is remembered, a retry after this posts the message again
+const messageNonceWindow = 10 * time.Minute
+
+// Stored against a nonce while its message is still being created
+const messageNoncePending = "pending"
+
+func messageNonceKey(userId uint64, nonce string) string {
+	return fmt.Sprintf("user-%d-message-nonce-%s", userId, nonce)
 }
 
 func tempDir() string {
@@ -102,8 +129,79 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 
 	}
 
+	if len(form.Value["nonce"]) > 0 && len(form.Value["nonce"][0]) > 0 {
+		input.Nonce = &form.Value["nonce"][0]
+
+		if len(*input.Nonce) > 64 {
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"field":   "Nonce",
+					"message": "Nonce must be a maximum of 64 characters in length",
+				}},
+			})
+		}
+	}
+
 	var errors []fiber.Map
 
+	var pollClosesAt sql.NullTime
+
+	if len(form.Value["poll"]) > 0 {
+		input.Poll = new(CreateMessagePollInput)
+
+		err = json.Unmarshal([]byte(form.Value["poll"][0]), input.Poll)
+
+		if err != nil {
+			slog.Warn("Invalid poll input 💀")
+
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Invalid input.",
+				}},
+			})
+		}
+
+		input.Poll.Question = strings.TrimSpace(input.Poll.Question)
+
+		for i, o := range input.Poll.Options {
+			input.Poll.Options[i] = strings.TrimSpace(o)
+		}
+
+		validate := validator.New()
+		en := en.New()
+		uni := ut.New(en, en)
+		trans, _ := uni.GetTranslator("en")
+		en_translations.RegisterDefaultTranslations(validate, trans)
+		err = validate.Struct(input.Poll)
+
+		if err != nil {
+			slog.Error("Unable to create poll, input 💀",
+				slog.String("error", err.Error()))
+
+			errs := err.(validator.ValidationErrors)
+
+			for _, v := range errs {
+				errors = append(errors, fiber.Map{
+					"field":   v.Field(),
+					"message": v.Translate(trans),
+				})
+			}
+		}
+
+		if input.Poll.ClosesAt != nil {
+			closesAt, err := time.Parse(time.RFC3339, *input.Poll.ClosesAt)
+
+			if err != nil || !closesAt.After(time.Now()) || closesAt.After(time.Now().Add(maxPollDuration)) {
+				errors = append(errors, fiber.Map{
+					"field":   "ClosesAt",
+					"message": "Polls have to close in the next 30 days.",
+				})
+			}
+
+			pollClosesAt = sql.NullTime{Time: closesAt, Valid: true}
+		}
+	}
+
 	if len(errors) > 0 {
 		slog.Error("Unable to create message, input error 💀")
 
@@ -124,8 +222,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		})
 	}
 
-	hasFiles := len(files) > 0
-
 	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
 
 	community := model.Communities{}
@@ -143,9 +239,7 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		})
 	}
 
-	hasPermission := HasCommunityPermission(user.ID, community.ID, model.SendMessages, db, wRdb, rRdb, ctx)
-
-	if !hasPermission {
+	notAllowed := func() error {
 		slog.Warn("Not allowed")
 
 		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
@@ -155,6 +249,15 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		})
 	}
 
+	// Sending is decided per channel below, overwrites can open a channel up beyond the community's permissions
+	if _, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx); !member {
+		return notAllowed()
+	}
+
+	if remaining := CommunityTimeout(user.ID, community.ID, db, wRdb, rRdb, ctx); remaining > 0 {
+		return timedOutError(c, remaining)
+	}
+
 	channel := model.Channels{}
 
 	channelId, channelOk := security_helpers.Decode(input.ChannelID)
@@ -182,115 +285,103 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		})
 	}
 
-	salt := uuid.New().String()
-
-	createdAt := time.Now()
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
 
-	handleCantCreateError := func(err error) error {
-		slog.Error("Unable to create message. 💀")
-
-		if err != nil {
-			slog.Error(err.Error())
-		}
+	if !ok || !channelPermissions.Has(channel.ID, model.SendMessages) {
+		return notAllowed()
+	}
 
-		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-			"errors": []fiber.Map{{
-				"message": "Unable to create message.",
-			}},
-		})
+	if len(files) > 0 && !channelPermissions.Has(channel.ID, model.AttachMedia) {
+		return notAllowed()
 	}
 
-	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+	canMentionRoles := channelPermissions.Has(channel.ID, model.MentionRoles)
 
-	if err != nil {
-		slog.Error("Couldn't begin tx, db error 💀")
+	// Retries of a send that's already been made get the original message back instead of a duplicate
+	nonceClaimed := false
+	committed := false
 
-		return handleCantCreateError(err)
-	}
+	if input.Nonce != nil {
+		nonceKey := messageNonceKey(user.ID, *input.Nonce)
 
-	handleTxError := func(err error) error {
-		tx.Rollback()
+		claimed, err := wRdb.SetNX(ctx, nonceKey, messageNoncePending, messageNonceWindow).Result()
 
-		return handleCantCreateError(err)
-	}
+		if err != nil {
+			// Without redis the send goes ahead, a duplicate is better than losing the message
+			slog.Error("Couldn't claim message nonce 💀",
+				slog.String("error", err.Error()))
+		} else if !claimed {
+			return existingNonceMessage(c, ctx, user, community, *input.Nonce, db, wRdb, rRdb)
+		} else {
+			nonceClaimed = true
 
-	var parentId uint64 = 0
+			defer func() {
+				if !committed {
+					wRdb.Del(ctx, nonceKey)
+				}
+			}()
+		}
+	}
 
-	if input.ParentID != nil {
+	blockedBy, flaggedBy := checkAutomod(user, community, input.Text, db, wRdb, rRdb, ctx)
 
-		pId, parentOk := security_helpers.Decode(*input.ParentID)
+	if blockedBy != nil {
+		return automodError(c, user, community, *blockedBy, db, wRdb, ctx)
+	}
 
-		if pId == 0 || parentOk != model.MESSAGES_TYPE {
-			slog.Error("Channel security ID failure 💀 ")
+	if channel.SlowModeSeconds > 0 && !channelPermissions.Has(channel.ID, model.ManageChannels) {
+		allowed, retryAfter, err := message_helpers.ClaimSlowMode(user.ID, channel, wRdb, ctx)
 
-			tx.Rollback()
+		if err != nil {
+			// Without redis the send goes ahead, slow mode is only there to calm busy channels
+			slog.Error("Couldn't claim slow mode 💀",
+				slog.String("error", err.Error()))
+		} else if !allowed {
+			slog.Warn("Slow mode is on")
 
 			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 				"errors": []fiber.Map{{
-					"message": "Not found",
+					"code":        "slow_mode",
+					"message":     "Slow mode is on, wait before sending another message.",
+					"retry_after": message_helpers.RetryAfterSeconds(retryAfter),
 				}},
 			})
+		} else {
+			defer func() {
+				if !committed {
+					message_helpers.ReleaseSlowMode(user.ID, channel, wRdb, ctx)
+				}
+			}()
 		}
-
-		parent := model.Messages{}
-
-		err = tx.Get(&parent, "SELECT * FROM messages WHERE id = ? AND community_id = ? LIMIT 1", pId, community.ID)
-
-		if err != nil {
-			slog.Error("Couldn't find parent message, db error 💀")
-
-			return handleTxError(err)
-		}
-
-		slog.Info("🔥 Replying to a parent")
-
-		parentId = pId
 	}
 
-	message := model.Messages{}
-
-	tx.Get(&message, "SELECT * FROM messages WHERE channel_id = ? ORDER BY id DESC LIMIT 1", channelId)
-
-	var messageId uint64
-
-	var prevCount uint64
-
-	tx.Get(&prevCount, "SELECT count(*) FROM files WHERE message_id = ? AND user_id = ?", message.ID, user.ID)
-
-	if message.UserID == user.ID && parentId == 0 && !hasFiles && prevCount == 0 {
-
-		messageId = message.ID
-
-		updatedAt := time.Now()
-
-		text := message.Text + "\n" + input.Text
-
-		_, err = tx.Exec("UPDATE messages SET text = ?, created_at = ?, updated_at = ? WHERE id = ?", text, updatedAt, updatedAt, messageId)
-
-		if err != nil {
-			slog.Error("Couldn't edit messages, db error 💀")
-
-			return handleTxError(err)
-		}
+	salt := uuid.New().String()
 
-	} else {
+	createdAt := time.Now()
 
-		_, err = tx.Exec("INSERT INTO messages (created_at, object_salt, community_id, channel_id, user_id, text, parent_id) VALUES (?, ?, ?, ?, ?, ?, ?)", createdAt, salt, community.ID, channel.ID, user.ID, input.Text, parentId)
+	handleCantCreateError := func(err error) error {
+		slog.Error("Unable to create message. 💀")
 
 		if err != nil {
-			slog.Error("Couldn't insert messages, db error 💀")
-
-			return handleTxError(err)
+			slog.Error(err.Error())
 		}
 
-		err = tx.Get(&messageId, "SELECT LAST_INSERT_ID()")
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to create message.",
+			}},
+		})
+	}
 
-		if err != nil {
-			slog.Error("Couldn't get last insert for messages, db error 💀")
+	// Uploads happen before the transaction, the seq taken in it locks the channel row until
+	// commit and a slow upload would hold up every other send in the channel
+	uploaded := []model.Files{}
 
-			return handleTxError(err)
+	defer func() {
+		if !committed {
+			message_helpers.DeleteStoredFiles(ctx, uploaded)
 		}
-	}
+	}()
 
 	for _, file := range files {
 
@@ -303,8 +394,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		if len(file.Header["Content-Type"]) == 0 {
 			slog.Error("Files length was zero")
 
-			tx.Rollback()
-
 			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 				"errors": []fiber.Map{{
 					"message": "Not an allowed type.",
@@ -319,8 +408,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		if !validType {
 			slog.Error("Files length was zero")
 
-			tx.Rollback()
-
 			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 				"errors": []fiber.Map{{
 					"message": "Not an allowed type.",
@@ -335,8 +422,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 				slog.Error("Couldn't open file",
 					slog.String("error", err.Error()))
 
-				tx.Rollback()
-
 				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 					"errors": []fiber.Map{{
 						"message": "Couldn't upload file.",
@@ -356,8 +441,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 				slog.Error("Couldn't upload file",
 					slog.String("error", err.Error()))
 
-				tx.Rollback()
-
 				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 					"errors": []fiber.Map{{
 						"message": "Couldn't upload file.",
@@ -365,25 +448,15 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 				})
 			}
 
-			ic := `
-			INSERT INTO files
-			(created_at, object_salt, file_name, user_id, content_size, message_id, mime_type, cf_images_id)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-
-			_, err = tx.Exec(ic, createdAt, filename, file.Filename, user.ID, file.Size, messageId, contentType, img.ID)
-
-			if err != nil {
-				slog.Error("Couldn't insert files, db error 💀",
-					slog.String("error", err.Error()))
-
-				tx.Rollback()
-
-				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-					"errors": []fiber.Map{{
-						"message": "Invalid input.",
-					}},
-				})
-			}
+			uploaded = append(uploaded, model.Files{
+				CreatedAt:   createdAt,
+				Salt:        filename,
+				FileName:    file.Filename,
+				UserID:      user.ID,
+				ContentSize: uint64(file.Size),
+				MimeType:    sql.NullString{String: contentType, Valid: true},
+				CFImagesID:  sql.NullString{String: img.ID, Valid: true},
+			})
 		} else if strings.Contains(contentType, "video") {
 			tempFile := fmt.Sprintf("%s/%s", tempDir(), filename)
 
@@ -392,8 +465,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 				slog.Error("Couldn't save file to tmp",
 					slog.String("error", err.Error()))
 
-				tx.Rollback()
-
 				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 					"errors": []fiber.Map{{
 						"message": "Couldn't upload file.",
@@ -410,8 +481,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 				slog.Error("Couldn't upload file",
 					slog.String("error", err.Error()))
 
-				tx.Rollback()
-
 				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 					"errors": []fiber.Map{{
 						"message": "Couldn't upload file.",
@@ -426,25 +495,16 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 					slog.String("error", err.Error()))
 			}
 
-			ic := `
-			INSERT INTO files
-			(created_at, object_salt, file_name, user_id, content_size, message_id, mime_type, cf_video_stream_uid, cf_video_stream_thumbnail)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
-
-			_, err = tx.Exec(ic, createdAt, filename, file.Filename, user.ID, file.Size, messageId, contentType, video.UID, video.Thumbnail)
-
-			if err != nil {
-				slog.Error("Couldn't insert files, db error 💀",
-					slog.String("error", err.Error()))
-
-				tx.Rollback()
-
-				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-					"errors": []fiber.Map{{
-						"message": "Invalid input.",
-					}},
-				})
-			}
+			uploaded = append(uploaded, model.Files{
+				CreatedAt:              createdAt,
+				Salt:                   filename,
+				FileName:               file.Filename,
+				UserID:                 user.ID,
+				ContentSize:            uint64(file.Size),
+				MimeType:               sql.NullString{String: contentType, Valid: true},
+				CFVideoStreamUID:       sql.NullString{String: video.UID, Valid: true},
+				CFVideoStreamThumbnail: sql.NullString{String: video.Thumbnail, Valid: true},
+			})
 		} else {
 			bucketName := os.Getenv("CLOUDFLARE_BUCKET_NAME")
 			accountId := os.Getenv("CLOUDFLARE_ACCOUNT_IDENTIFIER")
@@ -469,8 +529,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 				slog.Error("Couldn't get S3 context 💀",
 					slog.String("error", err.Error()))
 
-				tx.Rollback()
-
 				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 					"errors": []fiber.Map{{
 						"message": "Couldn't upload file.",
@@ -488,8 +546,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 				slog.Error("Couldn't open file 💀",
 					slog.String("error", err.Error()))
 
-				tx.Rollback()
-
 				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 					"errors": []fiber.Map{{
 						"message": "Couldn't upload file.",
@@ -507,8 +563,6 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 				slog.Error("Couldn't upload file 💀",
 					slog.String("error", err.Error()))
 
-				tx.Rollback()
-
 				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 					"errors": []fiber.Map{{
 						"message": "Couldn't upload file.",
@@ -516,25 +570,114 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 				})
 			}
 
-			ic := `
-			INSERT INTO files
-			(created_at, object_salt, file_name, user_id, content_size, message_id, mime_type, cf_r2_uid)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+			uploaded = append(uploaded, model.Files{
+				CreatedAt:   createdAt,
+				Salt:        filename,
+				FileName:    file.Filename,
+				UserID:      user.ID,
+				ContentSize: uint64(file.Size),
+				MimeType:    sql.NullString{String: contentType, Valid: true},
+				CFF2ID:      sql.NullString{String: aws.ToString(result.Key), Valid: true},
+			})
+		}
+	}
 
-			_, err = tx.Exec(ic, createdAt, filename, file.Filename, user.ID, file.Size, messageId, contentType, result.Key)
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
 
-			if err != nil {
-				slog.Error("Couldn't insert files, db error 💀",
-					slog.String("error", err.Error()))
+	if err != nil {
+		slog.Error("Couldn't begin tx, db error 💀")
 
-				tx.Rollback()
+		return handleCantCreateError(err)
+	}
 
-				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-					"errors": []fiber.Map{{
-						"message": "Invalid input.",
-					}},
-				})
-			}
+	handleTxError := func(err error) error {
+		tx.Rollback()
+
+		return handleCantCreateError(err)
+	}
+
+	var parentId uint64 = 0
+
+	parent := model.Messages{}
+
+	if input.ParentID != nil {
+
+		pId, parentOk := security_helpers.Decode(*input.ParentID)
+
+		if pId == 0 || parentOk != model.MESSAGES_TYPE {
+			slog.Error("Channel security ID failure 💀 ")
+
+			tx.Rollback()
+
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Not found",
+				}},
+			})
+		}
+
+		err = tx.Get(&parent, "SELECT * FROM messages WHERE id = ? AND community_id = ? AND channel_id = ? AND deleted = 0 LIMIT 1", pId, community.ID, channel.ID)
+
+		if err != nil {
+			slog.Error("Couldn't find parent message, db error 💀")
+
+			return handleTxError(err)
+		}
+
+		slog.Info("🔥 Replying to a parent")
+
+		parentId = pId
+	}
+
+	message, mentionedUserIds, err := message_helpers.InsertMessage(tx, model.Messages{
+		CreatedAt:   createdAt,
+		Salt:        salt,
+		CommunityID: community.ID,
+		ChannelID:   channel.ID,
+		UserID:      user.ID,
+		Text:        input.Text,
+		ParentID:    parentId,
+	}, canMentionRoles, channelPermissions.CanView, db)
+
+	if err != nil {
+		slog.Error("Couldn't insert messages, db error 💀")
+
+		return handleTxError(err)
+	}
+
+	messageId := message.ID
+
+	var poll model.Polls
+
+	if input.Poll != nil {
+		poll, err = message_helpers.SavePoll(tx, message, input.Poll.Question, input.Poll.Options, input.Poll.MultipleChoice, pollClosesAt)
+
+		if err != nil {
+			slog.Error("Couldn't insert poll, db error 💀")
+
+			return handleTxError(err)
+		}
+	}
+
+	for _, f := range uploaded {
+		ic := `
+		INSERT INTO files
+		(created_at, object_salt, file_name, user_id, content_size, message_id, mime_type, cf_images_id, cf_video_stream_uid, cf_video_stream_thumbnail, cf_r2_uid)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+		_, err = tx.Exec(ic, f.CreatedAt, f.Salt, f.FileName, f.UserID, f.ContentSize, messageId, f.MimeType, f.CFImagesID, f.CFVideoStreamUID, f.CFVideoStreamThumbnail, f.CFF2ID)
+
+		if err != nil {
+			slog.Error("Couldn't insert files, db error 💀",
+				slog.String("error", err.Error()))
+
+			tx.Rollback()
+
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Invalid input.",
+				}},
+			})
 		}
 	}
 
@@ -546,23 +689,54 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		return handleCantCreateError(err)
 	}
 
-	go func() {
-		_, err = wRdb.Set(ctx, fmt.Sprintf("user-%d-channel-%d", user.ID, channel.ID), time.Now().Format(time.RFC3339), 0).Result()
+	committed = true
+
+	message_helpers.CacheChannelSeq(channel.ID, message.Seq, wRdb, ctx)
+	message_helpers.CacheSentReadMarker(message, wRdb, ctx)
+
+	if len(flaggedBy) > 0 {
+		go message_helpers.SaveAutomodFlags(message, flaggedBy, db)
+	}
+
+	if nonceClaimed {
+		_, err = wRdb.Set(ctx, messageNonceKey(user.ID, *input.Nonce), messageId, messageNonceWindow).Result()
 
 		if err != nil {
-			slog.Error("Couldn't update communities redis for channel 💀",
-				slog.String("error", err.Error()),
-				slog.String("area", "not sure"))
+			slog.Error("Couldn't save message nonce 💀",
+				slog.String("error", err.Error()))
 		}
-	}()
+	}
+
+	if poll.ClosesAt.Valid {
+		task, err := tasks.NewClosePollTask(poll.ID)
 
-	var avatarUrl *string = nil
+		if err == nil {
+			_, err = queue.Enqueue(task, asynq.ProcessAt(poll.ClosesAt.Time), asynq.TaskID(tasks.ClosePollTaskID(poll.ID)))
+		}
 
-	if user.CFAvatarImagesID.Valid {
-		s := os.Getenv("CLOUDFLARE_IMAGES_PROXY") + user.CFAvatarImagesID.String + "/public"
-		avatarUrl = &s
+		// Voting still stops at the close time, only the poll.closed event is lost
+		if err != nil {
+			slog.Error("Couldn't schedule poll close 💀",
+				slog.String("error", err.Error()),
+				slog.Uint64("pId", poll.ID))
+		}
 	}
 
+	go func() {
+		_, err := message_helpers.MoveReadMarkers(user, []model.ReadMarkers{{
+			ChannelID:   channel.ID,
+			CommunityID: community.ID,
+			MessageID:   messageId,
+			Seq:         message.Seq,
+			ReadAt:      createdAt,
+		}}, db, wRdb, ctx)
+
+		if err != nil {
+			slog.Error("Couldn't move read marker 💀",
+				slog.String("error", err.Error()))
+		}
+	}()
+
 	newMessage := model.Messages{}
 
 	err = db.Get(&newMessage, "SELECT * FROM messages WHERE id = ? LIMIT 1", messageId)
@@ -575,11 +749,13 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		})
 	}
 
-	rolesUsers := []model.CommuniyRolesUsers{}
-
-	err = db.Select(&rolesUsers, "SELECT * FROM community_roles_users WHERE community_id = ? AND user_id = ? ", community.ID, user.ID)
+	mapped, err := message_helpers.MapMessages([]model.Messages{newMessage}, community.ID, message_helpers.PublicChannels, db, wRdb, rRdb, ctx)
 
 	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "mapping new message"))
+
 		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 			"errors": []fiber.Map{{
 				"message": "Not found",
@@ -587,79 +763,51 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		})
 	}
 
-	var cids = []uint64{}
+	mappedMessage := mapped[0]
 
-	for _, ru := range rolesUsers {
-		cids = append(cids, ru.CommunityRoleID)
-	}
+	err = message_helpers.MarkContinuations([]model.Messages{newMessage}, mapped, db)
 
-	mappedUser := fiber.Map{
-		"name":       user.Name.String,
-		"handle":     user.Handle.String,
-		"avatar_url": avatarUrl,
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "grouping new message"))
 	}
 
-	if len(cids) > 0 {
-
-		rolesQuery, rolesArgs, err := sqlx.In("SELECT * FROM community_roles WHERE id IN (?) ORDER BY priority ASC LIMIT 1", cids)
-
-		if err != nil {
-			slog.Error("Database problem 💀",
-				slog.String("error", err.Error()),
-				slog.String("area", "community_roles_users"))
-
-			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-				"errors": []fiber.Map{{
-					"message": "Not found",
-				}},
-			})
-		}
-
-		rolesQuery = db.Rebind(rolesQuery)
-
-		role := model.CommunityRoles{}
+	if input.Nonce != nil {
+		mappedMessage["nonce"] = *input.Nonce
+	}
 
-		err = db.Get(&role, rolesQuery, rolesArgs...)
+	go message_helpers.BroadcastNewMessage(newMessage, mappedMessage, channel, parent, mentionedUserIds, db, wRdb, rRdb, ctx)
 
-		if err != nil {
-			slog.Error("Database problem 💀",
-				slog.String("error", err.Error()),
-				slog.String("area", "after the bind selecting roles"))
-
-			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-				"errors": []fiber.Map{{
-					"message": "Not found",
-				}},
-			})
-		}
+	return c.Status(fiber.StatusOK).JSON(&mappedMessage)
+}
 
-		uhr := fiber.Map{
-			"name":  role.Name,
-			"color": role.Color,
-		}
+// Sends back the message a nonce was already used for, or tells the client it's still being sent
+func existingNonceMessage(c *fiber.Ctx, ctx context.Context, user model.Users, community model.Communities, nonce string, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client) error {
+	val, err := wRdb.Get(ctx, messageNonceKey(user.ID, nonce)).Result()
 
-		maps.Copy(mappedUser, fiber.Map{
-			"powerful_role": uhr,
+	if err != nil || val == messageNoncePending {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Message already being sent.",
+				"nonce":   nonce,
+			}},
 		})
 	}
 
-	mappedMessage := fiber.Map{
-		"id":         security_helpers.Encode(messageId, model.MESSAGES_TYPE, newMessage.Salt),
-		"created_at": newMessage.CreatedAt.Format(time.RFC3339),
-		"text":       newMessage.Text,
-		"edited":     newMessage.Edited,
-		"user":       mappedUser,
-	}
+	messageId, err := strconv.ParseUint(val, 10, 64)
 
-	if newMessage.UpdatedAt.Valid {
-		maps.Copy(mappedMessage, fiber.Map{
-			"updated_at": newMessage.UpdatedAt.Time.Format(time.RFC3339),
+	if err != nil {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
 		})
 	}
 
-	mfiles := []model.Files{}
+	message := model.Messages{}
 
-	err = db.Select(&mfiles, "SELECT * FROM files WHERE message_id = ?", messageId)
+	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND user_id = ? AND community_id = ? LIMIT 1", messageId, user.ID, community.ID)
 
 	if err != nil {
 		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
@@ -669,82 +817,35 @@ func CreateMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		})
 	}
 
-	if len(mfiles) > 0 {
-		mfs := make([]fiber.Map, len(mfiles))
-		for i, f := range mfiles {
-			mfs[i] = f.ToFiberMap()
-		}
-		maps.Copy(mappedMessage, fiber.Map{
-			"files": mfs,
-		})
-	}
-
-	if newMessage.ParentID > 0 {
-		pMessage := model.Messages{}
-
-		err = db.Get(&pMessage, "SELECT * FROM messages WHERE id = ? LIMIT 1", newMessage.ParentID)
-
-		if err != nil {
-			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-				"errors": []fiber.Map{{
-					"message": "Not found",
-				}},
-			})
-		}
-
-		pUser := model.Users{}
+	slog.Info("Message nonce already used ✅", slog.Uint64("mId", message.ID))
 
-		err = db.Get(&pUser, "SELECT * FROM users WHERE id = ? LIMIT 1", pMessage.UserID)
-
-		if err != nil {
-			pUser = model.GHOST_USER
-		}
+	channelPermissions, _ := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
 
-		var avatarUrl *string = nil
+	mapped, err := message_helpers.MapMessages([]model.Messages{message}, community.ID, channelPermissions.CanView, db, wRdb, rRdb, ctx)
 
-		if pUser.CFAvatarImagesID.Valid {
-			s := os.Getenv("CLOUDFLARE_IMAGES_PROXY") + pUser.CFAvatarImagesID.String + "/public"
-			avatarUrl = &s
-		}
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "mapping nonce message"))
 
-		maps.Copy(mappedMessage, fiber.Map{
-			"parent": fiber.Map{
-				"id":         security_helpers.Encode(pMessage.ID, model.MESSAGES_TYPE, pMessage.Salt),
-				"created_at": pMessage.CreatedAt.Format(time.RFC3339),
-				"text":       pMessage.Text,
-				"edited":     pMessage.Edited,
-				"user": fiber.Map{
-					"name":   pUser.Name.String,
-					"handle": pUser.Handle.String,
-					// "powerful_role": uhr,
-					"avatar_url": avatarUrl,
-				},
-			},
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
 		})
 	}
 
-	go func() {
-		client := req.C()
-
-		marshalled, err := json.Marshal(mappedMessage)
-
-		if err != nil {
-			slog.Error("💀 Couldn't marshal message",
-				slog.String("error", err.Error()))
+	err = message_helpers.MarkContinuations([]model.Messages{message}, mapped, db)
 
-			return
-		}
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "grouping nonce message"))
+	}
 
-		client.R().
-			SetContentType("application/json").
-			SetBody(&internal_handlers.BroadcastMessageInput{
-				Topic:   security_helpers.Encode(channelId, model.CHANNELS_TYPE, channel.Salt),
-				Message: string(marshalled),
-			}).
-			Post(os.Getenv("PRIVATE_WS_INTERNAL_API") + "/broadcast-message")
+	mappedMessage := mapped[0]
 
-		slog.Info("✅ Broadcasted message event")
-	}()
+	mappedMessage["nonce"] = nonce
 
 	return c.Status(fiber.StatusOK).JSON(&mappedMessage)
 }
@@ -176,6 +176,114 @@ func DeleteChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		return handleTxError(err, "Couldn't delete messages, db error 💀")
 	}
 
+	uq = `
+		DELETE FROM messages_mentions
+		WHERE channel_id = ?
+		AND community_id = ?
+	`
+
+	_, err = tx.Exec(uq, channelId, community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete mentions, db error 💀")
+	}
+
+	uq = `
+		DELETE FROM users_mentions
+		WHERE channel_id = ?
+		AND community_id = ?
+	`
+
+	_, err = tx.Exec(uq, channelId, community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete mentions, db error 💀")
+	}
+
+	uq = `
+		DELETE FROM messages_pins
+		WHERE channel_id = ?
+		AND community_id = ?
+	`
+
+	_, err = tx.Exec(uq, channelId, community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete pins, db error 💀")
+	}
+
+	uq = `
+		DELETE FROM messages_revisions
+		WHERE channel_id = ?
+		AND community_id = ?
+	`
+
+	_, err = tx.Exec(uq, channelId, community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete revisions, db error 💀")
+	}
+
+	uq = `
+		DELETE FROM reactions
+		WHERE channel_id = ?
+		AND community_id = ?
+	`
+
+	_, err = tx.Exec(uq, channelId, community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete reactions, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE polls_votes FROM polls_votes JOIN polls ON polls.id = polls_votes.poll_id WHERE polls.channel_id = ?", channelId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete polls, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE polls_options FROM polls_options JOIN polls ON polls.id = polls_options.poll_id WHERE polls.channel_id = ?", channelId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete polls, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM polls WHERE channel_id = ?", channelId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete polls, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM scheduled_messages WHERE channel_id = ?", channelId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete scheduled messages, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM bookmarks WHERE channel_id = ?", channelId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete bookmarks, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM read_markers WHERE channel_id = ?", channelId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete read markers, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM automod_flags WHERE channel_id = ?", channelId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete automod flags, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM permission_overwrites WHERE channel_id = ?", channelId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete permission overwrites, db error 💀")
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
@@ -98,6 +98,102 @@ func DeleteCommunity(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, rdb *redis.
 		return handleTxError(err, "Couldn't delete communities, db error 💀")
 	}
 
+	_, err = tx.Exec("DELETE FROM messages_mentions WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM users_mentions WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM messages_pins WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM messages_revisions WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM reactions WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM community_emojis WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE polls_votes FROM polls_votes JOIN polls ON polls.id = polls_votes.poll_id WHERE polls.community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE polls_options FROM polls_options JOIN polls ON polls.id = polls_options.poll_id WHERE polls.community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM polls WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM scheduled_messages WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM bookmarks WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM read_markers WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM automod_rules WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM automod_flags WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM reports WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
+	_, err = tx.Exec("DELETE FROM permission_overwrites WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete communities, db error 💀")
+	}
+
 	_, err = tx.Exec("DELETE FROM community_roles_users WHERE community_id = ?", community.ID)
 
 	if err != nil {
@@ -184,6 +184,12 @@ func DeleteCommunityRole(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *r
 		return handleTxError(err, "Couldn't delete roles, db error 💀")
 	}
 
+	_, err = tx.Exec("DELETE FROM permission_overwrites WHERE target_type = ? AND target_id = ?", model.OVERWRITE_ROLE, roleId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete role permission overwrites, db error 💀")
+	}
+
 	var rolesUserIds []uint64
 
 	err = tx.Select(&rolesUserIds, "SELECT user_id FROM community_roles_users WHERE community_id = ?", community.ID)
@@ -165,6 +165,18 @@ func DeleteGroup(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		return handleCantDeleteError(err, reason)
 	}
 
+	oq := `
+		DELETE FROM permission_overwrites
+		WHERE group_id = ?
+		OR channel_id IN (SELECT id FROM channels WHERE group_id = ?)
+	`
+
+	_, err = tx.Exec(oq, groupId, groupId)
+
+	if err != nil {
+		return handleTxError(err, "Couldn't delete group permission overwrites, db error 💀")
+	}
+
 	uq := `
 		DELETE FROM channels
 		WHERE group_id = ?
@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+type DeleteMessageInput struct {
+	MessageID string `json:"message_id" validate:"required,gte=3,lte=255"`
+}
+
+func DeleteMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Deleting message ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(DeleteMessageInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to delete message, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to delete message, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	messageId, messageOk := security_helpers.Decode(input.MessageID)
+
+	if messageId == 0 || messageOk != model.MESSAGES_TYPE {
+		slog.Error("No message found 💀 " + handle)
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	message := model.Messages{}
+
+	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND community_id = ? AND deleted = 0", messageId, community.ID)
+
+	if err != nil {
+		slog.Error("No message found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	// Authors can always remove their own messages, anyone else needs to be a moderator
+	if message.UserID != user.ID {
+		channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+		if !ok || !channelPermissions.Has(message.ChannelID, model.ManageChannels) {
+			slog.Warn("Not allowed")
+
+			return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Not allowed.",
+				}},
+			})
+		}
+	}
+
+	err = DeleteMessageAndBroadcast(message, user.ID, db, wRdb, ctx)
+
+	if err != nil {
+		slog.Error("Can't delete message 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to delete message.",
+			}},
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"deleted": true,
+	})
+}
+
+// Soft deletes the message, leaving a tombstone row behind so replies to it still render.
+// The message content, its files and reactions are removed, then connected clients are told to drop it.
+func DeleteMessageAndBroadcast(message model.Messages, deletedBy uint64, db *sqlx.DB, wRdb *redis.Client, ctx context.Context) error {
+
+	channel := model.Channels{}
+
+	err := db.Get(&channel, "SELECT * FROM channels WHERE id = ? LIMIT 1", message.ChannelID)
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return err
+	}
+
+	deletedAt := time.Now()
+
+	uq := `
+	UPDATE messages
+	SET text = ?,
+		deleted = ?,
+		deleted_at = ?,
+		deleted_by = ?,
+		updated_at = ?
+	WHERE id = ?`
+
+	_, err = tx.Exec(uq, "", true, deletedAt, deletedBy, deletedAt, message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	// The stored objects are removed once the rows are gone, these are the only record of them
+	files := []model.Files{}
+
+	err = tx.Select(&files, "SELECT * FROM files WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM files WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM messages_mentions WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM users_mentions WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM messages_pins WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM messages_revisions WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM reactions WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM bookmarks WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM automod_flags WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE polls_votes FROM polls_votes JOIN polls ON polls.id = polls_votes.poll_id WHERE polls.message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE polls_options FROM polls_options JOIN polls ON polls.id = polls_options.poll_id WHERE polls.message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM polls WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return err
+	}
+
+	go message_helpers.DeleteStoredFiles(ctx, files)
+
+	message_helpers.InvalidateReactions(message.ID, db, wRdb, ctx)
+
+	deletedEvent := fiber.Map{
+		"type":       "message.deleted",
+		"id":         security_helpers.Encode(message.ID, model.MESSAGES_TYPE, message.Salt),
+		"channel_id": security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt),
+	}
+
+	go internal_handlers.SendBroadcast(security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt), deletedEvent)
+
+	if message.ParentID > 0 {
+		parent := model.Messages{}
+
+		err = db.Get(&parent, "SELECT * FROM messages WHERE id = ? LIMIT 1", message.ParentID)
+
+		if err == nil {
+			go internal_handlers.SendBroadcast(message_helpers.ThreadTopic(parent), deletedEvent)
+			go message_helpers.BroadcastThreadUpdated(parent, channel, db)
+		}
+	}
+
+	return nil
+}
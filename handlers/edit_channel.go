@@ -21,10 +21,17 @@ import (
 	"golang.org/x/exp/slog"
 )
 
+// Either access list replaces who's let into the channel when it's sent, leaving it out keeps what's there
 type EditChannelInput struct {
-	ChannelID string  `json:"channel_id" validate:"required,gte=3,lte=255"`
-	Name      string  `json:"name" validate:"required,gte=3,lte=32"`
-	GroupID   *string `json:"group_id" validate:"omitempty,lte=255"`
+	ChannelID     string   `json:"channel_id" validate:"required,gte=3,lte=255"`
+	Name          string   `json:"name" validate:"required,gte=3,lte=32"`
+	GroupID       *string  `json:"group_id" validate:"omitempty,lte=255"`
+	MaxPins       *uint32  `json:"max_pins" validate:"omitempty,gte=1,lte=250"`
+	RetentionDays *uint32  `json:"retention_days" validate:"omitempty,lte=3650"`
+	SlowMode      *uint32  `json:"slow_mode_seconds" validate:"omitempty,lte=21600"`
+	Private       *bool    `json:"private"`
+	AllowedRoles  []string `json:"allowed_roles" validate:"omitempty,lte=50,dive,gte=3,lte=255"`
+	AllowedUsers  []string `json:"allowed_users" validate:"omitempty,lte=100,dive,gte=3,lte=255"`
 }
 
 func EditChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
@@ -188,6 +195,19 @@ func EditChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		})
 	}
 
+	allowedRoles, rolesOk := decodeChannelAccess(model.OVERWRITE_ROLE, input.AllowedRoles, community.ID, db)
+	allowedUsers, usersOk := decodeChannelAccess(model.OVERWRITE_USER, input.AllowedUsers, community.ID, db)
+
+	if !rolesOk || !usersOk {
+		slog.Info("Channel access not found 💀 " + handle)
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
 	handleCantEditError := func(err error) error {
 		slog.Error("Unable to edit channel. 💀")
 
@@ -234,7 +254,44 @@ func EditChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 
 	updatedAt := time.Now()
 
-	_, err = tx.Exec("UPDATE channels SET updated_at = ?, name = ?, handle = ?, group_id = ? WHERE id = ?", updatedAt, input.Name, channelHandle, group.ID, channel.ID)
+	maxPins := channel.MaxPins
+
+	if input.MaxPins != nil {
+		maxPins = *input.MaxPins
+	}
+
+	retentionDays := channel.RetentionDays
+
+	if input.RetentionDays != nil {
+		retentionDays = *input.RetentionDays
+	}
+
+	slowMode := channel.SlowModeSeconds
+
+	if input.SlowMode != nil {
+		slowMode = *input.SlowMode
+	}
+
+	private := channel.Private
+
+	if input.Private != nil {
+		private = *input.Private
+	}
+
+	position := channel.Position
+
+	// A channel moved to another group goes to the end of it
+	if group.ID != channel.GroupID {
+		position, err = nextChannelPosition(tx, community.ID, group.ID)
+
+		if err != nil {
+			slog.Error("Couldn't find channel position, db error 💀")
+
+			return handleTxError(err)
+		}
+	}
+
+	_, err = tx.Exec("UPDATE channels SET updated_at = ?, name = ?, handle = ?, group_id = ?, max_pins = ?, retention_days = ?, slow_mode_seconds = ?, private = ?, position = ? WHERE id = ?", updatedAt, input.Name, channelHandle, group.ID, maxPins, retentionDays, slowMode, private, position, channel.ID)
 
 	if err != nil {
 		slog.Error("Couldn't insert channels, db error 💀")
@@ -242,6 +299,26 @@ func EditChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		return handleTxError(err)
 	}
 
+	if input.AllowedRoles != nil {
+		err = setChannelAccess(tx, community.ID, channel.ID, model.OVERWRITE_ROLE, allowedRoles)
+
+		if err != nil {
+			slog.Error("Couldn't let roles into channel, db error 💀")
+
+			return handleTxError(err)
+		}
+	}
+
+	if input.AllowedUsers != nil {
+		err = setChannelAccess(tx, community.ID, channel.ID, model.OVERWRITE_USER, allowedUsers)
+
+		if err != nil {
+			slog.Error("Couldn't let users into channel, db error 💀")
+
+			return handleTxError(err)
+		}
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
@@ -250,11 +327,30 @@ func EditChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		return handleCantEditError(err)
 	}
 
+	// Moving the channel to another group changes which overwrites it inherits, and who's let
+	// into a private channel changes who can see it
+	if group.ID != channel.GroupID || private != channel.Private || input.AllowedRoles != nil || input.AllowedUsers != nil {
+		if err := ClearChannelPermissions(community.ID, db, wRdb, ctx); err != nil {
+			slog.Error("Couldn't clear channel permissions 💀",
+				slog.String("error", err.Error()))
+		}
+	}
+
+	// Everyone else's sidebar shows the channel in its new group
+	if group.ID != channel.GroupID {
+		BroadcastChannelLayout(community, db, wRdb, rRdb, ctx)
+	}
+
 	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-		"id":         input.ChannelID,
-		"created_at": channel.CreatedAt.Format(time.RFC3339),
-		"update_at":  updatedAt.Format(time.RFC3339),
-		"name":       input.Name,
-		"handle":     channelHandle,
+		"id":                       input.ChannelID,
+		"created_at":               channel.CreatedAt.Format(time.RFC3339),
+		"update_at":                updatedAt.Format(time.RFC3339),
+		"name":                     input.Name,
+		"handle":                   channelHandle,
+		"max_pins":                 maxPins,
+		"retention_days":           retentionDays,
+		"effective_retention_days": model.Channels{RetentionDays: retentionDays}.EffectiveRetentionDays(community),
+		"slow_mode_seconds":        slowMode,
+		"private":                  private,
 	})
 }
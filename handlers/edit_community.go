@@ -20,7 +20,8 @@ import (
 )
 
 type EditCommunityInput struct {
-	Name string `json:"name" validate:"required,gte=3,lte=32"`
+	Name          string  `json:"name" validate:"required,gte=3,lte=32"`
+	RetentionDays *uint32 `json:"retention_days" validate:"omitempty,lte=3650"`
 }
 
 func EditCommunity(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
@@ -151,7 +152,13 @@ func EditCommunity(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 
 	updatedAt := time.Now()
 
-	_, err = tx.Exec("UPDATE communities SET updated_at = ?, name = ? WHERE id = ?", updatedAt, input.Name, community.ID)
+	retentionDays := community.RetentionDays
+
+	if input.RetentionDays != nil {
+		retentionDays = *input.RetentionDays
+	}
+
+	_, err = tx.Exec("UPDATE communities SET updated_at = ?, name = ?, retention_days = ? WHERE id = ?", updatedAt, input.Name, retentionDays, community.ID)
 
 	if err != nil {
 		slog.Error("Couldn't insert channels, db error 💀")
@@ -167,5 +174,7 @@ func EditCommunity(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 		return handleCantEditError(err)
 	}
 
-	return c.Status(fiber.StatusOK).JSON(&fiber.Map{})
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"retention_days": retentionDays,
+	})
 }
@@ -28,6 +28,7 @@ type EditCommunityDefaultPermissionsInput struct {
 	BanMembers      *bool `json:"ban_members" validate:"required"`
 	SendMessages    *bool `json:"send_messages" validate:"required"`
 	AttachMedia     *bool `json:"attach_media" validate:"required"`
+	MentionRoles    *bool `json:"mention_roles"`
 }
 
 func EditCommunityDefaultPermissions(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
@@ -114,6 +115,11 @@ func EditCommunityDefaultPermissions(c *fiber.Ctx, ctx context.Context, db *sqlx
 		})
 	}
 
+	// Clients from before role pings were gated don't send it, the defaults keep what they had
+	if input.MentionRoles == nil {
+		input.MentionRoles = &community.Permissions.MentionRoles
+	}
+
 	updatedAt := time.Now()
 
 	handleCantEditError := func(err error, reason string) error {
@@ -153,12 +159,13 @@ func EditCommunityDefaultPermissions(c *fiber.Ctx, ctx context.Context, db *sqlx
 			kick_members = ?,
 			ban_members = ?,
 			send_messages = ?,
-			attach_media = ?
+			attach_media = ?,
+			mention_roles = ?
 		WHERE id = ?
 	`
 
 	_, err = tx.Exec(uq, updatedAt, input.ViewChannels, input.ManageChannels, input.ManageCommunity,
-		input.CreateInvite, input.KickMembers, input.BanMembers, input.SendMessages, input.AttachMedia, community.ID)
+		input.CreateInvite, input.KickMembers, input.BanMembers, input.SendMessages, input.AttachMedia, input.MentionRoles, community.ID)
 
 	if err != nil {
 		return handleTxError(err, "Couldn't insert roles, db error 💀")
@@ -34,6 +34,7 @@ type EditCommunityRoleInput struct {
 	BanMembers            *bool    `json:"ban_members" validate:"required"`
 	SendMessages          *bool    `json:"send_messages" validate:"required"`
 	AttachMedia           *bool    `json:"attach_media" validate:"required"`
+	MentionRoles          *bool    `json:"mention_roles"`
 	Members               []string `json:"members" validate:"required"`
 }
 
@@ -157,6 +158,11 @@ func EditCommunityRole(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *red
 		})
 	}
 
+	// Clients from before role pings were gated don't send it, the role keeps what it had
+	if input.MentionRoles == nil {
+		input.MentionRoles = &communityRole.MentionRoles
+	}
+
 	if communityRole.CommunityID != community.ID {
 		slog.Warn("Not allowed")
 
@@ -207,13 +213,14 @@ func EditCommunityRole(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *red
 				 kick_members = ?,
 				 ban_members = ?,
 				 send_messages = ?,
-				 attach_media = ?
+				 attach_media = ?,
+				 mention_roles = ?
 			  WHERE id = ?
 		`
 
 		_, err = tx.Exec(uq, updatedAt, input.Name, input.Color, input.ShowOnlineDifferently,
 			input.ViewChannels, input.ManageChannels, input.ManageCommunity, input.CreateInvite,
-			input.KickMembers, input.BanMembers, input.SendMessages, input.AttachMedia, roleId)
+			input.KickMembers, input.BanMembers, input.SendMessages, input.AttachMedia, input.MentionRoles, roleId)
 
 		if err != nil {
 			handleTxError(err, "Couldn't insert roles, db error 💀")
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
 	"github.com/macwilko/exotic-auth/security_helpers"
 
 	"github.com/go-playground/locales/en"
@@ -99,9 +100,7 @@ func EditMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		})
 	}
 
-	hasPermission := HasCommunityPermission(user.ID, community.ID, model.SendMessages, db, wRdb, rRdb, ctx)
-
-	if !hasPermission {
+	notAllowed := func() error {
 		slog.Warn("Not allowed")
 
 		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
@@ -111,6 +110,14 @@ func EditMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		})
 	}
 
+	if _, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx); !member {
+		return notAllowed()
+	}
+
+	if remaining := CommunityTimeout(user.ID, community.ID, db, wRdb, rRdb, ctx); remaining > 0 {
+		return timedOutError(c, remaining)
+	}
+
 	messageId, messageOk := security_helpers.Decode(input.MessageID)
 
 	if messageId == 0 || messageOk != model.MESSAGES_TYPE {
@@ -126,7 +133,7 @@ func EditMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 
 	message := model.Messages{}
 
-	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND user_id = ? AND community_id = ?", messageId, user.ID, community.ID)
+	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND user_id = ? AND community_id = ? AND deleted = 0", messageId, user.ID, community.ID)
 
 	if err != nil {
 		slog.Error("No message found 💀 "+handle,
@@ -139,6 +146,43 @@ func EditMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		})
 	}
 
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !ok || !channelPermissions.Has(message.ChannelID, model.SendMessages) {
+		return notAllowed()
+	}
+
+	blockedBy, flaggedBy := checkAutomod(user, community, input.Text, db, wRdb, rRdb, ctx)
+
+	if blockedBy != nil {
+		// A timeout takes the message down too, so it can't be edited back into something else
+		if blockedBy.Action == model.AUTOMOD_TIMEOUT {
+			err = DeleteMessageAndBroadcast(message, 0, db, wRdb, ctx)
+
+			if err != nil {
+				slog.Error("Couldn't delete message blocked by automod 💀",
+					slog.String("error", err.Error()))
+			}
+		}
+
+		return automodError(c, user, community, *blockedBy, db, wRdb, ctx)
+	}
+
+	canMentionRoles := channelPermissions.Has(message.ChannelID, model.MentionRoles)
+
+	mentions, err := message_helpers.ResolveMentions(input.Text, community.ID, canMentionRoles, channelPermissions.CanView, db)
+
+	if err != nil {
+		slog.Error("Couldn't resolve mentions 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to edit message.",
+			}},
+		})
+	}
+
 	handleCantEditError := func(err error) error {
 		if err != nil {
 			slog.Error("Can't edit message 💀 "+handle,
@@ -170,6 +214,19 @@ func EditMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 
 	updatedAt := time.Now()
 
+	rq := `
+	INSERT INTO messages_revisions
+	(created_at, message_id, community_id, channel_id, edited_by, text)
+	VALUES (?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(rq, updatedAt, message.ID, message.CommunityID, message.ChannelID, user.ID, message.Text)
+
+	if err != nil {
+		slog.Error("Couldn't save message revision, db error 💀")
+
+		return handleTxError(err)
+	}
+
 	_, err = tx.Exec("UPDATE messages SET text = ?, updated_at = ?, edited = ? WHERE id = ?", input.Text, updatedAt, true, messageId)
 
 	if err != nil {
@@ -178,6 +235,14 @@ func EditMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		return handleTxError(err)
 	}
 
+	mentionedUserIds, err := message_helpers.SaveMentions(tx, message, mentions)
+
+	if err != nil {
+		slog.Error("Couldn't update mentions, db error 💀")
+
+		return handleTxError(err)
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
@@ -186,11 +251,34 @@ func EditMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Cli
 		return handleCantEditError(err)
 	}
 
+	message.Text = input.Text
+	message.Edited = true
+	message.UpdatedAt = sql.NullTime{Time: updatedAt, Valid: true}
+
+	go message_helpers.BroadcastMentions(mentionedUserIds, message, db, wRdb, rRdb, ctx)
+
+	if len(flaggedBy) > 0 {
+		go message_helpers.SaveAutomodFlags(message, flaggedBy, db)
+	}
+
+	// The edit is saved by now, so a failure here only leaves the mentions out
+	var mappedMentions interface{} = []fiber.Map{}
+
+	mapped, err := message_helpers.MapMessages([]model.Messages{message}, community.ID, channelPermissions.CanView, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		slog.Error("Couldn't map message 💀 "+handle,
+			slog.String("error", err.Error()))
+	} else {
+		mappedMentions = mapped[0]["mentions"]
+	}
+
 	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 		"id":         input.MessageID,
 		"created_at": message.CreatedAt.Format(time.RFC3339),
 		"update_at":  updatedAt.Format(time.RFC3339),
 		"text":       input.Text,
 		"edited":     true,
+		"mentions":   mappedMentions,
 	})
 }
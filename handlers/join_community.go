@@ -198,13 +198,13 @@ func JoinCommunity(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.C
 	icu := `
 	INSERT INTO communities_users
 	(created_at, community_id, user_id, view_channels, manage_channels, manage_community, create_invite,
-	kick_members, ban_members, send_messages, attach_media)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	kick_members, ban_members, send_messages, attach_media, mention_roles)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	_, err = tx.Exec(icu, createdAt, community.ID, user.ID, community.ViewChannels, community.ManageChannels,
 		community.ManageCommunity, community.CreateInvite, community.KickMembers, community.BanMembers,
-		community.SendMessages, community.AttachMedia)
+		community.SendMessages, community.AttachMedia, community.MentionRoles)
 
 	if err != nil {
 		slog.Error("Couldn't insert channels, db error 💀")
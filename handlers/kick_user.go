@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"strings"
-	"time"
 
 	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
 	"github.com/macwilko/exotic-auth/security_helpers"
@@ -152,62 +151,61 @@ func KickUser(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client
 		})
 	}
 
-	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+	err = KickMember(kickedUserId, community, db, wRdb, ctx)
 
 	if err != nil {
-		slog.Error("Couldn't begin tx, db error 💀")
-
 		return handleError(err)
 	}
 
-	handleTxError := func(err error) error {
-		tx.Rollback()
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"updated": true,
+	})
+}
 
-		return handleError(err)
-	}
+// Removes the member from the community along with their roles and bookmarks. Used by the
+// kick endpoint and when a moderator resolves a report with a kick.
+func KickMember(userId uint64, community model.Communities, db *sqlx.DB, wRdb *redis.Client, ctx context.Context) error {
 
-	_, err = tx.Exec("DELETE FROM communities_users WHERE user_id = ? AND community_id = ?", kickedUserId, community.ID)
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
 
 	if err != nil {
-		slog.Error("Couldn't kick user, db error 💀",
-			slog.String("error", err.Error()))
-
-		return handleTxError(err)
+		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM communiy_roles_users WHERE user_id = ? AND community_id = ?", kickedUserId, community.ID)
+	err = removeMember(tx, userId, community.ID)
 
 	if err != nil {
-		slog.Error("Couldn't kick user, db error 💀",
-			slog.String("error", err.Error()))
+		tx.Rollback()
 
-		return handleTxError(err)
+		return err
 	}
 
-	_, err = tx.Exec("INSERT INTO communities_banned_users (created_at, community_id, user_id) VALUES (?, ?, ?)", time.Now(), community.ID, kickedUser.ID)
+	err = tx.Commit()
 
 	if err != nil {
-		tx.Rollback()
+		return err
+	}
 
-		slog.Error("Couldn't kick user, db error 💀",
-			slog.String("error", err.Error()))
+	wRdb.Del(ctx, model.PermissionRedisKey(userId, community.ID), model.ChannelPermissionsRedisKey(userId, community.ID))
 
-		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-			"errors": []fiber.Map{{
-				"message": "Unable to kick user.",
-			}},
-		})
-	}
+	return nil
+}
 
-	err = tx.Commit()
+func removeMember(tx *sqlx.Tx, userId uint64, communityId uint64) error {
+
+	_, err := tx.Exec("DELETE FROM communities_users WHERE user_id = ? AND community_id = ?", userId, communityId)
 
 	if err != nil {
-		slog.Error("Couldn't commit channel")
+		return err
+	}
 
-		return handleError(err)
+	_, err = tx.Exec("DELETE FROM community_roles_users WHERE user_id = ? AND community_id = ?", userId, communityId)
+
+	if err != nil {
+		return err
 	}
 
-	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-		"updated": true,
-	})
+	_, err = tx.Exec("DELETE FROM bookmarks WHERE user_id = ? AND community_id = ?", userId, communityId)
+
+	return err
 }
@@ -86,16 +86,17 @@ func LeaveCommunity(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.
 	dcu := `
 		DELETE FROM communities_users
 		WHERE user_id = ?
+		AND community_id = ?
 	`
 
-	_, err = tx.Exec(dcu, user.ID)
+	_, err = tx.Exec(dcu, user.ID, community.ID)
 
 	if err != nil {
 		return handleTxError(err)
 	}
 
 	dcr := `
-	DELETE FROM communiy_roles_users
+	DELETE FROM community_roles_users
 	WHERE user_id = ?
 	AND community_id = ?
 	`
@@ -118,9 +119,13 @@ func LeaveCommunity(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.
 		return handleTxError(err)
 	}
 
-	rk := model.PermissionRedisKey(user.ID, community.ID)
+	_, err = tx.Exec("DELETE FROM bookmarks WHERE user_id = ? AND community_id = ?", user.ID, community.ID)
 
-	_, err = wRdb.Del(ctx, rk).Result()
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	_, err = wRdb.Del(ctx, model.PermissionRedisKey(user.ID, community.ID), model.ChannelPermissionsRedisKey(user.ID, community.ID)).Result()
 
 	if err != nil {
 		return handleTxError(err)
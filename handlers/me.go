@@ -2,11 +2,11 @@ package handlers
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"time"
 
 	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
 	"github.com/macwilko/exotic-auth/security_helpers"
 
 	"github.com/gofiber/fiber/v2"
@@ -16,7 +16,7 @@ import (
 	"golang.org/x/exp/slog"
 )
 
-func Me(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, rdb *redis.Client, queue *asynq.Client) error {
+func Me(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
 	slog.Info("Starting me ✅")
 
 	user, userOk := c.Locals("viewer").(model.Users)
@@ -112,6 +112,86 @@ func Me(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, rdb *redis.Client, queue
 		}
 	}
 
+	// Channels the user can't see, private ones they aren't let into, don't count towards anything
+	channelPermissions := make(map[uint64]ChannelPermissionSet)
+
+	for _, community := range communities {
+		cp, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+		if !ok {
+			return handleDbProblem(nil)
+		}
+
+		channelPermissions[community.ID] = cp
+	}
+
+	mentionCounts := []struct {
+		CommunityID  uint64 `db:"community_id"`
+		ChannelID    uint64 `db:"channel_id"`
+		MentionCount uint64 `db:"mention_count"`
+	}{}
+
+	mcq := `
+	SELECT community_id, channel_id, COUNT(*) AS mention_count
+	FROM users_mentions
+	WHERE user_id = ?
+	AND read_at IS NULL
+	GROUP BY community_id, channel_id`
+
+	err = db.Select(&mentionCounts, mcq, user.ID)
+
+	if err != nil {
+		return handleDbProblem(err)
+	}
+
+	// Map of community ids to unread mentions
+	mentionsMap := make(map[uint64]uint64)
+
+	for _, mc := range mentionCounts {
+		if channelPermissions[mc.CommunityID].Has(mc.ChannelID, model.ViewChannels) {
+			mentionsMap[mc.CommunityID] += mc.MentionCount
+		}
+	}
+
+	// Map of community ids to unread messages across their channels
+	unreadMap := make(map[uint64]uint64)
+
+	if len(communities) > 0 {
+		communityIds := make([]uint64, len(communities))
+
+		for i, community := range communities {
+			communityIds[i] = community.ID
+		}
+
+		cq, cArgs, err := sqlx.In("SELECT id, community_id FROM channels WHERE community_id IN (?)", communityIds)
+
+		if err != nil {
+			return handleDbProblem(err)
+		}
+
+		communityChannels := []model.Channels{}
+
+		err = db.Select(&communityChannels, db.Rebind(cq), cArgs...)
+
+		if err != nil {
+			return handleDbProblem(err)
+		}
+
+		channelIds := []uint64{}
+
+		for _, ch := range communityChannels {
+			if channelPermissions[ch.CommunityID].Has(ch.ID, model.ViewChannels) {
+				channelIds = append(channelIds, ch.ID)
+			}
+		}
+
+		channelUnreads := message_helpers.UnreadCounts(user.ID, channelIds, db, wRdb, rRdb, ctx)
+
+		for _, ch := range communityChannels {
+			unreadMap[ch.CommunityID] += channelUnreads[ch.ID]
+		}
+	}
+
 	mappedCommunities := make([]fiber.Map, len(communities))
 
 	for i, community := range communities {
@@ -120,7 +200,7 @@ func Me(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, rdb *redis.Client, queue
 		permissions := community.Permissions
 
 		pq := `SELECT view_channels, manage_channels, manage_community, create_invite, kick_members,
-		ban_members, send_messages, attach_media FROM communities_users WHERE community_id = ? AND user_id = ?
+		ban_members, send_messages, attach_media, mention_roles FROM communities_users WHERE community_id = ? AND user_id = ?
 		`
 
 		err = db.Get(&permissions, pq, community.ID, user.ID)
@@ -160,48 +240,6 @@ func Me(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, rdb *redis.Client, queue
 			defaultChannel = handle
 		}
 
-		channels := []uint64{}
-
-		err = db.Select(&channels, "SELECT id FROM channels WHERE community_id = ?", community.ID)
-
-		if err != nil {
-			slog.Info("Database problem 💀")
-
-			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
-				"errors": []fiber.Map{{
-					"message": "Not found",
-				}},
-			})
-		}
-
-		var unreadCount uint64 = 0
-
-		for _, ch := range channels {
-
-			var msgCount uint64 = 0
-
-			rk := fmt.Sprintf("user-%d-channel-%d", user.ID, ch)
-
-			if val, err := rdb.Get(ctx, rk).Result(); err == nil {
-				if tm, err := time.Parse(time.RFC3339, val); err == nil {
-					q := `SELECT count(*)
-					FROM messages
-					WHERE channel_id = ?
-					AND NOT user_id = ?
-					AND created_at > ?`
-
-					err = db.Get(&msgCount, q, ch, user.ID, tm)
-
-					if err != nil {
-						slog.Error("Database problem 💀",
-							slog.String("err", err.Error()))
-					}
-				}
-			}
-
-			unreadCount = unreadCount + msgCount
-		}
-
 		mappedCommunities[i] = fiber.Map{
 			"id":              security_helpers.Encode(community.ID, model.COMMUNITIES_TYPE, community.Salt),
 			"name":            community.Name,
@@ -209,7 +247,8 @@ func Me(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, rdb *redis.Client, queue
 			"permissions":     permissions.ToFiberMap(),
 			"server_owner":    severOwner,
 			"default_channel": defaultChannel,
-			"unread_count":    unreadCount,
+			"unread_count":    unreadMap[community.ID],
+			"mention_count":   mentionsMap[community.ID],
 		}
 	}
 
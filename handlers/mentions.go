@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"context"
+	"maps"
+	"strconv"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Mentions returned per page of the inbox
+const mentionsPageSize = 25
+
+type ReadMentionsInput struct {
+	MessageID *string `json:"message_id" validate:"omitempty,gte=3,lte=255"`
+}
+
+// Lists the messages that mention the viewer, directly or through one of their roles,
+// across every community they're still a member of. Newest first.
+func Mentions(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Starting fetch mentions ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	beforeId, beforeOk := decodeMessageCursor(c, "before")
+
+	unreadOnly := false
+
+	if v := c.Query("unread"); len(v) > 0 {
+		var err error
+
+		unreadOnly, err = strconv.ParseBool(v)
+
+		if err != nil {
+			beforeOk = false
+		}
+	}
+
+	if !beforeOk {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Invalid input.",
+			}},
+		})
+	}
+
+	channelPermissions, visibleChannelIds, err := MemberChannelPermissions(user.ID, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		return notFound(err, "selecting channel permissions")
+	}
+
+	if len(visibleChannelIds) == 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"mentions": []fiber.Map{},
+			"has_more": false,
+		})
+	}
+
+	// Deleted messages and channels the user can't see are filtered here, not after the limit
+	q := `
+	SELECT users_mentions.*
+	FROM users_mentions
+	JOIN messages ON messages.id = users_mentions.message_id
+	WHERE users_mentions.user_id = ?
+	AND users_mentions.channel_id IN (?)
+	AND messages.deleted = 0`
+
+	args := []interface{}{user.ID, visibleChannelIds}
+
+	if unreadOnly {
+		q += " AND users_mentions.read_at IS NULL"
+	}
+
+	if beforeId > 0 {
+		q += " AND users_mentions.message_id < ?"
+		args = append(args, beforeId)
+	}
+
+	q += " ORDER BY users_mentions.message_id DESC LIMIT ?"
+	args = append(args, mentionsPageSize+1)
+
+	uq, uArgs, err := sqlx.In(q, args...)
+
+	if err != nil {
+		return notFound(err, "building mentions query")
+	}
+
+	userMentions := []model.UsersMentions{}
+
+	err = db.Select(&userMentions, db.Rebind(uq), uArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting mentions")
+	}
+
+	hasMore := len(userMentions) > mentionsPageSize
+
+	if hasMore {
+		userMentions = userMentions[:mentionsPageSize]
+	}
+
+	if len(userMentions) == 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"mentions": []fiber.Map{},
+			"has_more": false,
+		})
+	}
+
+	var messageIds = []uint64{}
+	var channelIds = []uint64{}
+	var communityIds = []uint64{}
+
+	for _, um := range userMentions {
+		messageIds = append(messageIds, um.MessageID)
+		channelIds = append(channelIds, um.ChannelID)
+		communityIds = append(communityIds, um.CommunityID)
+	}
+
+	mq, mArgs, err := sqlx.In("SELECT * FROM messages WHERE id IN (?) AND deleted = 0", messageIds)
+
+	if err != nil {
+		return notFound(err, "building messages query")
+	}
+
+	messages := []model.Messages{}
+
+	err = db.Select(&messages, db.Rebind(mq), mArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting messages")
+	}
+
+	cq, cArgs, err := sqlx.In("SELECT * FROM channels WHERE id IN (?)", channelIds)
+
+	if err != nil {
+		return notFound(err, "building channels query")
+	}
+
+	channels := []model.Channels{}
+
+	err = db.Select(&channels, db.Rebind(cq), cArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting channels")
+	}
+
+	cmq, cmArgs, err := sqlx.In("SELECT * FROM communities WHERE id IN (?)", communityIds)
+
+	if err != nil {
+		return notFound(err, "building communities query")
+	}
+
+	communities := []model.Communities{}
+
+	err = db.Select(&communities, db.Rebind(cmq), cmArgs...)
+
+	if err != nil {
+		return notFound(err, "selecting communities")
+	}
+
+	// Mentions in channels the user can no longer see are left out
+	channelsMap := make(map[uint64]model.Channels)
+
+	for _, ch := range channels {
+		if channelPermissions[ch.CommunityID].Has(ch.ID, model.ViewChannels) {
+			channelsMap[ch.ID] = ch
+		}
+	}
+
+	communitiesMap := make(map[uint64]model.Communities)
+
+	for _, cm := range communities {
+		communitiesMap[cm.ID] = cm
+	}
+
+	// Messages are mapped a community at a time, so authors show their roles from that community
+	messagesByCommunity := make(map[uint64][]model.Messages)
+
+	for _, m := range messages {
+		if _, found := channelsMap[m.ChannelID]; !found {
+			continue
+		}
+
+		messagesByCommunity[m.CommunityID] = append(messagesByCommunity[m.CommunityID], m)
+	}
+
+	mappedMessages := make(map[uint64]fiber.Map)
+
+	for communityId, cms := range messagesByCommunity {
+		mapped, err := message_helpers.MapMessages(cms, communityId, channelPermissions[communityId].CanView, db, wRdb, rRdb, ctx)
+
+		if err != nil {
+			return notFound(err, "mapping messages")
+		}
+
+		for i, m := range cms {
+			mappedMessages[m.ID] = mapped[i]
+		}
+	}
+
+	mm := []fiber.Map{}
+
+	for _, um := range userMentions {
+		message, mok := mappedMessages[um.MessageID]
+		channel, chok := channelsMap[um.ChannelID]
+		community, cmok := communitiesMap[um.CommunityID]
+
+		if !mok || !chok || !cmok {
+			continue
+		}
+
+		mention := fiber.Map{
+			"created_at": um.CreatedAt.Format(time.RFC3339),
+			"read":       um.ReadAt.Valid,
+			"via_role":   um.CommunityRoleID > 0,
+			"channel":    channel.ToFiberMap(),
+			"community": fiber.Map{
+				"id":     security_helpers.Encode(community.ID, model.COMMUNITIES_TYPE, community.Salt),
+				"name":   community.Name,
+				"handle": community.Handle,
+			},
+			"message": message,
+		}
+
+		if um.ReadAt.Valid {
+			maps.Copy(mention, fiber.Map{
+				"read_at": um.ReadAt.Time.Format(time.RFC3339),
+			})
+		}
+
+		mm = append(mm, mention)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"mentions": mm,
+		"has_more": hasMore,
+	})
+}
+
+// Marks one mention as read, or the whole inbox when no message is given
+func ReadMentions(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Reading mentions ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(ReadMentionsInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to read mentions, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to read mentions, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	uq := "UPDATE users_mentions SET read_at = ? WHERE user_id = ? AND read_at IS NULL"
+
+	args := []interface{}{time.Now(), user.ID}
+
+	if input.MessageID != nil {
+		messageId, messageOk := security_helpers.Decode(*input.MessageID)
+
+		if messageId == 0 || messageOk != model.MESSAGES_TYPE {
+			slog.Error("Message security ID failure 💀")
+
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Not found",
+				}},
+			})
+		}
+
+		uq += " AND message_id = ?"
+		args = append(args, messageId)
+	}
+
+	_, err = db.Exec(uq, args...)
+
+	if err != nil {
+		slog.Error("Couldn't read mentions, db error 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to read mentions.",
+			}},
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"ok": true,
+	})
+}
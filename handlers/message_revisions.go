@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Lists what a message said before each of its edits, oldest first.
+// Only the author and moderators can see them.
+func MessageRevisions(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Starting fetch message revisions ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	communityHandle := Truncate(strings.ToLower(c.Params("communityHandle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", communityHandle)
+
+	if err != nil {
+		return notFound(err, "can't find community")
+	}
+
+	messageId, messageOk := security_helpers.Decode(c.Params("messageId"))
+
+	if messageId == 0 || messageOk != model.MESSAGES_TYPE {
+		slog.Error("Message security ID failure 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	message := model.Messages{}
+
+	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND community_id = ? AND deleted = 0", messageId, community.ID)
+
+	if err != nil {
+		return notFound(err, "can't find message")
+	}
+
+	if message.UserID != user.ID {
+		channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+		if !ok || !channelPermissions.Has(message.ChannelID, model.ManageChannels) {
+			slog.Warn("Not allowed")
+
+			return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Not allowed.",
+				}},
+			})
+		}
+	}
+
+	revisions := []model.MessagesRevisions{}
+
+	err = db.Select(&revisions, "SELECT * FROM messages_revisions WHERE message_id = ? ORDER BY id ASC", message.ID)
+
+	if err != nil {
+		return notFound(err, "selecting revisions")
+	}
+
+	usersMap := make(map[uint64]model.Users)
+
+	var uIds = []uint64{}
+
+	for _, r := range revisions {
+		if _, found := usersMap[r.EditedBy]; !found {
+			usersMap[r.EditedBy] = model.GHOST_USER
+			uIds = append(uIds, r.EditedBy)
+		}
+	}
+
+	if len(uIds) > 0 {
+		uq, uArgs, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", uIds)
+
+		if err != nil {
+			return notFound(err, "building users query")
+		}
+
+		users := []model.Users{}
+
+		err = db.Select(&users, db.Rebind(uq), uArgs...)
+
+		if err != nil {
+			return notFound(err, "selecting users")
+		}
+
+		for _, u := range users {
+			usersMap[u.ID] = u
+		}
+	}
+
+	mr := make([]fiber.Map, len(revisions))
+
+	for i, r := range revisions {
+		editor := usersMap[r.EditedBy]
+
+		var avatarUrl *string = nil
+
+		if editor.CFAvatarImagesID.Valid {
+			s := os.Getenv("CLOUDFLARE_IMAGES_PROXY") + editor.CFAvatarImagesID.String + "/public"
+			avatarUrl = &s
+		}
+
+		mr[i] = fiber.Map{
+			"edited_at": r.CreatedAt.Format(time.RFC3339),
+			"text":      r.Text,
+			"edited_by": fiber.Map{
+				"name":       editor.Name.String,
+				"handle":     editor.Handle.String,
+				"avatar_url": avatarUrl,
+			},
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"id":        security_helpers.Encode(message.ID, model.MESSAGES_TYPE, message.Salt),
+		"text":      message.Text,
+		"revisions": mr,
+	})
+}
@@ -0,0 +1,714 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+type EditPermissionOverwriteInput struct {
+	ChannelID  *string  `json:"channel_id" validate:"omitempty,gte=3,lte=255"`
+	GroupID    *string  `json:"group_id" validate:"omitempty,gte=3,lte=255"`
+	TargetType string   `json:"target_type" validate:"required,oneof=everyone role user"`
+	TargetID   *string  `json:"target_id" validate:"omitempty,gte=3,lte=255"`
+	Allow      []string `json:"allow" validate:"lte=5,dive,oneof=view_channels manage_channels send_messages attach_media mention_roles"`
+	Deny       []string `json:"deny" validate:"lte=5,dive,oneof=view_channels manage_channels send_messages attach_media mention_roles"`
+}
+
+type DeletePermissionOverwriteInput struct {
+	OverwriteID string `json:"overwrite_id" validate:"required,gte=3,lte=255"`
+}
+
+// Every overwrite in the community, for the channel settings screens
+func PermissionOverwrites(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Fetching permission overwrites ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		return notFound(err, "selecting community")
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageChannels, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	overwrites := []model.PermissionOverwrites{}
+
+	err = db.Select(&overwrites, "SELECT * FROM permission_overwrites WHERE community_id = ? ORDER BY id ASC", community.ID)
+
+	if err != nil {
+		return notFound(err, "selecting permission overwrites")
+	}
+
+	mapped, err := mapPermissionOverwrites(overwrites, community.ID, db)
+
+	if err != nil {
+		return notFound(err, "mapping permission overwrites")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"overwrites": mapped,
+	})
+}
+
+// Sets the overwrite for a target in a channel or group, replacing the one already there
+func EditPermissionOverwrite(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Editing permission overwrite ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(EditPermissionOverwriteInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to edit permission overwrite, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	} else {
+		if (input.ChannelID == nil) == (input.GroupID == nil) {
+			errors = append(errors, fiber.Map{
+				"field":   "ChannelID",
+				"message": "Set overwrites on either a channel or a group.",
+			})
+		}
+
+		if (input.TargetType == model.OVERWRITE_EVERYONE) != (input.TargetID == nil) {
+			errors = append(errors, fiber.Map{
+				"field":   "TargetID",
+				"message": "Roles and users need a target, everyone doesn't.",
+			})
+		}
+	}
+
+	var allow, deny uint32
+
+	for _, name := range input.Allow {
+		if p, found := model.ChannelPermissionFromString(name); found {
+			allow |= p.Bit()
+		}
+	}
+
+	for _, name := range input.Deny {
+		if p, found := model.ChannelPermissionFromString(name); found {
+			deny |= p.Bit()
+		}
+	}
+
+	if allow&deny != 0 {
+		errors = append(errors, fiber.Map{
+			"field":   "Deny",
+			"message": "A permission can't be allowed and denied at once.",
+		})
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to edit permission overwrite, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	notAllowed := func() error {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageChannels, db, wRdb, rRdb, ctx) {
+		return notAllowed()
+	}
+
+	// Only someone who can manage the community can hand out permissions they don't have themselves
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx) {
+		for _, p := range model.ChannelPermissions {
+			if (allow|deny)&p.Bit() != 0 && !HasCommunityPermission(user.ID, community.ID, p, db, wRdb, rRdb, ctx) {
+				return notAllowed()
+			}
+		}
+	}
+
+	overwrite := model.PermissionOverwrites{
+		CreatedAt:   time.Now().Truncate(time.Second),
+		Salt:        uuid.New().String(),
+		CommunityID: community.ID,
+		TargetType:  input.TargetType,
+		Allow:       allow,
+		Deny:        deny,
+	}
+
+	if input.ChannelID != nil {
+		channelId, channelOk := security_helpers.Decode(*input.ChannelID)
+
+		if channelId == 0 || channelOk != model.CHANNELS_TYPE {
+			slog.Error("Channel security ID failure 💀")
+
+			return notFound()
+		}
+
+		var count int
+
+		err = db.Get(&count, "SELECT COUNT(*) FROM channels WHERE id = ? AND community_id = ?", channelId, community.ID)
+
+		if err != nil || count == 0 {
+			slog.Error("No channel found 💀 " + handle)
+
+			return notFound()
+		}
+
+		overwrite.ChannelID = channelId
+	} else {
+		groupId, groupOk := security_helpers.Decode(*input.GroupID)
+
+		if groupId == 0 || groupOk != model.CHANNEL_GROUPS_TYPE {
+			slog.Error("Group security ID failure 💀")
+
+			return notFound()
+		}
+
+		var count int
+
+		err = db.Get(&count, "SELECT COUNT(*) FROM channel_groups WHERE id = ? AND community_id = ?", groupId, community.ID)
+
+		if err != nil || count == 0 {
+			slog.Error("No group found 💀 " + handle)
+
+			return notFound()
+		}
+
+		overwrite.GroupID = groupId
+	}
+
+	if input.TargetID != nil {
+		targetId, targetOk := security_helpers.Decode(*input.TargetID)
+
+		var count int
+
+		switch input.TargetType {
+		case model.OVERWRITE_ROLE:
+			if targetOk != model.COMMUNITY_ROLES_TYPE {
+				return notFound()
+			}
+
+			err = db.Get(&count, "SELECT COUNT(*) FROM community_roles WHERE id = ? AND community_id = ?", targetId, community.ID)
+		case model.OVERWRITE_USER:
+			if targetOk != model.USERS_TYPE {
+				return notFound()
+			}
+
+			err = db.Get(&count, "SELECT COUNT(*) FROM communities_users WHERE user_id = ? AND community_id = ?", targetId, community.ID)
+		}
+
+		if targetId == 0 || err != nil || count == 0 {
+			slog.Error("No overwrite target found 💀 " + handle)
+
+			return notFound()
+		}
+
+		overwrite.TargetID = targetId
+	}
+
+	handleCantEditError := func(err error) error {
+		slog.Error("Unable to edit permission overwrite 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to edit permission overwrite.",
+			}},
+		})
+	}
+
+	iq := `
+	INSERT INTO permission_overwrites
+	(created_at, object_salt, community_id, channel_id, group_id, target_type, target_id, allow, deny)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE allow = VALUES(allow), deny = VALUES(deny), updated_at = ?`
+
+	_, err = db.Exec(iq, overwrite.CreatedAt, overwrite.Salt, overwrite.CommunityID, overwrite.ChannelID, overwrite.GroupID,
+		overwrite.TargetType, overwrite.TargetID, overwrite.Allow, overwrite.Deny, overwrite.CreatedAt)
+
+	if err != nil {
+		return handleCantEditError(err)
+	}
+
+	sq := `
+	SELECT *
+	FROM permission_overwrites
+	WHERE channel_id = ?
+	AND group_id = ?
+	AND target_type = ?
+	AND target_id = ?
+	LIMIT 1`
+
+	err = db.Get(&overwrite, sq, overwrite.ChannelID, overwrite.GroupID, overwrite.TargetType, overwrite.TargetID)
+
+	if err != nil {
+		return handleCantEditError(err)
+	}
+
+	if err := ClearChannelPermissions(community.ID, db, wRdb, ctx); err != nil {
+		slog.Error("Couldn't clear channel permissions 💀",
+			slog.String("error", err.Error()))
+	}
+
+	mapped, err := mapPermissionOverwrites([]model.PermissionOverwrites{overwrite}, community.ID, db)
+
+	if err != nil {
+		return handleCantEditError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(mapped[0])
+}
+
+// Removes an overwrite, the target goes back to what the group or community gives them
+func DeletePermissionOverwrite(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Deleting permission overwrite ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(DeletePermissionOverwriteInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to delete permission overwrite, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to delete permission overwrite, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	notAllowed := func() error {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageChannels, db, wRdb, rRdb, ctx) {
+		return notAllowed()
+	}
+
+	overwriteId, overwriteOk := security_helpers.Decode(input.OverwriteID)
+
+	if overwriteId == 0 || overwriteOk != model.PERMISSION_OVERWRITES_TYPE {
+		slog.Error("Overwrite security ID failure 💀")
+
+		return notFound()
+	}
+
+	overwrite := model.PermissionOverwrites{}
+
+	err = db.Get(&overwrite, "SELECT * FROM permission_overwrites WHERE id = ? AND community_id = ? LIMIT 1", overwriteId, community.ID)
+
+	if err != nil {
+		slog.Error("No permission overwrite found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	// Dropping an overwrite gives back whatever it denied, so the same rule as setting one applies
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageCommunity, db, wRdb, rRdb, ctx) {
+		for _, p := range model.ChannelPermissions {
+			if (overwrite.Allow|overwrite.Deny)&p.Bit() != 0 && !HasCommunityPermission(user.ID, community.ID, p, db, wRdb, rRdb, ctx) {
+				return notAllowed()
+			}
+		}
+	}
+
+	_, err = db.Exec("DELETE FROM permission_overwrites WHERE id = ?", overwrite.ID)
+
+	if err != nil {
+		slog.Error("Unable to delete permission overwrite 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to delete permission overwrite.",
+			}},
+		})
+	}
+
+	if err := ClearChannelPermissions(community.ID, db, wRdb, ctx); err != nil {
+		slog.Error("Couldn't clear channel permissions 💀",
+			slog.String("error", err.Error()))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"ok": true})
+}
+
+func mapPermissionOverwrites(overwrites []model.PermissionOverwrites, communityId uint64, db *sqlx.DB) ([]fiber.Map, error) {
+
+	mo := []fiber.Map{}
+
+	if len(overwrites) == 0 {
+		return mo, nil
+	}
+
+	channels := []model.Channels{}
+
+	err := db.Select(&channels, "SELECT * FROM channels WHERE community_id = ?", communityId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []model.ChannelGroups{}
+
+	err = db.Select(&groups, "SELECT * FROM channel_groups WHERE community_id = ?", communityId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []model.CommunityRoles{}
+
+	err = db.Select(&roles, "SELECT * FROM community_roles WHERE community_id = ?", communityId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	channelsMap := make(map[uint64]model.Channels)
+	groupsMap := make(map[uint64]model.ChannelGroups)
+	rolesMap := make(map[uint64]model.CommunityRoles)
+	usersMap := make(map[uint64]fiber.Map)
+
+	for _, ch := range channels {
+		channelsMap[ch.ID] = ch
+	}
+
+	for _, g := range groups {
+		groupsMap[g.ID] = g
+	}
+
+	for _, r := range roles {
+		rolesMap[r.ID] = r
+	}
+
+	var userIds []uint64
+
+	for _, o := range overwrites {
+		if o.TargetType == model.OVERWRITE_USER {
+			userIds = append(userIds, o.TargetID)
+		}
+	}
+
+	if len(userIds) > 0 {
+		uq, uArgs, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIds)
+
+		if err != nil {
+			return nil, err
+		}
+
+		users := []model.Users{}
+
+		err = db.Select(&users, db.Rebind(uq), uArgs...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range users {
+			usersMap[u.ID] = u.ToFiberMap()
+		}
+	}
+
+	for _, o := range overwrites {
+		overwrite := fiber.Map{
+			"id":          security_helpers.Encode(o.ID, model.PERMISSION_OVERWRITES_TYPE, o.Salt),
+			"channel_id":  nil,
+			"group_id":    nil,
+			"target_type": o.TargetType,
+			"target":      nil,
+			"allow":       model.ChannelPermissionNames(o.Allow),
+			"deny":        model.ChannelPermissionNames(o.Deny),
+		}
+
+		if ch, found := channelsMap[o.ChannelID]; found {
+			overwrite["channel_id"] = security_helpers.Encode(ch.ID, model.CHANNELS_TYPE, ch.Salt)
+		}
+
+		if g, found := groupsMap[o.GroupID]; found {
+			overwrite["group_id"] = security_helpers.Encode(g.ID, model.CHANNEL_GROUPS_TYPE, g.Salt)
+		}
+
+		switch o.TargetType {
+		case model.OVERWRITE_ROLE:
+			if r, found := rolesMap[o.TargetID]; found {
+				overwrite["target"] = r.ToFiberMap(false)
+			}
+		case model.OVERWRITE_USER:
+			if u, found := usersMap[o.TargetID]; found {
+				overwrite["target"] = u
+			}
+		}
+
+		mo = append(mo, overwrite)
+	}
+
+	return mo, nil
+}
+
+// Decodes the roles or members let into a private channel, checking each one is in the
+// community. Returns false when one isn't.
+func decodeChannelAccess(targetType string, encodedIds []string, communityId uint64, db *sqlx.DB) ([]uint64, bool) {
+
+	idType := model.COMMUNITY_ROLES_TYPE
+	q := "SELECT COUNT(DISTINCT id) FROM community_roles WHERE community_id = ? AND id IN (?)"
+
+	if targetType == model.OVERWRITE_USER {
+		idType = model.USERS_TYPE
+		q = "SELECT COUNT(DISTINCT user_id) FROM communities_users WHERE community_id = ? AND user_id IN (?)"
+	}
+
+	seen := make(map[uint64]bool)
+	ids := []uint64{}
+
+	for _, encoded := range encodedIds {
+		id, decodedType := security_helpers.Decode(encoded)
+
+		if id == 0 || decodedType != idType {
+			return nil, false
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return ids, true
+	}
+
+	cq, cArgs, err := sqlx.In(q, communityId, ids)
+
+	if err != nil {
+		return nil, false
+	}
+
+	var count int
+
+	err = db.Get(&count, db.Rebind(cq), cArgs...)
+
+	if err != nil || count != len(ids) {
+		return nil, false
+	}
+
+	return ids, true
+}
+
+// Replaces the roles or members let into a private channel. Everyone on the list gets an
+// overwrite allowing them to view it, anyone taken off loses that allow.
+func setChannelAccess(tx *sqlx.Tx, communityId uint64, channelId uint64, targetType string, ids []uint64) error {
+
+	view := model.ViewChannels.Bit()
+	updatedAt := time.Now().Truncate(time.Second)
+
+	uq := `
+	UPDATE permission_overwrites
+	SET allow = allow & ~?, updated_at = ?
+	WHERE channel_id = ?
+	AND target_type = ?`
+
+	_, err := tx.Exec(uq, view, updatedAt, channelId, targetType)
+
+	if err != nil {
+		return err
+	}
+
+	iq := `
+	INSERT INTO permission_overwrites
+	(created_at, object_salt, community_id, channel_id, group_id, target_type, target_id, allow, deny)
+	VALUES (?, ?, ?, ?, 0, ?, ?, ?, 0)
+	ON DUPLICATE KEY UPDATE allow = allow | VALUES(allow), deny = deny & ~VALUES(allow), updated_at = ?`
+
+	for _, id := range ids {
+		_, err = tx.Exec(iq, updatedAt, uuid.New().String(), communityId, channelId, targetType, id, view, updatedAt)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM permission_overwrites WHERE channel_id = ? AND target_type = ? AND allow = 0 AND deny = 0", channelId, targetType)
+
+	return err
+}
@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+type PinMessageInput struct {
+	MessageID string `json:"message_id" validate:"required,gte=3,lte=255"`
+}
+
+func PinMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	return pinOrUnpinMessage(c, ctx, db, wRdb, rRdb, true)
+}
+
+func UnpinMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	return pinOrUnpinMessage(c, ctx, db, wRdb, rRdb, false)
+}
+
+func pinOrUnpinMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, pin bool) error {
+
+	slog.Info("Pinning message ✅", slog.Bool("pin", pin))
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(PinMessageInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to pin message, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to pin message, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	messageId, messageOk := security_helpers.Decode(input.MessageID)
+
+	if messageId == 0 || messageOk != model.MESSAGES_TYPE {
+		slog.Error("No message found 💀 " + handle)
+
+		return notFound()
+	}
+
+	message := model.Messages{}
+
+	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND community_id = ? AND deleted = 0", messageId, community.ID)
+
+	if err != nil {
+		slog.Error("No message found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	// Moderating is checked in the message's channel, so overwrites there can grant or take it away
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !ok || !channelPermissions.Has(message.ChannelID, model.ManageChannels) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	channel := model.Channels{}
+
+	err = db.Get(&channel, "SELECT * FROM channels WHERE id = ? LIMIT 1", message.ChannelID)
+
+	if err != nil {
+		slog.Error("No channel found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	handleCantPinError := func(err error) error {
+		if err != nil {
+			slog.Error("Can't pin message 💀 "+handle,
+				slog.String("error", err.Error()))
+		}
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to pin message.",
+			}},
+		})
+	}
+
+	channelTopic := security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt)
+
+	if !pin {
+		_, err = db.Exec("DELETE FROM messages_pins WHERE message_id = ?", message.ID)
+
+		if err != nil {
+			return handleCantPinError(err)
+		}
+
+		go internal_handlers.SendBroadcast(channelTopic, fiber.Map{
+			"type":       "message.unpinned",
+			"id":         security_helpers.Encode(message.ID, model.MESSAGES_TYPE, message.Salt),
+			"channel_id": channelTopic,
+		})
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"pinned": false,
+		})
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return handleCantPinError(err)
+	}
+
+	var alreadyPinned bool
+
+	err = tx.Get(&alreadyPinned, "SELECT EXISTS (SELECT 1 FROM messages_pins WHERE message_id = ?)", message.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return handleCantPinError(err)
+	}
+
+	if alreadyPinned {
+		tx.Rollback()
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"pinned": true,
+		})
+	}
+
+	var pinCount uint32
+
+	// Locks the channel's pins so two moderators can't both take the last slot
+	err = tx.Get(&pinCount, "SELECT count(*) FROM messages_pins WHERE channel_id = ? FOR UPDATE", channel.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return handleCantPinError(err)
+	}
+
+	if pinCount >= channel.MaxPins {
+		tx.Rollback()
+
+		slog.Warn("Pin limit reached 💀 " + handle)
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message":  "Pin limit reached.",
+				"max_pins": channel.MaxPins,
+			}},
+		})
+	}
+
+	createdAt := time.Now()
+
+	iq := `
+	INSERT INTO messages_pins
+	(created_at, message_id, channel_id, community_id, pinned_by)
+	VALUES (?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(iq, createdAt, message.ID, channel.ID, community.ID, user.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return handleCantPinError(err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return handleCantPinError(err)
+	}
+
+	mapped, err := message_helpers.MapMessages([]model.Messages{message}, community.ID, message_helpers.PublicChannels, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		return handleCantPinError(err)
+	}
+
+	go internal_handlers.SendBroadcast(channelTopic, fiber.Map{
+		"type":       "message.pinned",
+		"id":         security_helpers.Encode(message.ID, model.MESSAGES_TYPE, message.Salt),
+		"channel_id": channelTopic,
+		"pinned_at":  createdAt.Format(time.RFC3339),
+		"message":    mapped[0],
+	})
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"pinned": true,
+	})
+}
+
+func ChannelPins(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Starting fetch channel pins ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	communityHandle := Truncate(strings.ToLower(c.Params("communityHandle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", communityHandle)
+
+	if err != nil {
+		return notFound(err, "can't find community")
+	}
+
+	channelHandle := Truncate(strings.ToLower(c.Params("channelHandle")), 255)
+
+	channel := model.Channels{}
+
+	err = db.Get(&channel, "SELECT * FROM channels WHERE handle = ? AND community_id = ? LIMIT 1", channelHandle, community.ID)
+
+	if err != nil {
+		return notFound(err, "can't find channel")
+	}
+
+	_, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !member || !ok || !channelPermissions.Has(channel.ID, model.ViewChannels) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	pins := []model.MessagesPins{}
+
+	err = db.Select(&pins, "SELECT * FROM messages_pins WHERE channel_id = ? ORDER BY created_at DESC", channel.ID)
+
+	if err != nil {
+		return notFound(err, "selecting pins")
+	}
+
+	var messageIds = []uint64{}
+
+	for _, p := range pins {
+		messageIds = append(messageIds, p.MessageID)
+	}
+
+	messages := []model.Messages{}
+
+	if len(messageIds) > 0 {
+		mq, mArgs, err := sqlx.In("SELECT * FROM messages WHERE id IN (?) AND deleted = 0", messageIds)
+
+		if err != nil {
+			return notFound(err, "building messages query")
+		}
+
+		err = db.Select(&messages, db.Rebind(mq), mArgs...)
+
+		if err != nil {
+			return notFound(err, "selecting messages")
+		}
+	}
+
+	mapped, err := message_helpers.MapMessages(messages, community.ID, channelPermissions.CanView, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		return notFound(err, "mapping messages")
+	}
+
+	mappedMessages := make(map[uint64]fiber.Map)
+
+	for i, m := range messages {
+		mappedMessages[m.ID] = mapped[i]
+	}
+
+	// Most recently pinned first
+	mp := []fiber.Map{}
+
+	for _, p := range pins {
+		if m, found := mappedMessages[p.MessageID]; found {
+			mp = append(mp, fiber.Map{
+				"pinned_at": p.CreatedAt.Format(time.RFC3339),
+				"message":   m,
+			})
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"channel":  channel.ToFiberMap(),
+		"pins":     mp,
+		"max_pins": channel.MaxPins,
+	})
+}
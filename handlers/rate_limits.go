@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// A named limit for a group of routes. Requests are counted per user and per IP in
+// redis so every replica shares the same counts, a zero max skips that side.
+type RateLimitPolicy struct {
+	Name    string
+	UserMax int64
+	IPMax   int64
+	Window  time.Duration
+}
+
+var (
+	AuthRateLimit = RateLimitPolicy{
+		Name:   "auth",
+		IPMax:  30,
+		Window: time.Hour,
+	}
+
+	// Every signed in write, the named policies below are checked on top of it
+	WriteRateLimit = RateLimitPolicy{
+		Name:    "writes",
+		UserMax: 120,
+		IPMax:   300,
+		Window:  time.Minute,
+	}
+
+	MessageRateLimit = RateLimitPolicy{
+		Name:    "messages",
+		UserMax: 20,
+		IPMax:   60,
+		Window:  10 * time.Second,
+	}
+
+	ReactionRateLimit = RateLimitPolicy{
+		Name:    "reactions",
+		UserMax: 30,
+		IPMax:   90,
+		Window:  10 * time.Second,
+	}
+
+	InviteRateLimit = RateLimitPolicy{
+		Name:    "invites",
+		UserMax: 20,
+		IPMax:   50,
+		Window:  time.Hour,
+	}
+
+	JoinRateLimit = RateLimitPolicy{
+		Name:    "joins",
+		UserMax: 20,
+		IPMax:   50,
+		Window:  time.Hour,
+	}
+
+	ReportRateLimit = RateLimitPolicy{
+		Name:    "reports",
+		UserMax: 10,
+		IPMax:   30,
+		Window:  time.Hour,
+	}
+)
+
+// Sliding window over two fixed windows, the previous window's count is weighted by how
+// much of it still overlaps. Each subject has a pair of keys and its own max, every subject is
+// checked before any is counted so a request one of them rejects doesn't use up the others.
+var slidingWindowLimit = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local elapsed = tonumber(ARGV[2])
+local allowed = 1
+local counts = {}
+for i = 1, #KEYS / 2 do
+	local current = tonumber(redis.call("GET", KEYS[i * 2 - 1]) or "0") or 0
+	local previous = tonumber(redis.call("GET", KEYS[i * 2]) or "0") or 0
+	if previous * (window - elapsed) / window + current >= tonumber(ARGV[i + 2]) then
+		allowed = 0
+	end
+	counts[i * 2 - 1] = current
+	counts[i * 2] = previous
+end
+if allowed == 1 then
+	for i = 1, #KEYS / 2 do
+		redis.call("INCR", KEYS[i * 2 - 1])
+		redis.call("PEXPIRE", KEYS[i * 2 - 1], window * 2)
+	end
+end
+table.insert(counts, 1, allowed)
+return counts
+`)
+
+func rateLimitKey(policy RateLimitPolicy, subject string, window int64) string {
+	return fmt.Sprintf("rate-limit-%s-%s-%d", policy.Name, subject, window)
+}
+
+// Who a request is counted against, the viewer or their IP, and how many they get per window
+type rateLimitSubject struct {
+	Name string
+	Max  int64
+}
+
+// The edge proxy appends the address it saw, anything before it came from the client
+func clientIP(c *fiber.Ctx) string {
+	ips := c.IPs()
+
+	if len(ips) > 0 {
+		if ip := strings.TrimSpace(ips[len(ips)-1]); ip != "" {
+			return ip
+		}
+	}
+
+	return c.IP()
+}
+
+// Counts the request against every subject, or none of them when any is over its limit.
+// When it's turned away the longest wait among the subjects over their limit is returned.
+func takeRateLimit(policy RateLimitPolicy, subjects []rateLimitSubject, now time.Time, ctx context.Context, wRdb *redis.Client) (bool, time.Duration, error) {
+	window := policy.Window.Milliseconds()
+	index := now.UnixMilli() / window
+	elapsed := now.UnixMilli() % window
+
+	keys := []string{}
+	args := []interface{}{window, elapsed}
+
+	for _, s := range subjects {
+		keys = append(keys, rateLimitKey(policy, s.Name, index), rateLimitKey(policy, s.Name, index-1))
+		args = append(args, s.Max)
+	}
+
+	res, err := slidingWindowLimit.Run(ctx, wRdb, keys, args...).Int64Slice()
+
+	if err != nil {
+		return true, 0, err
+	}
+
+	if res[0] == 1 {
+		return true, 0, nil
+	}
+
+	var retryAfter time.Duration = 0
+
+	for i, s := range subjects {
+		current, previous := res[i*2+1], res[i*2+2]
+
+		if float64(previous)*float64(window-elapsed)/float64(window)+float64(current) < float64(s.Max) {
+			continue
+		}
+
+		var wait time.Duration
+
+		if current >= s.Max || previous == 0 {
+			// Over the limit on this window alone, nothing frees up until the next one
+			wait = time.Duration(window-elapsed) * time.Millisecond
+		} else {
+			// Otherwise wait until enough of the previous window has slid out
+			w := float64(window-elapsed) - float64(s.Max-1-current)*float64(window)/float64(previous)
+
+			wait = time.Duration(math.Max(w, 0)) * time.Millisecond
+		}
+
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+
+	return false, retryAfter, nil
+}
+
+// Rejects the request with a 429 once the viewer or their IP goes over the policy.
+// When redis can't be reached requests go through rather than locking everyone out.
+func RateLimit(c *fiber.Ctx, ctx context.Context, wRdb *redis.Client, policy RateLimitPolicy) error {
+	now := time.Now()
+
+	subjects := []rateLimitSubject{}
+
+	if user, ok := c.Locals("viewer").(model.Users); ok && policy.UserMax > 0 {
+		subjects = append(subjects, rateLimitSubject{Name: fmt.Sprintf("user-%d", user.ID), Max: policy.UserMax})
+	}
+
+	if policy.IPMax > 0 {
+		subjects = append(subjects, rateLimitSubject{Name: "ip-" + clientIP(c), Max: policy.IPMax})
+	}
+
+	if len(subjects) == 0 {
+		return c.Next()
+	}
+
+	allowed, retryAfter, err := takeRateLimit(policy, subjects, now, ctx, wRdb)
+
+	if err != nil {
+		slog.Error("Couldn't check rate limit 💀",
+			slog.String("error", err.Error()),
+			slog.String("policy", policy.Name))
+	}
+
+	if allowed {
+		return c.Next()
+	}
+
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	slog.Warn("Rate limited",
+		slog.String("policy", policy.Name),
+		slog.String("path", c.Path()))
+
+	c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(seconds, 10))
+
+	return c.Status(fiber.StatusTooManyRequests).JSON(&fiber.Map{
+		"errors": []fiber.Map{{
+			"code":        "rate_limited",
+			"message":     "Too many requests, try again later.",
+			"retry_after": seconds,
+		}},
+	})
+}
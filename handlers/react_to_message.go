@@ -2,11 +2,12 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"strings"
+	"time"
 
 	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/message_helpers"
 	"github.com/macwilko/exotic-auth/security_helpers"
 
 	"github.com/go-playground/locales/en"
@@ -99,9 +100,7 @@ func ReactToMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.
 		})
 	}
 
-	hasPermission := HasCommunityPermission(user.ID, community.ID, model.SendMessages, db, wRdb, rRdb, ctx)
-
-	if !hasPermission {
+	notAllowed := func() error {
 		slog.Warn("Not allowed")
 
 		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
@@ -111,6 +110,14 @@ func ReactToMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.
 		})
 	}
 
+	if _, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx); !member {
+		return notAllowed()
+	}
+
+	if remaining := CommunityTimeout(user.ID, community.ID, db, wRdb, rRdb, ctx); remaining > 0 {
+		return timedOutError(c, remaining)
+	}
+
 	messageId, messageOk := security_helpers.Decode(input.MessageID)
 
 	if messageId == 0 || messageOk != model.MESSAGES_TYPE {
@@ -126,7 +133,7 @@ func ReactToMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.
 
 	message := model.Messages{}
 
-	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND community_id = ?", messageId, community.ID)
+	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND community_id = ? AND deleted = 0", messageId, community.ID)
 
 	if err != nil {
 		slog.Error("No message found 💀 ",
@@ -139,58 +146,50 @@ func ReactToMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.
 		})
 	}
 
-	reactions := model.MessagesReactions{}
-
-	rkey := fmt.Sprintf("message-reactions-%d", messageId)
-
-	val, err := rRdb.Get(ctx, rkey).Result()
+	// Custom emoji have to be in the community's set
+	if name, isEmoji := message_helpers.ReactionEmojiName(input.Reaction); isEmoji {
+		emojis, err := message_helpers.LoadEmojis([]string{name}, community.ID, db)
 
-	if err == nil {
-		json.Unmarshal([]byte(val), &reactions)
-	} else {
-		reactions.MessageID = messageId
-		reactions.Reactions = make(map[string][]model.ReactionUser)
-	}
-
-	r, rf := reactions.Reactions[input.Reaction]
-
-	if rf {
-		adding := true
-		idx := 0
+		if err != nil {
+			slog.Error("Couldn't load emojis 💀 ",
+				slog.String("error", err.Error()))
 
-		for i, ru := range r {
-			if ru.UserID == user.ID {
-				adding = false
-				idx = i
-			}
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Unable to react to message.",
+				}},
+			})
 		}
 
-		if adding {
-			r = append(r, model.ReactionUser{
-				UserID:     user.ID,
-				UserHandle: user.Handle.String,
+		if _, found := emojis[name]; !found {
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"message": "Unknown emoji.",
+				}},
 			})
-		} else {
-			r = model.RemoveReactionUser(r, idx)
 		}
-	} else {
-		r = []model.ReactionUser{{
-			UserID:     user.ID,
-			UserHandle: user.Handle.String,
-		}}
 	}
 
-	reactions.MessageID = messageId
+	channel := model.Channels{}
 
-	if len(r) > 0 {
-		reactions.Reactions[input.Reaction] = r
-	} else {
-		delete(reactions.Reactions, input.Reaction)
+	err = db.Get(&channel, "SELECT * FROM channels WHERE id = ? LIMIT 1", message.ChannelID)
+
+	if err != nil {
+		slog.Error("No channel found 💀 ",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
 	}
 
-	p, err := json.Marshal(reactions)
+	if !HasChannelPermission(user.ID, channel.ID, model.SendMessages, db, wRdb, rRdb, ctx) {
+		return notAllowed()
+	}
 
-	if err != nil {
+	handleCantReactError := func(err error) error {
 		slog.Error("Unable to react to message 💀",
 			slog.String("error", err.Error()))
 
@@ -201,16 +200,74 @@ func ReactToMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.
 		})
 	}
 
-	go func() {
-		_, err = wRdb.Set(ctx, rkey, p, 0).Result()
+	// A legacy key has to be in the table before the toggle can see what's there
+	if err := message_helpers.ImportLegacyReactions(message.ID, db, wRdb, ctx); err != nil {
+		return handleCantReactError(err)
+	}
+
+	// Reacting again with the same reaction takes it away. Each change is a single statement
+	// against the unique (message, user, reaction) key, so simultaneous reacts can't lose updates.
+	res, err := db.Exec("DELETE FROM reactions WHERE message_id = ? AND user_id = ? AND reaction = ?", message.ID, user.ID, input.Reaction)
+
+	if err != nil {
+		return handleCantReactError(err)
+	}
+
+	removed, err := res.RowsAffected()
+
+	if err != nil {
+		return handleCantReactError(err)
+	}
+
+	added := removed == 0
+
+	if added {
+		iq := `
+		INSERT INTO reactions
+		(created_at, message_id, community_id, channel_id, user_id, reaction)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE id = id`
+
+		_, err = db.Exec(iq, time.Now(), message.ID, community.ID, channel.ID, user.ID, input.Reaction)
 
 		if err != nil {
-			slog.Error("Unable to react to message 💀",
-				slog.String("error", err.Error()))
+			return handleCantReactError(err)
 		}
-	}()
+	}
+
+	message_helpers.InvalidateReactions(message.ID, db, wRdb, ctx)
+
+	var count uint64
+
+	err = db.Get(&count, "SELECT count(*) FROM reactions WHERE message_id = ? AND reaction = ?", message.ID, input.Reaction)
+
+	if err != nil {
+		return handleCantReactError(err)
+	}
+
+	eventType := "reaction.removed"
+
+	if added {
+		eventType = "reaction.added"
+	}
+
+	channelTopic := security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt)
+
+	go internal_handlers.SendBroadcast(channelTopic, fiber.Map{
+		"type":       eventType,
+		"id":         security_helpers.Encode(message.ID, model.MESSAGES_TYPE, message.Salt),
+		"channel_id": channelTopic,
+		"reaction":   input.Reaction,
+		"count":      count,
+		"user": fiber.Map{
+			"user_id":     user.ID,
+			"user_handle": user.Handle.String,
+		},
+	})
 
 	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
 		"updated": true,
+		"reacted": added,
+		"count":   count,
 	})
 }
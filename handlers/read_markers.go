@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+type ReadChannelInput struct {
+	ChannelID string `json:"channel_id" validate:"required,gte=3,lte=255"`
+	MessageID string `json:"message_id" validate:"required,gte=3,lte=255"`
+}
+
+// Marks the channel read up to and including the given message
+func ReadChannel(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Marking channel read ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(ReadChannelInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to mark channel read, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to mark channel read, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	channelId, channelOk := security_helpers.Decode(input.ChannelID)
+
+	if channelId == 0 || channelOk != model.CHANNELS_TYPE {
+		slog.Error("Channel security ID failure 💀")
+
+		return notFound()
+	}
+
+	_, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !member || !HasChannelPermission(user.ID, channelId, model.ViewChannels, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	messageId, messageOk := security_helpers.Decode(input.MessageID)
+
+	if messageId == 0 || messageOk != model.MESSAGES_TYPE {
+		slog.Error("Message security ID failure 💀")
+
+		return notFound()
+	}
+
+	message := model.Messages{}
+
+	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND channel_id = ? AND community_id = ? LIMIT 1", messageId, channelId, community.ID)
+
+	if err != nil {
+		slog.Error("No message found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	moved, err := message_helpers.MoveReadMarkers(user, []model.ReadMarkers{{
+		ChannelID:   message.ChannelID,
+		CommunityID: message.CommunityID,
+		MessageID:   message.ID,
+		Seq:         message.Seq,
+		ReadAt:      message.CreatedAt,
+	}}, db, wRdb, ctx)
+
+	if err != nil {
+		slog.Error("Unable to mark channel read 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to mark channel read.",
+			}},
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"updated": len(moved) > 0,
+	})
+}
+
+// Marks every channel the viewer can see in the community read up to its latest message
+func ReadCommunity(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Marking community read ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	_, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !member || !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	handleCantReadError := func(err error) error {
+		slog.Error("Unable to mark community read 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to mark community read.",
+			}},
+		})
+	}
+
+	type latestMessage struct {
+		ChannelID uint64 `db:"channel_id"`
+		MessageID uint64 `db:"message_id"`
+		Seq       uint64 `db:"seq"`
+	}
+
+	latest := []latestMessage{}
+
+	err = db.Select(&latest, "SELECT channel_id, MAX(id) AS message_id, MAX(seq) AS seq FROM messages WHERE community_id = ? GROUP BY channel_id", community.ID)
+
+	if err != nil {
+		return handleCantReadError(err)
+	}
+
+	readAt := time.Now()
+
+	markers := []model.ReadMarkers{}
+
+	for _, l := range latest {
+		if !channelPermissions.Has(l.ChannelID, model.ViewChannels) {
+			continue
+		}
+
+		markers = append(markers, model.ReadMarkers{
+			ChannelID:   l.ChannelID,
+			CommunityID: community.ID,
+			MessageID:   l.MessageID,
+			Seq:         l.Seq,
+			ReadAt:      readAt,
+		})
+	}
+
+	moved, err := message_helpers.MoveReadMarkers(user, markers, db, wRdb, ctx)
+
+	if err != nil {
+		return handleCantReadError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"updated": len(moved),
+	})
+}
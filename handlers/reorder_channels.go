@@ -0,0 +1,504 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+type ReorderChannelsGroupInput struct {
+	GroupID    string   `json:"group_id" validate:"required,gte=3,lte=255"`
+	ChannelIDs []string `json:"channel_ids" validate:"lte=500,dive,gte=3,lte=255"`
+}
+
+// The whole sidebar in order, top channels first and then each group with its channels.
+// Listing a channel under another group moves it there.
+type ReorderChannelsInput struct {
+	TopChannelIDs []string                    `json:"top_channel_ids" validate:"lte=500,dive,gte=3,lte=255"`
+	Groups        []ReorderChannelsGroupInput `json:"groups" validate:"lte=100,dive"`
+}
+
+func ReorderChannels(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Reordering channels ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(ReorderChannelsInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Warn("Unable to reorder channels, input 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "input validation"))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("Community not found 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "community not found reordering channels"))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	hasPermission := HasCommunityPermission(user.ID, community.ID, model.ManageChannels, db, wRdb, rRdb, ctx)
+
+	if !hasPermission {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !ok {
+		slog.Error("Couldn't load channel permissions 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	channels, groups, err := sortedChannels(community.ID, db)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "selecting channels to reorder"))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	visibleGroups := visibleChannelGroups(channels, groups, channelPermissions)
+
+	channelsMap := make(map[uint64]model.Channels)
+
+	for _, ch := range channels {
+		channelsMap[ch.ID] = ch
+	}
+
+	groupsMap := make(map[uint64]model.ChannelGroups)
+
+	for _, cg := range groups {
+		groupsMap[cg.ID] = cg
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	seenChannels := make(map[uint64]bool)
+
+	decodeChannels := func(encodedIds []string) ([]uint64, bool) {
+		var ids = []uint64{}
+
+		for _, encodedId := range encodedIds {
+			id, idType := security_helpers.Decode(encodedId)
+
+			if _, found := channelsMap[id]; !found || idType != model.CHANNELS_TYPE {
+				return nil, false
+			}
+
+			// Channels the editor can't see can't be moved by them either
+			if seenChannels[id] || !channelPermissions.Has(id, model.ViewChannels) {
+				return nil, false
+			}
+
+			seenChannels[id] = true
+
+			ids = append(ids, id)
+		}
+
+		return ids, true
+	}
+
+	topChannelIds, ok := decodeChannels(input.TopChannelIDs)
+
+	if !ok {
+		return notFound()
+	}
+
+	var groupIds = []uint64{}
+
+	groupChannelIds := make(map[uint64][]uint64)
+
+	seenGroups := make(map[uint64]bool)
+
+	for _, g := range input.Groups {
+		groupId, idType := security_helpers.Decode(g.GroupID)
+
+		if _, found := groupsMap[groupId]; !found || idType != model.CHANNEL_GROUPS_TYPE {
+			return notFound()
+		}
+
+		if seenGroups[groupId] || !visibleGroups[groupId] {
+			return notFound()
+		}
+
+		ids, ok := decodeChannels(g.ChannelIDs)
+
+		if !ok {
+			return notFound()
+		}
+
+		seenGroups[groupId] = true
+
+		groupIds = append(groupIds, groupId)
+		groupChannelIds[groupId] = ids
+	}
+
+	// Hidden channels and groups keep their group and go after the ones the editor sorted
+	for _, ch := range channels {
+		if channelPermissions.Has(ch.ID, model.ViewChannels) {
+			if !seenChannels[ch.ID] {
+				slog.Warn("Channel missing from reorder 💀")
+
+				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+					"errors": []fiber.Map{{
+						"message": "Every channel and group needs to be in the new order.",
+					}},
+				})
+			}
+
+			continue
+		}
+
+		if ch.GroupID == 0 {
+			topChannelIds = append(topChannelIds, ch.ID)
+		} else {
+			groupChannelIds[ch.GroupID] = append(groupChannelIds[ch.GroupID], ch.ID)
+		}
+	}
+
+	for _, cg := range groups {
+		if visibleGroups[cg.ID] {
+			if !seenGroups[cg.ID] {
+				slog.Warn("Group missing from reorder 💀")
+
+				return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+					"errors": []fiber.Map{{
+						"message": "Every channel and group needs to be in the new order.",
+					}},
+				})
+			}
+
+			continue
+		}
+
+		groupIds = append(groupIds, cg.ID)
+	}
+
+	handleCantEditError := func(err error, reason string) error {
+
+		if err != nil {
+			slog.Error("Can't reorder channels 💀",
+				slog.String("error", err.Error()),
+				slog.String("area", reason))
+		}
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to reorder channels.",
+			}},
+		})
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return handleCantEditError(err, "Couldn't begin tx, db error 💀")
+	}
+
+	handleTxError := func(err error, reason string) error {
+		tx.Rollback()
+
+		return handleCantEditError(err, reason)
+	}
+
+	movedGroup := false
+
+	moveChannels := func(groupId uint64, ids []uint64) error {
+		for i, id := range ids {
+			ch := channelsMap[id]
+
+			if ch.GroupID == groupId && ch.Position == uint32(i) {
+				continue
+			}
+
+			movedGroup = movedGroup || ch.GroupID != groupId
+
+			uq := `
+			UPDATE channels
+			SET group_id = ?, position = ?
+			WHERE id = ?
+			AND community_id = ?`
+
+			_, err := tx.Exec(uq, groupId, i, id, community.ID)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err = moveChannels(0, topChannelIds)
+
+	if err != nil {
+		return handleTxError(err, "Can't move top channels")
+	}
+
+	for i, groupId := range groupIds {
+		if groupsMap[groupId].Position != uint32(i) {
+			uq := `
+			UPDATE channel_groups
+			SET position = ?
+			WHERE id = ?
+			AND community_id = ?`
+
+			_, err = tx.Exec(uq, i, groupId, community.ID)
+
+			if err != nil {
+				return handleTxError(err, "Can't move groups")
+			}
+		}
+
+		err = moveChannels(groupId, groupChannelIds[groupId])
+
+		if err != nil {
+			return handleTxError(err, "Can't move group channels")
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return handleCantEditError(err, "Couldn't commit channel reorder")
+	}
+
+	// A channel in another group inherits that group's overwrites
+	if movedGroup {
+		if err := ClearChannelPermissions(community.ID, db, wRdb, ctx); err != nil {
+			slog.Error("Couldn't clear channel permissions 💀",
+				slog.String("error", err.Error()))
+		}
+	}
+
+	BroadcastChannelLayout(community, db, wRdb, rRdb, ctx)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"updated": true})
+}
+
+// Everyone connected to the community listens here for changes to its sidebar. It's the
+// community's own id, the ws api checks membership for private communities.
+func CommunityTopic(community model.Communities) string {
+	return security_helpers.Encode(community.ID, model.COMMUNITIES_TYPE, community.Salt)
+}
+
+// The community's channels and groups in sidebar order
+func sortedChannels(cId uint64, db *sqlx.DB) ([]model.Channels, []model.ChannelGroups, error) {
+
+	channels := []model.Channels{}
+
+	err := db.Select(&channels, "SELECT * FROM channels WHERE community_id = ? ORDER BY position, id", cId)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groups := []model.ChannelGroups{}
+
+	err = db.Select(&groups, "SELECT * FROM channel_groups WHERE community_id = ? ORDER BY position, id", cId)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return channels, groups, nil
+}
+
+// A group shows when it can be viewed, or when a channel in it has been opened up
+func visibleChannelGroups(channels []model.Channels, groups []model.ChannelGroups, cp ChannelPermissionSet) map[uint64]bool {
+
+	visible := make(map[uint64]bool)
+
+	for _, cg := range groups {
+		if cp.Groups[cg.ID].Has(model.ViewChannels) {
+			visible[cg.ID] = true
+		}
+	}
+
+	for _, ch := range channels {
+		if ch.GroupID > 0 && cp.Has(ch.ID, model.ViewChannels) {
+			visible[ch.GroupID] = true
+		}
+	}
+
+	return visible
+}
+
+// Next position at the end of a group, or of the top channels when the group is 0
+func nextChannelPosition(tx *sqlx.Tx, cId uint64, groupId uint64) (uint32, error) {
+
+	var position uint32
+
+	err := tx.Get(&position, "SELECT COALESCE(MAX(position) + 1, 0) FROM channels WHERE community_id = ? AND group_id = ?", cId, groupId)
+
+	return position, err
+}
+
+// Sends the new sidebar order to everyone on the community topic so clients can re-sort.
+// Only channels guests can see are listed, when anything is left out complete is false and
+// clients showing hidden channels should fetch the community again.
+func BroadcastChannelLayout(community model.Communities, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) {
+
+	channels, groups, err := sortedChannels(community.ID, db)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "selecting channels for layout"))
+
+		return
+	}
+
+	channelPermissions, ok := CommunityChannelPermissions(0, community.ID, db, wRdb, rRdb, ctx)
+
+	if !ok {
+		slog.Error("Couldn't load channel permissions 💀")
+
+		return
+	}
+
+	visibleGroups := visibleChannelGroups(channels, groups, channelPermissions)
+
+	complete := true
+
+	topChannelIds := []string{}
+
+	groupChannelIds := make(map[uint64][]string)
+
+	for _, ch := range channels {
+		if !channelPermissions.Has(ch.ID, model.ViewChannels) {
+			complete = false
+
+			continue
+		}
+
+		id := security_helpers.Encode(ch.ID, model.CHANNELS_TYPE, ch.Salt)
+
+		if ch.GroupID == 0 {
+			topChannelIds = append(topChannelIds, id)
+		} else {
+			groupChannelIds[ch.GroupID] = append(groupChannelIds[ch.GroupID], id)
+		}
+	}
+
+	mg := []fiber.Map{}
+
+	for _, cg := range groups {
+		if !visibleGroups[cg.ID] {
+			complete = false
+
+			continue
+		}
+
+		channelIds, found := groupChannelIds[cg.ID]
+
+		if !found {
+			channelIds = []string{}
+		}
+
+		mg = append(mg, fiber.Map{
+			"id":          security_helpers.Encode(cg.ID, model.CHANNEL_GROUPS_TYPE, cg.Salt),
+			"channel_ids": channelIds,
+		})
+	}
+
+	go internal_handlers.SendBroadcast(CommunityTopic(community), fiber.Map{
+		"type":            "channels.reordered",
+		"top_channel_ids": topChannelIds,
+		"groups":          mg,
+		"complete":        complete,
+	})
+}
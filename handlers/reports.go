@@ -0,0 +1,722 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Reports returned per page of the queue
+const reportsPageSize = 25
+
+type CreateReportInput struct {
+	MessageID *string `json:"message_id" validate:"omitempty,gte=3,lte=255"`
+	UserID    *string `json:"user_id" validate:"omitempty,gte=3,lte=255"`
+	Category  string  `json:"category" validate:"required,oneof=spam harassment hate nsfw violence self_harm other"`
+	Details   *string `json:"details" validate:"omitempty,lte=1000"`
+}
+
+type ResolveReportInput struct {
+	ReportID string `json:"report_id" validate:"required,gte=3,lte=255"`
+	Action   string `json:"action" validate:"required,oneof=kick ban delete_message none"`
+}
+
+type DismissReportInput struct {
+	ReportID string `json:"report_id" validate:"required,gte=3,lte=255"`
+}
+
+// Reports a message, or a member directly, to the community's moderators
+func CreateReport(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Creating report ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(CreateReportInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to create report, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	} else if (input.MessageID == nil) == (input.UserID == nil) {
+		errors = append(errors, fiber.Map{
+			"field":   "MessageID",
+			"message": "Report either a message or a user.",
+		})
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to create report, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ViewChannels, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	report := model.Reports{
+		CreatedAt:   time.Now().Truncate(time.Second),
+		Salt:        uuid.New().String(),
+		CommunityID: community.ID,
+		ReporterID:  user.ID,
+		Category:    input.Category,
+		Status:      model.REPORT_OPEN,
+	}
+
+	if input.Details != nil && len(strings.TrimSpace(*input.Details)) > 0 {
+		report.Details = sql.NullString{String: strings.TrimSpace(*input.Details), Valid: true}
+	}
+
+	if input.MessageID != nil {
+		messageId, messageOk := security_helpers.Decode(*input.MessageID)
+
+		if messageId == 0 || messageOk != model.MESSAGES_TYPE {
+			slog.Error("Message security ID failure 💀")
+
+			return notFound()
+		}
+
+		message := model.Messages{}
+
+		err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND community_id = ? AND deleted = 0 LIMIT 1", messageId, community.ID)
+
+		if err != nil || !HasChannelPermission(user.ID, message.ChannelID, model.ViewChannels, db, wRdb, rRdb, ctx) {
+			slog.Error("No message found 💀 " + handle)
+
+			return notFound()
+		}
+
+		report.TargetUserID = message.UserID
+		report.MessageID = message.ID
+		report.ChannelID = message.ChannelID
+		report.MessageText = sql.NullString{String: message.Text, Valid: true}
+	} else {
+		targetId, targetOk := security_helpers.Decode(*input.UserID)
+
+		if targetId == 0 || targetOk != model.USERS_TYPE {
+			slog.Error("User security ID failure 💀")
+
+			return notFound()
+		}
+
+		var members int
+
+		err = db.Get(&members, "SELECT COUNT(*) FROM communities_users WHERE user_id = ? AND community_id = ?", targetId, community.ID)
+
+		if err != nil || members == 0 {
+			slog.Error("No member found 💀 " + handle)
+
+			return notFound()
+		}
+
+		report.TargetUserID = targetId
+	}
+
+	if report.TargetUserID == user.ID {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "You can't report yourself.",
+			}},
+		})
+	}
+
+	handleCantCreateError := func(err error) error {
+		slog.Error("Unable to create report 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to create report.",
+			}},
+		})
+	}
+
+	var open int
+
+	dq := `
+	SELECT COUNT(*)
+	FROM reports
+	WHERE reporter_id = ?
+	AND community_id = ?
+	AND target_user_id = ?
+	AND message_id = ?
+	AND status = ?`
+
+	err = db.Get(&open, dq, user.ID, community.ID, report.TargetUserID, report.MessageID, model.REPORT_OPEN)
+
+	if err != nil {
+		return handleCantCreateError(err)
+	}
+
+	if open > 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "You've already reported this.",
+			}},
+		})
+	}
+
+	iq := `
+	INSERT INTO reports
+	(created_at, object_salt, community_id, reporter_id, target_user_id, message_id, channel_id, message_text, category, details, status)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	res, err := db.Exec(iq, report.CreatedAt, report.Salt, report.CommunityID, report.ReporterID, report.TargetUserID, report.MessageID,
+		report.ChannelID, report.MessageText, report.Category, report.Details, report.Status)
+
+	if err != nil {
+		return handleCantCreateError(err)
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return handleCantCreateError(err)
+	}
+
+	report.ID = uint64(id)
+
+	go message_helpers.BroadcastReports(community, "report.created", []model.Reports{report}, db)
+
+	// The reporter only learns the report was made, what happens next is between the moderators
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"id":         security_helpers.Encode(report.ID, model.REPORTS_TYPE, report.Salt),
+		"created_at": report.CreatedAt.Format(time.RFC3339),
+		"status":     report.Status,
+	})
+}
+
+// The moderators' queue of reports in one state, newest first
+func Reports(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Fetching reports ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	invalidInput := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Invalid input.",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		return notFound(err, "selecting community")
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageChannels, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	status := c.Query("status", model.REPORT_OPEN)
+
+	if status != model.REPORT_OPEN && status != model.REPORT_RESOLVED && status != model.REPORT_DISMISSED {
+		slog.Warn("Invalid report status 💀")
+
+		return invalidInput()
+	}
+
+	var beforeId uint64 = 0
+
+	if cursor := c.Query("before"); len(cursor) > 0 {
+		id, idType := security_helpers.Decode(Truncate(cursor, 255))
+
+		if id == 0 || idType != model.REPORTS_TYPE {
+			slog.Warn("Invalid report cursor 💀")
+
+			return invalidInput()
+		}
+
+		beforeId = id
+	}
+
+	q := "SELECT * FROM reports WHERE community_id = ? AND status = ?"
+
+	args := []interface{}{community.ID, status}
+
+	if beforeId > 0 {
+		q += " AND id < ?"
+		args = append(args, beforeId)
+	}
+
+	q += " ORDER BY id DESC LIMIT ?"
+	args = append(args, reportsPageSize+1)
+
+	reports := []model.Reports{}
+
+	err = db.Select(&reports, q, args...)
+
+	if err != nil {
+		return notFound(err, "selecting reports")
+	}
+
+	hasMore := len(reports) > reportsPageSize
+
+	if hasMore {
+		reports = reports[:reportsPageSize]
+	}
+
+	mapped, err := message_helpers.MapReports(reports, db)
+
+	if err != nil {
+		return notFound(err, "mapping reports")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"reports":  mapped,
+		"has_more": hasMore,
+	})
+}
+
+// Acts on a report. Kicking or banning resolves every open report about the member,
+// deleting the message resolves every open report about the message.
+func ResolveReport(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Resolving report ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(ResolveReportInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to resolve report, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to resolve report, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notAllowed := func() error {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	community, report, err := openReport(c, ctx, user, input.ReportID, db, wRdb, rRdb)
+
+	if err != nil || report.ID == 0 {
+		return err
+	}
+
+	switch input.Action {
+	case model.REPORT_KICK:
+		if !HasCommunityPermission(user.ID, community.ID, model.KickMembers, db, wRdb, rRdb, ctx) || report.TargetUserID == community.OwnerID {
+			return notAllowed()
+		}
+	case model.REPORT_BAN:
+		if !HasCommunityPermission(user.ID, community.ID, model.BanMembers, db, wRdb, rRdb, ctx) || report.TargetUserID == community.OwnerID {
+			return notAllowed()
+		}
+	case model.REPORT_DELETE_MESSAGE:
+		if report.MessageID == 0 {
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"errors": []fiber.Map{{
+					"field":   "Action",
+					"message": "Only reports about a message can delete it.",
+				}},
+			})
+		}
+	}
+
+	handleCantResolveError := func(err error) error {
+		slog.Error("Unable to resolve report 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to resolve report.",
+			}},
+		})
+	}
+
+	switch input.Action {
+	case model.REPORT_KICK:
+		err = KickMember(report.TargetUserID, community, db, wRdb, ctx)
+	case model.REPORT_BAN:
+		err = BanMember(report.TargetUserID, community, db, wRdb, ctx)
+	case model.REPORT_DELETE_MESSAGE:
+		message := model.Messages{}
+
+		err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND community_id = ? LIMIT 1", report.MessageID, community.ID)
+
+		// Already gone, there's nothing left to delete
+		if err == sql.ErrNoRows || (err == nil && message.Deleted) {
+			err = nil
+		} else if err == nil {
+			err = DeleteMessageAndBroadcast(message, user.ID, db, wRdb, ctx)
+		}
+	}
+
+	if err != nil {
+		return handleCantResolveError(err)
+	}
+
+	uq := "UPDATE reports SET status = ?, resolution = ?, resolved_by = ?, resolved_at = ?, updated_at = ? WHERE community_id = ? AND status = ?"
+
+	resolvedAt := time.Now().Truncate(time.Second)
+
+	args := []interface{}{model.REPORT_RESOLVED, input.Action, user.ID, resolvedAt, resolvedAt, community.ID, model.REPORT_OPEN}
+
+	sq := "SELECT * FROM reports WHERE community_id = ? AND status = ?"
+
+	sArgs := []interface{}{community.ID, model.REPORT_OPEN}
+
+	var filter string
+	var filterArg uint64
+
+	switch input.Action {
+	case model.REPORT_KICK, model.REPORT_BAN:
+		filter, filterArg = " AND target_user_id = ?", report.TargetUserID
+	case model.REPORT_DELETE_MESSAGE:
+		filter, filterArg = " AND message_id = ?", report.MessageID
+	default:
+		filter, filterArg = " AND id = ?", report.ID
+	}
+
+	resolved := []model.Reports{}
+
+	err = db.Select(&resolved, sq+filter, append(sArgs, filterArg)...)
+
+	if err != nil {
+		return handleCantResolveError(err)
+	}
+
+	_, err = db.Exec(uq+filter, append(args, filterArg)...)
+
+	if err != nil {
+		return handleCantResolveError(err)
+	}
+
+	for i := range resolved {
+		resolved[i].Status = model.REPORT_RESOLVED
+		resolved[i].Resolution = sql.NullString{String: input.Action, Valid: true}
+		resolved[i].ResolvedBy = user.ID
+		resolved[i].ResolvedAt = sql.NullTime{Time: resolvedAt, Valid: true}
+	}
+
+	go message_helpers.BroadcastReports(community, "report.updated", resolved, db)
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"id":       input.ReportID,
+		"status":   model.REPORT_RESOLVED,
+		"action":   input.Action,
+		"resolved": len(resolved),
+	})
+}
+
+// Closes a report without acting on it
+func DismissReport(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Dismissing report ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(DismissReportInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to dismiss report, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to dismiss report, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	community, report, err := openReport(c, ctx, user, input.ReportID, db, wRdb, rRdb)
+
+	if err != nil || report.ID == 0 {
+		return err
+	}
+
+	dismissedAt := time.Now().Truncate(time.Second)
+
+	_, err = db.Exec("UPDATE reports SET status = ?, resolved_by = ?, resolved_at = ?, updated_at = ? WHERE id = ? AND status = ?",
+		model.REPORT_DISMISSED, user.ID, dismissedAt, dismissedAt, report.ID, model.REPORT_OPEN)
+
+	if err != nil {
+		slog.Error("Unable to dismiss report 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to dismiss report.",
+			}},
+		})
+	}
+
+	report.Status = model.REPORT_DISMISSED
+	report.ResolvedBy = user.ID
+	report.ResolvedAt = sql.NullTime{Time: dismissedAt, Valid: true}
+
+	go message_helpers.BroadcastReports(community, "report.updated", []model.Reports{report}, db)
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"id":     input.ReportID,
+		"status": model.REPORT_DISMISSED,
+	})
+}
+
+// Finds an open report in the community for a moderator. When it can't, the error response is
+// written and the report returned is empty.
+func openReport(c *fiber.Ctx, ctx context.Context, user model.Users, encodedId string, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client) (model.Communities, model.Reports, error) {
+
+	community := model.Communities{}
+	report := model.Reports{}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return community, report, notFound()
+	}
+
+	if !HasCommunityPermission(user.ID, community.ID, model.ManageChannels, db, wRdb, rRdb, ctx) {
+		slog.Warn("Not allowed")
+
+		return community, report, c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	reportId, reportOk := security_helpers.Decode(encodedId)
+
+	if reportId == 0 || reportOk != model.REPORTS_TYPE {
+		slog.Error("Report security ID failure 💀")
+
+		return community, report, notFound()
+	}
+
+	err = db.Get(&report, "SELECT * FROM reports WHERE id = ? AND community_id = ? LIMIT 1", reportId, community.ID)
+
+	if err != nil {
+		slog.Error("No report found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return community, model.Reports{}, notFound()
+	}
+
+	if report.Status != model.REPORT_OPEN {
+		return community, model.Reports{}, c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Report has already been handled.",
+			}},
+		})
+	}
+
+	return community, report, nil
+}
@@ -0,0 +1,788 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/security_helpers"
+	"github.com/macwilko/exotic-auth/tasks"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// How far ahead a message can be scheduled
+const maxScheduleAhead = 30 * 24 * time.Hour
+
+// How many messages each member can have waiting to send in a community
+const maxPendingScheduledMessages = 25
+
+type ScheduleMessageInput struct {
+	ChannelID string  `json:"channel_id" validate:"required,lte=255"`
+	Text      string  `json:"text" validate:"required,lte=2000"`
+	ParentID  *string `json:"parent_id" validate:"omitempty,lte=255"`
+	SendAt    string  `json:"send_at" validate:"required,lte=64"`
+}
+
+type EditScheduledMessageInput struct {
+	ID     string  `json:"id" validate:"required,gte=3,lte=255"`
+	Text   *string `json:"text" validate:"omitempty,lte=2000"`
+	SendAt *string `json:"send_at" validate:"omitempty,lte=64"`
+}
+
+type CancelScheduledMessageInput struct {
+	ID string `json:"id" validate:"required,gte=3,lte=255"`
+}
+
+func ScheduleMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Scheduling message ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(ScheduleMessageInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to schedule message, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	sendAt, sendAtOk := parseSendAt(input.SendAt)
+
+	if len(errors) == 0 && !sendAtOk {
+		errors = append(errors, fiber.Map{
+			"field":   "SendAt",
+			"message": "Messages can be scheduled up to 30 days ahead.",
+		})
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to schedule message, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	notAllowed := func() error {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	if _, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx); !member {
+		return notAllowed()
+	}
+
+	if remaining := CommunityTimeout(user.ID, community.ID, db, wRdb, rRdb, ctx); remaining > 0 {
+		return timedOutError(c, remaining)
+	}
+
+	channelId, channelOk := security_helpers.Decode(input.ChannelID)
+
+	if channelId == 0 || channelOk != model.CHANNELS_TYPE {
+		slog.Error("Channel security ID failure 💀")
+
+		return notFound()
+	}
+
+	channel := model.Channels{}
+
+	err = db.Get(&channel, "SELECT * FROM channels WHERE id = ? AND community_id = ? LIMIT 1", channelId, community.ID)
+
+	if err != nil {
+		slog.Error("No channel found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	// Overwrites on the channel or its group can take sending away
+	if !HasChannelPermission(user.ID, channel.ID, model.SendMessages, db, wRdb, rRdb, ctx) {
+		return notAllowed()
+	}
+
+	var parentId uint64 = 0
+
+	if input.ParentID != nil {
+		pId, parentOk := security_helpers.Decode(*input.ParentID)
+
+		if pId == 0 || parentOk != model.MESSAGES_TYPE {
+			slog.Error("Parent security ID failure 💀")
+
+			return notFound()
+		}
+
+		err = db.Get(&parentId, "SELECT id FROM messages WHERE id = ? AND channel_id = ? AND deleted = 0 LIMIT 1", pId, channel.ID)
+
+		if err != nil {
+			slog.Error("No parent message found 💀 "+handle,
+				slog.String("error", err.Error()))
+
+			return notFound()
+		}
+	}
+
+	handleCantScheduleError := func(err error) error {
+		slog.Error("Unable to schedule message 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to schedule message.",
+			}},
+		})
+	}
+
+	var pending uint64
+
+	err = db.Get(&pending, "SELECT count(*) FROM scheduled_messages WHERE user_id = ? AND community_id = ? AND sent_at IS NULL AND failed_at IS NULL", user.ID, community.ID)
+
+	if err != nil {
+		return handleCantScheduleError(err)
+	}
+
+	if pending >= maxPendingScheduledMessages {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message":                "Scheduled message limit reached.",
+				"max_scheduled_messages": maxPendingScheduledMessages,
+			}},
+		})
+	}
+
+	scheduled := model.ScheduledMessages{
+		CreatedAt:   time.Now(),
+		Salt:        uuid.New().String(),
+		CommunityID: community.ID,
+		ChannelID:   channel.ID,
+		UserID:      user.ID,
+		ParentID:    parentId,
+		Text:        input.Text,
+		SendAt:      sendAt,
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return handleCantScheduleError(err)
+	}
+
+	handleTxError := func(err error) error {
+		tx.Rollback()
+
+		return handleCantScheduleError(err)
+	}
+
+	iq := `
+	INSERT INTO scheduled_messages
+	(created_at, object_salt, community_id, channel_id, user_id, parent_id, text, send_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(iq, scheduled.CreatedAt, scheduled.Salt, scheduled.CommunityID, scheduled.ChannelID, scheduled.UserID, scheduled.ParentID, scheduled.Text, scheduled.SendAt)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	err = tx.Get(&scheduled.ID, "SELECT LAST_INSERT_ID()")
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return handleCantScheduleError(err)
+	}
+
+	// Queued once the row is committed, a task that ran before then would find nothing to send
+	err = enqueueScheduledMessage(scheduled, queue, db)
+
+	if err != nil {
+		return handleCantScheduleError(err)
+	}
+
+	ms := scheduled.ToFiberMap()
+
+	ms["channel"] = channel.ToFiberMap()
+
+	return c.Status(fiber.StatusOK).JSON(ms)
+}
+
+// Lists the viewer's scheduled messages in the community that haven't gone out, soonest first.
+// Ones that couldn't be sent are included so the author can see why.
+func ScheduledMessages(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Starting fetch scheduled messages ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		return notFound(err, "can't find community")
+	}
+
+	scheduled := []model.ScheduledMessages{}
+
+	sq := `
+	SELECT *
+	FROM scheduled_messages
+	WHERE user_id = ?
+	AND community_id = ?
+	AND sent_at IS NULL
+	ORDER BY send_at ASC`
+
+	err = db.Select(&scheduled, sq, user.ID, community.ID)
+
+	if err != nil {
+		return notFound(err, "selecting scheduled messages")
+	}
+
+	var channelIds = []uint64{}
+	var parentIds = []uint64{}
+
+	for _, s := range scheduled {
+		channelIds = append(channelIds, s.ChannelID)
+
+		if s.ParentID > 0 {
+			parentIds = append(parentIds, s.ParentID)
+		}
+	}
+
+	channelsMap := make(map[uint64]model.Channels)
+
+	if len(channelIds) > 0 {
+		cq, cArgs, err := sqlx.In("SELECT * FROM channels WHERE id IN (?)", channelIds)
+
+		if err != nil {
+			return notFound(err, "building channels query")
+		}
+
+		channels := []model.Channels{}
+
+		err = db.Select(&channels, db.Rebind(cq), cArgs...)
+
+		if err != nil {
+			return notFound(err, "selecting channels")
+		}
+
+		for _, ch := range channels {
+			channelsMap[ch.ID] = ch
+		}
+	}
+
+	parentsMap := make(map[uint64]model.Messages)
+
+	if len(parentIds) > 0 {
+		pq, pArgs, err := sqlx.In("SELECT * FROM messages WHERE id IN (?)", parentIds)
+
+		if err != nil {
+			return notFound(err, "building parents query")
+		}
+
+		parents := []model.Messages{}
+
+		err = db.Select(&parents, db.Rebind(pq), pArgs...)
+
+		if err != nil {
+			return notFound(err, "selecting parents")
+		}
+
+		for _, p := range parents {
+			parentsMap[p.ID] = p
+		}
+	}
+
+	ms := []fiber.Map{}
+
+	for _, s := range scheduled {
+		channel, found := channelsMap[s.ChannelID]
+
+		if !found {
+			continue
+		}
+
+		m := s.ToFiberMap()
+
+		m["channel"] = channel.ToFiberMap()
+
+		if p, found := parentsMap[s.ParentID]; found {
+			m["parent"] = p.ToFiberMap()
+		}
+
+		ms = append(ms, m)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"scheduled_messages":     ms,
+		"max_scheduled_messages": maxPendingScheduledMessages,
+	})
+}
+
+func EditScheduledMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Editing scheduled message ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(EditScheduledMessageInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to edit scheduled message, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if input.Text != nil && len(strings.TrimSpace(*input.Text)) == 0 {
+		errors = append(errors, fiber.Map{
+			"field":   "Text",
+			"message": "Text is a required field",
+		})
+	}
+
+	var sendAt time.Time
+
+	if input.SendAt != nil {
+		var sendAtOk bool
+
+		sendAt, sendAtOk = parseSendAt(*input.SendAt)
+
+		if !sendAtOk {
+			errors = append(errors, fiber.Map{
+				"field":   "SendAt",
+				"message": "Messages can be scheduled up to 30 days ahead.",
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to edit scheduled message, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	handleCantEditError := func(err error) error {
+		slog.Error("Unable to edit scheduled message 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to edit scheduled message.",
+			}},
+		})
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return handleCantEditError(err)
+	}
+
+	handleTxError := func(err error) error {
+		tx.Rollback()
+
+		return handleCantEditError(err)
+	}
+
+	scheduled, err := findScheduledMessage(c, tx, user, input.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	if !scheduled.IsPending() {
+		tx.Rollback()
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Scheduled message can't be changed.",
+			}},
+		})
+	}
+
+	if input.Text != nil {
+		scheduled.Text = *input.Text
+	}
+
+	rescheduled := input.SendAt != nil && !sendAt.Equal(scheduled.SendAt)
+
+	if rescheduled {
+		scheduled.SendAt = sendAt
+	}
+
+	scheduled.UpdatedAt = sql.NullTime{Time: time.Now(), Valid: true}
+
+	_, err = tx.Exec("UPDATE scheduled_messages SET text = ?, send_at = ?, updated_at = ? WHERE id = ?", scheduled.Text, scheduled.SendAt, scheduled.UpdatedAt, scheduled.ID)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return handleCantEditError(err)
+	}
+
+	// The task for the old time is left to find the send time moved and do nothing
+	if rescheduled {
+		err = enqueueScheduledMessage(scheduled, queue, db)
+
+		if err != nil {
+			return handleCantEditError(err)
+		}
+	}
+
+	channel := model.Channels{}
+
+	err = db.Get(&channel, "SELECT * FROM channels WHERE id = ? LIMIT 1", scheduled.ChannelID)
+
+	if err != nil {
+		return handleCantEditError(err)
+	}
+
+	ms := scheduled.ToFiberMap()
+
+	ms["channel"] = channel.ToFiberMap()
+
+	return c.Status(fiber.StatusOK).JSON(ms)
+}
+
+func CancelScheduledMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Cancelling scheduled message ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(CancelScheduledMessageInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to cancel scheduled message, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to cancel scheduled message, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	handleCantCancelError := func(err error) error {
+		slog.Error("Unable to cancel scheduled message 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to cancel scheduled message.",
+			}},
+		})
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return handleCantCancelError(err)
+	}
+
+	scheduled, err := findScheduledMessage(c, tx, user, input.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	if scheduled.SentAt.Valid {
+		tx.Rollback()
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Scheduled message already sent.",
+			}},
+		})
+	}
+
+	// Its task finds nothing when it runs
+	_, err = tx.Exec("DELETE FROM scheduled_messages WHERE id = ?", scheduled.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return handleCantCancelError(err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return handleCantCancelError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"cancelled": true,
+	})
+}
+
+// Send times are RFC3339 and have to be in the future, within maxScheduleAhead
+func parseSendAt(s string) (time.Time, bool) {
+	sendAt, err := time.Parse(time.RFC3339, s)
+
+	if err != nil {
+		return sendAt, false
+	}
+
+	now := time.Now()
+
+	return sendAt, sendAt.After(now) && !sendAt.After(now.Add(maxScheduleAhead))
+}
+
+// Queues the send for a committed row. When it can't be queued the row is marked failed, so it
+// isn't left pending with nothing to send it.
+func enqueueScheduledMessage(scheduled model.ScheduledMessages, queue *asynq.Client, db *sqlx.DB) error {
+	task, err := tasks.NewSendScheduledMessageTask(scheduled)
+
+	if err == nil {
+		_, err = queue.Enqueue(task, asynq.ProcessAt(scheduled.SendAt), asynq.TaskID(tasks.SendScheduledMessageTaskID(scheduled)))
+	}
+
+	if err != nil {
+		_, failErr := db.Exec("UPDATE scheduled_messages SET failed_at = ?, failure = ? WHERE id = ? AND sent_at IS NULL", time.Now(), "Couldn't be scheduled.", scheduled.ID)
+
+		if failErr != nil {
+			slog.Error("Couldn't mark scheduled message failed 💀",
+				slog.String("error", failErr.Error()),
+				slog.Uint64("sId", scheduled.ID))
+		}
+	}
+
+	return err
+}
+
+// Finds one of the viewer's own scheduled messages in the community from the route, locking it
+// so it can't be sent while it's being changed
+func findScheduledMessage(c *fiber.Ctx, tx *sqlx.Tx, user model.Users, encodedId string) (model.ScheduledMessages, error) {
+	scheduled := model.ScheduledMessages{}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err := tx.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return scheduled, err
+	}
+
+	scheduledId, scheduledOk := security_helpers.Decode(encodedId)
+
+	if scheduledId == 0 || scheduledOk != model.SCHEDULED_MESSAGES_TYPE {
+		slog.Error("Scheduled message security ID failure 💀")
+
+		return scheduled, sql.ErrNoRows
+	}
+
+	sq := `
+	SELECT *
+	FROM scheduled_messages
+	WHERE id = ?
+	AND community_id = ?
+	AND user_id = ?
+	LIMIT 1
+	FOR UPDATE`
+
+	err = tx.Get(&scheduled, sq, scheduledId, community.ID, user.ID)
+
+	if err != nil {
+		slog.Error("No scheduled message found 💀 "+handle,
+			slog.String("error", err.Error()))
+	}
+
+	return scheduled, err
+}
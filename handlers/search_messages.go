@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Messages returned per page of search results
+const searchPageSize = 25
+
+// Longest snippet returned with each result, in characters
+const searchSnippetLength = 160
+
+// Splits a search into words the same way the full-text index does.
+// Anything that isn't a letter or number is dropped, which also strips MySQL's boolean operators.
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Parses a date filter, either RFC3339 or a plain day.
+// A plain day used as the end of a range includes the whole day.
+func parseSearchDate(s string, end bool) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	if end {
+		t = t.Add(24 * time.Hour)
+	}
+
+	return t, true
+}
+
+// Cuts the text down around the first match and marks where each term appears.
+// Highlight offsets are in characters from the start of the snippet.
+func searchSnippet(text string, terms []string) fiber.Map {
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+
+	type highlight struct {
+		start int
+		end   int
+	}
+
+	var hs []highlight
+
+	for i := 0; i < len(lower); i++ {
+		// Only match from the start of a word, the same as a prefix search
+		if i > 0 && (unicode.IsLetter(lower[i-1]) || unicode.IsNumber(lower[i-1])) {
+			continue
+		}
+
+		for _, t := range terms {
+			tr := []rune(t)
+
+			if i+len(tr) <= len(lower) && string(lower[i:i+len(tr)]) == t {
+				end := i + len(tr)
+
+				for end < len(lower) && (unicode.IsLetter(lower[end]) || unicode.IsNumber(lower[end])) {
+					end++
+				}
+
+				hs = append(hs, highlight{start: i, end: end})
+				i = end - 1
+				break
+			}
+		}
+	}
+
+	start := 0
+
+	if len(runes) > searchSnippetLength && len(hs) > 0 {
+		start = max(0, hs[0].start-searchSnippetLength/4)
+	}
+
+	end := min(len(runes), start+searchSnippetLength)
+
+	highlights := []fiber.Map{}
+
+	for _, h := range hs {
+		if h.start >= start && h.end <= end {
+			highlights = append(highlights, fiber.Map{
+				"start": h.start - start,
+				"end":   h.end - start,
+			})
+		}
+	}
+
+	return fiber.Map{
+		"text":       string(runes[start:end]),
+		"truncated":  start > 0 || end < len(runes),
+		"highlights": highlights,
+	}
+}
+
+func SearchMessages(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Starting message search ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	invalidInput := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Invalid input.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	terms := searchTerms(Truncate(c.Query("q"), 255))
+
+	if len(terms) == 0 {
+		slog.Warn("Empty search 💀")
+
+		return invalidInput()
+	}
+
+	beforeId, beforeOk := decodeMessageCursor(c, "before")
+
+	if !beforeOk {
+		slog.Warn("Invalid message cursor 💀")
+
+		return invalidInput()
+	}
+
+	/* Fetch community */
+
+	communityHandle := Truncate(strings.ToLower(c.Params("communityHandle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", communityHandle)
+
+	if err != nil {
+		return notFound(err, "can't find community")
+	}
+
+	_, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !member || !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	/* Work out which channels can be searched */
+
+	channels := []model.Channels{}
+
+	err = db.Select(&channels, "SELECT * FROM channels WHERE community_id = ?", community.ID)
+
+	if err != nil {
+		return notFound(err, "selecting channels")
+	}
+
+	channelHandle := Truncate(strings.ToLower(c.Query("channel")), 255)
+
+	channelsMap := make(map[uint64]model.Channels)
+
+	var channelIds = []uint64{}
+
+	for _, ch := range channels {
+		if len(channelHandle) > 0 && ch.Handle != channelHandle {
+			continue
+		}
+
+		if !channelPermissions.Has(ch.ID, model.ViewChannels) {
+			continue
+		}
+
+		channelsMap[ch.ID] = ch
+		channelIds = append(channelIds, ch.ID)
+	}
+
+	if len(channelIds) == 0 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"messages": []fiber.Map{},
+			"has_more": false,
+		})
+	}
+
+	/* Build the query from the filters */
+
+	matchTerms := make([]string, len(terms))
+
+	for i, t := range terms {
+		matchTerms[i] = "+" + t + "*"
+	}
+
+	q := `
+	SELECT m.*
+	FROM messages m
+	WHERE m.community_id = ?
+	AND m.deleted = 0
+	AND m.channel_id IN (?)
+	AND MATCH (m.text) AGAINST (? IN BOOLEAN MODE)`
+
+	args := []interface{}{community.ID, channelIds, strings.Join(matchTerms, " ")}
+
+	if authorHandle := Truncate(strings.ToLower(c.Query("author")), 255); len(authorHandle) > 0 {
+		var authorId uint64
+
+		err = db.Get(&authorId, "SELECT id FROM users WHERE handle = ? LIMIT 1", authorHandle)
+
+		// Nobody by that handle means nothing matches, not that the search failed
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+				"messages": []fiber.Map{},
+				"has_more": false,
+			})
+		}
+
+		if err != nil {
+			return notFound(err, "can't find author")
+		}
+
+		q += " AND m.user_id = ?"
+		args = append(args, authorId)
+	}
+
+	if from := c.Query("from"); len(from) > 0 {
+		t, ok := parseSearchDate(from, false)
+
+		if !ok {
+			return invalidInput()
+		}
+
+		q += " AND m.created_at >= ?"
+		args = append(args, t)
+	}
+
+	if to := c.Query("to"); len(to) > 0 {
+		t, ok := parseSearchDate(to, true)
+
+		if !ok {
+			return invalidInput()
+		}
+
+		q += " AND m.created_at < ?"
+		args = append(args, t)
+	}
+
+	if v := c.Query("has_attachment"); len(v) > 0 {
+		hasAttachment, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return invalidInput()
+		}
+
+		if hasAttachment {
+			q += " AND EXISTS (SELECT 1 FROM files f WHERE f.message_id = m.id)"
+		} else {
+			q += " AND NOT EXISTS (SELECT 1 FROM files f WHERE f.message_id = m.id)"
+		}
+	}
+
+	if v := c.Query("is_reply"); len(v) > 0 {
+		isReply, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return invalidInput()
+		}
+
+		if isReply {
+			q += " AND m.parent_id > 0"
+		} else {
+			q += " AND m.parent_id = 0"
+		}
+	}
+
+	if beforeId > 0 {
+		q += " AND m.id < ?"
+		args = append(args, beforeId)
+	}
+
+	// Newest first, asking for one extra to know if there's another page
+	q += " ORDER BY m.id DESC LIMIT ?"
+	args = append(args, searchPageSize+1)
+
+	sq, sArgs, err := sqlx.In(q, args...)
+
+	if err != nil {
+		return notFound(err, "building search query")
+	}
+
+	messages := []model.Messages{}
+
+	err = db.Select(&messages, db.Rebind(sq), sArgs...)
+
+	if err != nil {
+		return notFound(err, "searching messages")
+	}
+
+	hasMore := len(messages) > searchPageSize
+
+	if hasMore {
+		messages = messages[:searchPageSize]
+	}
+
+	mm, err := message_helpers.MapMessages(messages, community.ID, channelPermissions.CanView, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		return notFound(err, "mapping messages")
+	}
+
+	for i, m := range messages {
+		maps.Copy(mm[i], fiber.Map{
+			"channel": channelsMap[m.ChannelID].ToFiberMap(),
+			"snippet": searchSnippet(m.Text, terms),
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"messages": mm,
+		"has_more": hasMore,
+	})
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Replies returned per page of a thread
+const threadPageSize = 50
+
+func Thread(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+	slog.Info("Starting fetch thread ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	notFound := func(err error, area string) error {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", area))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	afterId, afterOk := decodeMessageCursor(c, "after")
+
+	if !afterOk {
+		slog.Warn("Invalid message cursor 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Invalid input.",
+			}},
+		})
+	}
+
+	/* Fetch community */
+
+	communityHandle := Truncate(strings.ToLower(c.Params("communityHandle")), 255)
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", communityHandle)
+
+	if err != nil {
+		return notFound(err, "can't find community")
+	}
+
+	/* Fetch parent */
+
+	parentId, parentOk := security_helpers.Decode(c.Params("messageId"))
+
+	if parentId == 0 || parentOk != model.MESSAGES_TYPE {
+		slog.Error("Message security ID failure 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	// Deleted parents are still returned, as a tombstone, so their replies can be read
+	parent := model.Messages{}
+
+	err = db.Get(&parent, "SELECT * FROM messages WHERE id = ? AND community_id = ? LIMIT 1", parentId, community.ID)
+
+	if err != nil {
+		return notFound(err, "can't find parent message")
+	}
+
+	_, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	channelPermissions, ok := CommunityChannelPermissions(user.ID, community.ID, db, wRdb, rRdb, ctx)
+
+	if !member || !ok || !channelPermissions.Has(parent.ChannelID, model.ViewChannels) {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	channel := model.Channels{}
+
+	err = db.Get(&channel, "SELECT * FROM channels WHERE id = ? LIMIT 1", parent.ChannelID)
+
+	if err != nil {
+		return notFound(err, "can't find channel")
+	}
+
+	/* Fetch replies, oldest first */
+
+	rq := `
+	SELECT *
+	FROM messages
+	WHERE parent_id = ?
+	AND channel_id = ?
+	AND deleted = 0
+	AND id > ?
+	ORDER BY id ASC
+	LIMIT ?`
+
+	replies := []model.Messages{}
+
+	err = db.Select(&replies, rq, parent.ID, parent.ChannelID, afterId, threadPageSize+1)
+
+	if err != nil {
+		return notFound(err, "selecting replies")
+	}
+
+	hasMore := len(replies) > threadPageSize
+
+	if hasMore {
+		replies = replies[:threadPageSize]
+	}
+
+	mapped, err := message_helpers.MapMessages(append([]model.Messages{parent}, replies...), community.ID, channelPermissions.CanView, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		return notFound(err, "mapping messages")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+		"channel":  channel.ToFiberMap(),
+		"parent":   mapped[0],
+		"messages": mapped[1:],
+		"has_more": hasMore,
+		"topic":    message_helpers.ThreadTopic(parent),
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -31,16 +33,358 @@ func Truncate(s string, max int) string {
 	return string([]rune(s)[:max])
 }
 
+// Whether the user can see the channel group
 func HasGroupPermission(uId uint64, gId uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) bool {
-	return true
+
+	var communityId uint64
+
+	err := db.Get(&communityId, "SELECT community_id FROM channel_groups WHERE id = ? LIMIT 1", gId)
+
+	if err != nil {
+		slog.Warn("Does not have group permission 💀",
+			slog.Uint64("uId", uId),
+			slog.Uint64("gId", gId),
+			slog.String("error", err.Error()))
+
+		return false
+	}
+
+	cp, ok := CommunityChannelPermissions(uId, communityId, db, wRdb, rRdb, ctx)
+
+	if !ok {
+		return false
+	}
+
+	return cp.Groups[gId].Has(model.ViewChannels)
 }
 
+// Whether the user has the permission in the channel, once the channel's and its group's
+// overwrites are applied. Nothing is allowed in a channel the user can't see.
 func HasChannelPermission(uId uint64, cId uint64, permission model.Permission, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) bool {
-	return true
+
+	var communityId uint64
+
+	err := db.Get(&communityId, "SELECT community_id FROM channels WHERE id = ? LIMIT 1", cId)
+
+	if err != nil {
+		slog.Warn("Does not have channel permission 💀",
+			slog.Uint64("uId", uId),
+			slog.Uint64("cId", cId),
+			slog.String("error", err.Error()))
+
+		return false
+	}
+
+	cp, ok := CommunityChannelPermissions(uId, communityId, db, wRdb, rRdb, ctx)
+
+	if !ok {
+		return false
+	}
+
+	return cp.Has(cId, permission)
+}
+
+// A user's effective permissions in each channel and channel group of a community
+type ChannelPermissionSet struct {
+	Channels map[uint64]model.Permissions
+	Groups   map[uint64]model.Permissions
+}
+
+func (s ChannelPermissionSet) Has(channelId uint64, permission model.Permission) bool {
+	p := s.Channels[channelId]
+
+	return p.Has(model.ViewChannels) && p.Has(permission)
+}
+
+// Matches message_helpers.ChannelFilter, so mentions of channels the user can't see are dropped
+func (s ChannelPermissionSet) CanView(channel model.Channels) bool {
+	return s.Has(channel.ID, model.ViewChannels)
+}
+
+// The user's permissions in every channel and channel group of the community. Members start from
+// their community permissions, everyone else from the community's defaults. Members' sets are
+// cached in redis until their roles or the community's overwrites change.
+func CommunityChannelPermissions(uId uint64, cId uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) (ChannelPermissionSet, bool) {
+
+	cp := ChannelPermissionSet{
+		Channels: make(map[uint64]model.Permissions),
+		Groups:   make(map[uint64]model.Permissions),
+	}
+
+	cU, member := communityMember(uId, cId, db, wRdb, rRdb, ctx)
+
+	rk := model.ChannelPermissionsRedisKey(uId, cId)
+
+	if member {
+		cached, err := rRdb.HGetAll(ctx, rk).Result()
+
+		if err != nil {
+			slog.Error("Redis problem 💀",
+				slog.String("error", err.Error()),
+				slog.Uint64("uId", uId),
+				slog.Uint64("cId", cId),
+				slog.String("area", "selecting channel permissions from Redis"))
+		} else if len(cached) > 0 {
+			for field, v := range cached {
+				kind, rawId, _ := strings.Cut(field, "-")
+
+				id, err := strconv.ParseUint(rawId, 10, 64)
+
+				if err != nil {
+					continue
+				}
+
+				bits, err := strconv.ParseUint(v, 10, 32)
+
+				if err != nil {
+					continue
+				}
+
+				if kind == "c" {
+					cp.Channels[id] = model.PermissionsFromBits(uint32(bits))
+				} else if kind == "g" {
+					cp.Groups[id] = model.PermissionsFromBits(uint32(bits))
+				}
+			}
+
+			return cp, true
+		}
+	}
+
+	community := model.Communities{}
+
+	err := db.Get(&community, "SELECT * FROM communities WHERE id = ? LIMIT 1", cId)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("uId", uId),
+			slog.Uint64("cId", cId),
+			slog.String("area", "selecting community for channel permissions"))
+
+		return cp, false
+	}
+
+	base := community.Permissions
+
+	if member {
+		base = cU.Permissions
+	}
+
+	channels := []model.Channels{}
+
+	err = db.Select(&channels, "SELECT * FROM channels WHERE community_id = ?", cId)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("cId", cId),
+			slog.String("area", "selecting channels for channel permissions"))
+
+		return cp, false
+	}
+
+	var groupIds []uint64
+
+	err = db.Select(&groupIds, "SELECT id FROM channel_groups WHERE community_id = ?", cId)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("cId", cId),
+			slog.String("area", "selecting groups for channel permissions"))
+
+		return cp, false
+	}
+
+	// The owner and anyone who can manage the community can't be locked out of a channel
+	bypass := uId == community.OwnerID || base.ManageCommunity
+
+	overwrites := []model.PermissionOverwrites{}
+	roleIds := make(map[uint64]bool)
+
+	if !bypass {
+		err = db.Select(&overwrites, "SELECT * FROM permission_overwrites WHERE community_id = ?", cId)
+
+		if err != nil {
+			slog.Error("Database problem 💀",
+				slog.String("error", err.Error()),
+				slog.Uint64("cId", cId),
+				slog.String("area", "selecting permission overwrites"))
+
+			return cp, false
+		}
+
+		if member && len(overwrites) > 0 {
+			var ids []uint64
+
+			err = db.Select(&ids, "SELECT community_role_id FROM community_roles_users WHERE community_id = ? AND user_id = ?", cId, uId)
+
+			if err != nil {
+				slog.Error("Database problem 💀",
+					slog.String("error", err.Error()),
+					slog.Uint64("uId", uId),
+					slog.Uint64("cId", cId),
+					slog.String("area", "selecting roles for channel permissions"))
+
+				return cp, false
+			}
+
+			for _, id := range ids {
+				roleIds[id] = true
+			}
+		}
+	}
+
+	groupOverwrites := make(map[uint64][]model.PermissionOverwrites)
+	channelOverwrites := make(map[uint64][]model.PermissionOverwrites)
+
+	for _, o := range overwrites {
+		if o.GroupID > 0 {
+			groupOverwrites[o.GroupID] = append(groupOverwrites[o.GroupID], o)
+		} else {
+			channelOverwrites[o.ChannelID] = append(channelOverwrites[o.ChannelID], o)
+		}
+	}
+
+	groupBits := make(map[uint64]uint32)
+
+	for _, id := range groupIds {
+		groupBits[id] = model.ApplyOverwrites(base.Bits(), groupOverwrites[id], uId, roleIds)
+		cp.Groups[id] = model.PermissionsFromBits(groupBits[id])
+	}
+
+	// A channel in a group starts from the group's permissions
+	for _, ch := range channels {
+		bits := base.Bits()
+
+		if gb, found := groupBits[ch.GroupID]; found {
+			bits = gb
+		}
+
+		if !bypass {
+			bits = model.ChannelOverwriteBits(bits, ch, channelOverwrites[ch.ID], uId, roleIds)
+		}
+
+		cp.Channels[ch.ID] = model.PermissionsFromBits(bits)
+	}
+
+	if member {
+		// Always at least one field, so a community without channels is cached too
+		fields := map[string]interface{}{"c-0": 0}
+
+		for id, p := range cp.Channels {
+			fields[fmt.Sprintf("c-%d", id)] = p.Bits()
+		}
+
+		for id, p := range cp.Groups {
+			fields[fmt.Sprintf("g-%d", id)] = p.Bits()
+		}
+
+		go func() {
+			pipe := wRdb.TxPipeline()
+			pipe.HSet(ctx, rk, fields)
+			pipe.Expire(ctx, rk, 1*time.Hour)
+
+			_, err := pipe.Exec(ctx)
+
+			if err != nil {
+				slog.Warn("Redis error setting channel permissions 💀",
+					slog.Uint64("uId", uId),
+					slog.Uint64("cId", cId),
+					slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	return cp, true
+}
+
+// The user's channel permissions in each community they're a member of, keyed by community id,
+// and every channel they can see across them. Lists spanning communities filter on the channels
+// in their queries, so pages come back full.
+func MemberChannelPermissions(uId uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) (map[uint64]ChannelPermissionSet, []uint64, error) {
+
+	permissions := make(map[uint64]ChannelPermissionSet)
+
+	var channelIds = []uint64{}
+
+	var communityIds []uint64
+
+	err := db.Select(&communityIds, "SELECT community_id FROM communities_users WHERE user_id = ?", uId)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, cId := range communityIds {
+		cp, ok := CommunityChannelPermissions(uId, cId, db, wRdb, rRdb, ctx)
+
+		if !ok {
+			continue
+		}
+
+		permissions[cId] = cp
+
+		for chId := range cp.Channels {
+			if cp.Has(chId, model.ViewChannels) {
+				channelIds = append(channelIds, chId)
+			}
+		}
+	}
+
+	return permissions, channelIds, nil
+}
+
+// Drops every member's cached channel permissions in the community, after its overwrites,
+// channels or groups change
+func ClearChannelPermissions(cId uint64, db *sqlx.DB, wRdb *redis.Client, ctx context.Context) error {
+
+	var userIds []uint64
+
+	err := db.Select(&userIds, "SELECT user_id FROM communities_users WHERE community_id = ?", cId)
+
+	if err != nil {
+		return err
+	}
+
+	pipe := wRdb.Pipeline()
+
+	for _, uId := range userIds {
+		pipe.Del(ctx, model.ChannelPermissionsRedisKey(uId, cId))
+	}
+
+	_, err = pipe.Exec(ctx)
+
+	return err
 }
 
 func HasCommunityPermission(uId uint64, cId uint64, permission model.Permission, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) bool {
 
+	cU, ok := communityMember(uId, cId, db, wRdb, rRdb, ctx)
+
+	if !ok {
+		return false
+	}
+
+	return cU.HasCommunityPermission(permission)
+}
+
+// Time left on the member's timeout in the community, 0 when they can send
+func CommunityTimeout(uId uint64, cId uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) time.Duration {
+
+	cU, ok := communityMember(uId, cId, db, wRdb, rRdb, ctx)
+
+	if !ok {
+		return 0
+	}
+
+	return cU.TimeoutRemaining()
+}
+
+// The member's row in the community, cached in redis with their permissions
+func communityMember(uId uint64, cId uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) (model.CommunitiesUsers, bool) {
+
 	rk := model.PermissionRedisKey(uId, cId)
 
 	rp, err := rRdb.Get(ctx, rk).Result()
@@ -61,7 +405,7 @@ func HasCommunityPermission(uId uint64, cId uint64, permission model.Permission,
 				slog.Uint64("cId", cId),
 				slog.String("error", err.Error()))
 
-			return false
+			return cU, false
 		}
 
 		mCu, err := json.Marshal(cU)
@@ -72,7 +416,7 @@ func HasCommunityPermission(uId uint64, cId uint64, permission model.Permission,
 				slog.Uint64("cId", cId),
 				slog.String("error", err.Error()))
 
-			return false
+			return cU, false
 		}
 
 		go func() {
@@ -86,7 +430,7 @@ func HasCommunityPermission(uId uint64, cId uint64, permission model.Permission,
 			}
 		}()
 
-		return cU.HasCommunityPermission(permission)
+		return cU, true
 
 	} else if err != nil {
 		slog.Error("Redis problem 💀",
@@ -95,7 +439,7 @@ func HasCommunityPermission(uId uint64, cId uint64, permission model.Permission,
 			slog.Uint64("cId", cId),
 			slog.String("area", "selecting permissions from Redis"))
 
-		return false
+		return model.CommunitiesUsers{}, false
 	} else {
 
 		cU := model.CommunitiesUsers{}
@@ -108,10 +452,10 @@ func HasCommunityPermission(uId uint64, cId uint64, permission model.Permission,
 				slog.Uint64("cId", cId),
 				slog.String("error", err.Error()))
 
-			return false
+			return cU, false
 		}
 
-		return cU.HasCommunityPermission(permission)
+		return cU, true
 	}
 }
 
@@ -125,6 +469,7 @@ func ServerOwnerPermissions() model.Permissions {
 		BanMembers:      true,
 		SendMessages:    true,
 		AttachMedia:     true,
+		MentionRoles:    true,
 	}
 }
 
@@ -210,6 +555,10 @@ func RecalculateAndUpdatePermissionsForUsers(userIds []uint64, community model.C
 				if role.AttachMedia {
 					permissions.AttachMedia = true
 				}
+
+				if role.MentionRoles {
+					permissions.MentionRoles = true
+				}
 			}
 		}
 
@@ -221,20 +570,19 @@ func RecalculateAndUpdatePermissionsForUsers(userIds []uint64, community model.C
 			       kick_members = ?,
 			       ban_members = ?,
 			       send_messages = ?,
-			       attach_media = ?
+			       attach_media = ?,
+			       mention_roles = ?
 		       WHERE user_id = ?
 		       AND community_id = ?`
 
 		_, err = tx.Exec(up, permissions.ViewChannels, permissions.ManageChannels, permissions.ManageCommunity, permissions.CreateInvite,
-			permissions.KickMembers, permissions.BanMembers, permissions.SendMessages, permissions.AttachMedia, uid, community.ID)
+			permissions.KickMembers, permissions.BanMembers, permissions.SendMessages, permissions.AttachMedia, permissions.MentionRoles, uid, community.ID)
 
 		if err != nil {
 			return err
 		}
 
-		rk := model.PermissionRedisKey(uid, community.ID)
-
-		_, err = wRdb.Del(ctx, rk).Result()
+		_, err = wRdb.Del(ctx, model.PermissionRedisKey(uid, community.ID), model.ChannelPermissionsRedisKey(uid, community.ID)).Result()
 
 		if err != nil {
 			return err
@@ -337,6 +685,10 @@ func RecalculateAndUpdatePermissionsForUser(uId uint64, community model.Communit
 			if role.AttachMedia {
 				permissions.AttachMedia = true
 			}
+
+			if role.MentionRoles {
+				permissions.MentionRoles = true
+			}
 		}
 	}
 
@@ -349,16 +701,15 @@ func RecalculateAndUpdatePermissionsForUser(uId uint64, community model.Communit
 		kick_members = ?,
 		ban_members = ?,
 		send_messages = ?,
-		attach_media = ?
+		attach_media = ?,
+		mention_roles = ?
 	WHERE user_id = ?
 	AND community_id = ?`
 
 	tx.Exec(up, permissions.ViewChannels, permissions.ManageChannels, permissions.ManageCommunity, permissions.CreateInvite,
-		permissions.KickMembers, permissions.BanMembers, permissions.SendMessages, permissions.AttachMedia, uId, community.ID)
-
-	rk := model.PermissionRedisKey(uId, community.ID)
+		permissions.KickMembers, permissions.BanMembers, permissions.SendMessages, permissions.AttachMedia, permissions.MentionRoles, uId, community.ID)
 
-	wRdb.Del(ctx, rk)
+	wRdb.Del(ctx, model.PermissionRedisKey(uId, community.ID), model.ChannelPermissionsRedisKey(uId, community.ID))
 
 	return permissions
 }
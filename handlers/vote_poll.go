@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+type VotePollInput struct {
+	MessageID string   `json:"message_id" validate:"required,gte=3,lte=255"`
+	OptionIDs []string `json:"option_ids" validate:"max=10,dive,required,gte=3,lte=255"`
+}
+
+// Replaces the viewer's votes on a poll with the given options, no options takes their vote back
+func VotePoll(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, queue *asynq.Client) error {
+
+	slog.Info("Voting on poll ✅")
+
+	user, ok := c.Locals("viewer").(model.Users)
+
+	if !ok {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	input := new(VotePollInput)
+
+	if err := c.BodyParser(input); err != nil {
+		slog.Warn("Invalid input 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	validate := validator.New()
+	en := en.New()
+	uni := ut.New(en, en)
+	trans, _ := uni.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	err := validate.Struct(input)
+
+	var errors []fiber.Map
+
+	if err != nil {
+		slog.Error("Unable to vote, input 💀",
+			slog.String("error", err.Error()))
+
+		errs := err.(validator.ValidationErrors)
+
+		for _, v := range errs {
+			errors = append(errors, fiber.Map{
+				"field":   v.Field(),
+				"message": v.Translate(trans),
+			})
+		}
+	}
+
+	if len(errors) > 0 {
+		slog.Error("Unable to vote, input error 💀")
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": errors,
+		})
+	}
+
+	notFound := func() error {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not found",
+			}},
+		})
+	}
+
+	handle := Truncate(strings.ToLower(c.Params("handle")), 255)
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE handle = ? LIMIT 1", handle)
+
+	if err != nil {
+		slog.Error("No community found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	notAllowed := func() error {
+		slog.Warn("Not allowed")
+
+		return c.Status(fiber.StatusUnauthorized).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Not allowed.",
+			}},
+		})
+	}
+
+	if _, member := communityMember(user.ID, community.ID, db, wRdb, rRdb, ctx); !member {
+		return notAllowed()
+	}
+
+	if remaining := CommunityTimeout(user.ID, community.ID, db, wRdb, rRdb, ctx); remaining > 0 {
+		return timedOutError(c, remaining)
+	}
+
+	messageId, messageOk := security_helpers.Decode(input.MessageID)
+
+	if messageId == 0 || messageOk != model.MESSAGES_TYPE {
+		slog.Error("No message found 💀 " + handle)
+
+		return notFound()
+	}
+
+	message := model.Messages{}
+
+	err = db.Get(&message, "SELECT * FROM messages WHERE id = ? AND community_id = ? AND deleted = 0", messageId, community.ID)
+
+	if err != nil {
+		slog.Error("No message found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	if !HasChannelPermission(user.ID, message.ChannelID, model.SendMessages, db, wRdb, rRdb, ctx) {
+		return notAllowed()
+	}
+
+	poll := model.Polls{}
+
+	err = db.Get(&poll, "SELECT * FROM polls WHERE message_id = ? LIMIT 1", message.ID)
+
+	if err != nil {
+		slog.Error("No poll found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	if poll.IsClosed() {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Poll closed.",
+			}},
+		})
+	}
+
+	options := []model.PollsOptions{}
+
+	err = db.Select(&options, "SELECT * FROM polls_options WHERE poll_id = ?", poll.ID)
+
+	if err != nil {
+		slog.Error("No poll options found 💀 "+handle,
+			slog.String("error", err.Error()))
+
+		return notFound()
+	}
+
+	optionsMap := make(map[uint64]model.PollsOptions)
+
+	for _, o := range options {
+		optionsMap[o.ID] = o
+	}
+
+	var optionIds = []uint64{}
+
+	seen := make(map[uint64]bool)
+
+	for _, encoded := range input.OptionIDs {
+		optionId, optionOk := security_helpers.Decode(encoded)
+
+		if _, found := optionsMap[optionId]; !found || optionOk != model.POLLS_OPTIONS_TYPE {
+			slog.Error("Poll option security ID failure 💀")
+
+			return notFound()
+		}
+
+		if seen[optionId] {
+			continue
+		}
+
+		seen[optionId] = true
+
+		optionIds = append(optionIds, optionId)
+	}
+
+	if !poll.MultipleChoice && len(optionIds) > 1 {
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Only one option can be picked.",
+			}},
+		})
+	}
+
+	handleCantVoteError := func(err error) error {
+		slog.Error("Unable to vote 💀",
+			slog.String("error", err.Error()))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Unable to vote.",
+			}},
+		})
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return handleCantVoteError(err)
+	}
+
+	handleTxError := func(err error) error {
+		tx.Rollback()
+
+		return handleCantVoteError(err)
+	}
+
+	_, err = tx.Exec("DELETE FROM polls_votes WHERE poll_id = ? AND user_id = ?", poll.ID, user.ID)
+
+	if err != nil {
+		return handleTxError(err)
+	}
+
+	createdAt := time.Now()
+
+	for _, optionId := range optionIds {
+		_, err = tx.Exec("INSERT INTO polls_votes (created_at, poll_id, option_id, user_id) VALUES (?, ?, ?, ?)", createdAt, poll.ID, optionId, user.ID)
+
+		if err != nil {
+			return handleTxError(err)
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return handleCantVoteError(err)
+	}
+
+	go message_helpers.BroadcastPoll(poll, "poll.updated", db)
+
+	polls, err := message_helpers.MapPolls([]uint64{message.ID}, db)
+
+	if err != nil {
+		return handleCantVoteError(err)
+	}
+
+	mapped := []fiber.Map{{"poll": polls[message.ID]}}
+
+	err = message_helpers.MarkPollVotes(user.ID, []model.Messages{message}, mapped, db)
+
+	if err != nil {
+		return handleCantVoteError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(mapped[0]["poll"])
+}
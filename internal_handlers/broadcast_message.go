@@ -2,6 +2,8 @@ package internal_handlers
 
 import (
 	"context"
+	"encoding/json"
+	"os"
 
 	"github.com/go-playground/locales/en"
 	ut "github.com/go-playground/universal-translator"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/hibiken/asynq"
+	"github.com/imroc/req/v3"
 	"github.com/jmoiron/sqlx"
 	"github.com/redis/go-redis/v9"
 )
@@ -22,6 +25,36 @@ type BroadcastMessageInput struct {
 	Topic   string `json:"topic"`
 }
 
+// Asks the ws api to send an event to every client subscribed to the topic.
+// Run it in a goroutine, the caller shouldn't wait on the ws api.
+func SendBroadcast(topic string, event any) {
+	marshalled, err := json.Marshal(event)
+
+	if err != nil {
+		slog.Error("💀 Couldn't marshal message",
+			slog.String("error", err.Error()))
+
+		return
+	}
+
+	_, err = req.C().R().
+		SetContentType("application/json").
+		SetBody(&BroadcastMessageInput{
+			Topic:   topic,
+			Message: string(marshalled),
+		}).
+		Post(os.Getenv("PRIVATE_WS_INTERNAL_API") + "/broadcast-message")
+
+	if err != nil {
+		slog.Error("💀 Couldn't broadcast message",
+			slog.String("error", err.Error()))
+
+		return
+	}
+
+	slog.Info("✅ Broadcasted message event")
+}
+
 func BroadcastMessage(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, rdb *redis.Client, queue *asynq.Client, server *chatserver.Server) error {
 	slog.Info("Broadcasting message ✅")
 
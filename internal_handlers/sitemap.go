@@ -71,9 +71,64 @@ func Sitemap(c *fiber.Ctx, ctx context.Context, db *sqlx.DB, wRdb *redis.Client,
 		})
 	}
 
+	overwritesQuery, overwritesArgs, err := sqlx.In("SELECT * FROM permission_overwrites WHERE community_id IN (?) AND target_type = ?", communitiesIds, model.OVERWRITE_EVERYONE)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "creating the query for permission overwrites"))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Sitemap error",
+			}},
+		})
+	}
+
+	overwrites := []model.PermissionOverwrites{}
+
+	err = db.Select(&overwrites, db.Rebind(overwritesQuery), overwritesArgs...)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "after the bind to permission overwrites query"))
+
+		return c.Status(fiber.StatusOK).JSON(&fiber.Map{
+			"errors": []fiber.Map{{
+				"message": "Sitemap error",
+			}},
+		})
+	}
+
+	groupOverwrites := make(map[uint64][]model.PermissionOverwrites)
+	channelOverwrites := make(map[uint64][]model.PermissionOverwrites)
+
+	for _, o := range overwrites {
+		if o.GroupID > 0 {
+			groupOverwrites[o.GroupID] = append(groupOverwrites[o.GroupID], o)
+		} else {
+			channelOverwrites[o.ChannelID] = append(channelOverwrites[o.ChannelID], o)
+		}
+	}
+
+	communityPermissions := make(map[uint64]uint32)
+
+	for _, community := range communities {
+		communityPermissions[community.ID] = community.Permissions.Bits()
+	}
+
 	channelsMap := make(map[uint64][]model.Channels)
 
 	for _, channel := range channels {
+		// Only channels a signed out visitor could open, private ones never are
+		bits := model.ApplyOverwrites(communityPermissions[channel.CommunityID], groupOverwrites[channel.GroupID], 0, nil)
+		bits = model.ChannelOverwriteBits(bits, channel, channelOverwrites[channel.ID], 0, nil)
+
+		if bits&model.ViewChannels.Bit() == 0 {
+			continue
+		}
+
 		list, ok := channelsMap[channel.CommunityID]
 
 		if ok {
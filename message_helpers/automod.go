@@ -0,0 +1,237 @@
+package message_helpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Rules are read on every send, so they're cached until the next time they're edited
+const automodRulesCacheTTL = 1 * time.Hour
+
+// Caps rules leave short messages like "OK" or "LOL" alone
+const automodCapsMinLetters = 10
+
+// A domain with the scheme in front of it and the start of a path after it, when there is one
+var linkPattern = regexp.MustCompile(`(?i)(https?://)?\b((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})\b(/)?`)
+
+func AutomodRulesKey(communityId uint64) string {
+	return fmt.Sprintf("community-%d-automod-rules", communityId)
+}
+
+// The community's enabled rules, from redis when they're cached
+func LoadAutomodRules(communityId uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) ([]model.AutomodRules, error) {
+
+	rules := []model.AutomodRules{}
+
+	val, err := rRdb.Get(ctx, AutomodRulesKey(communityId)).Result()
+
+	if err == nil && json.Unmarshal([]byte(val), &rules) == nil {
+		return rules, nil
+	}
+
+	err = db.Select(&rules, "SELECT * FROM automod_rules WHERE community_id = ? AND enabled = 1 ORDER BY id ASC", communityId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := json.Marshal(rules)
+
+	if err == nil {
+		err = wRdb.Set(ctx, AutomodRulesKey(communityId), p, automodRulesCacheTTL).Err()
+	}
+
+	if err != nil {
+		slog.Error("Couldn't cache automod rules 💀",
+			slog.String("error", err.Error()))
+	}
+
+	return rules, nil
+}
+
+func InvalidateAutomodRules(communityId uint64, wRdb *redis.Client, ctx context.Context) {
+	wRdb.Del(ctx, AutomodRulesKey(communityId))
+}
+
+// The hosts linked to in the text, lowercased. A link needs a scheme, www or a path,
+// so "ok.so" typed without a space isn't taken for one but discord.gg/invite is.
+func LinkHosts(text string) []string {
+	hosts := []string{}
+
+	for _, m := range linkPattern.FindAllStringSubmatch(text, -1) {
+		host := strings.ToLower(m[2])
+
+		if len(m[1]) > 0 || len(m[3]) > 0 || strings.HasPrefix(host, "www.") {
+			hosts = append(hosts, strings.TrimPrefix(host, "www."))
+		}
+	}
+
+	return hosts
+}
+
+// A host matches a listed domain when it is the domain or one of its subdomains
+func hostListed(host string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "www.")
+
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Counts the different @ mentions written in the text, whether or not they resolve
+func CountMentions(text string) int {
+	seen := make(map[string]bool)
+
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if m[2] == "@" {
+			seen[strings.ToLower(m[3])] = true
+		}
+	}
+
+	return len(seen)
+}
+
+// Percentage of the letters in the text that are capitals, 0 when there are too few to judge
+func capsPercentage(text string) uint32 {
+	var letters, upper uint32
+
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+
+		letters++
+
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+
+	if letters < automodCapsMinLetters {
+		return 0
+	}
+
+	return upper * 100 / letters
+}
+
+// Keywords match whole words without caring about case
+func KeywordPattern(keyword string) (*regexp.Regexp, error) {
+	return regexp.Compile(`(?i)(^|\W)` + regexp.QuoteMeta(strings.TrimSpace(keyword)) + `($|\W)`)
+}
+
+// Whether the text breaks the rule
+func AutomodRuleMatches(rule model.AutomodRules, text string) bool {
+	switch rule.Kind {
+	case model.AUTOMOD_KEYWORD:
+		for _, p := range rule.PatternList() {
+			if re, err := KeywordPattern(p); err == nil && re.MatchString(text) {
+				return true
+			}
+		}
+	case model.AUTOMOD_REGEX:
+		for _, p := range rule.PatternList() {
+			if re, err := regexp.Compile(p); err == nil && re.MatchString(text) {
+				return true
+			}
+		}
+	case model.AUTOMOD_LINK_ALLOW:
+		for _, host := range LinkHosts(text) {
+			if !hostListed(host, rule.PatternList()) {
+				return true
+			}
+		}
+	case model.AUTOMOD_LINK_DENY:
+		for _, host := range LinkHosts(text) {
+			if hostListed(host, rule.PatternList()) {
+				return true
+			}
+		}
+	case model.AUTOMOD_MASS_MENTION:
+		return rule.Threshold > 0 && uint32(CountMentions(text)) >= rule.Threshold
+	case model.AUTOMOD_CAPS:
+		return rule.Threshold > 0 && capsPercentage(text) >= rule.Threshold
+	}
+
+	return false
+}
+
+var automodActionWeight = map[string]int{
+	model.AUTOMOD_FLAG:    1,
+	model.AUTOMOD_BLOCK:   2,
+	model.AUTOMOD_TIMEOUT: 3,
+}
+
+// Checks the text against every rule. Returns the rule with the harshest action that
+// matched, and every flag rule that matched so they can be recorded if the send goes through.
+func EvaluateAutomod(rules []model.AutomodRules, text string) (*model.AutomodRules, []model.AutomodRules) {
+
+	var strongest *model.AutomodRules = nil
+
+	flagged := []model.AutomodRules{}
+
+	for i, rule := range rules {
+		if !rule.Enabled || !AutomodRuleMatches(rule, text) {
+			continue
+		}
+
+		if rule.Action == model.AUTOMOD_FLAG {
+			flagged = append(flagged, rule)
+		}
+
+		if strongest == nil || automodActionWeight[rule.Action] > automodActionWeight[strongest.Action] {
+			strongest = &rules[i]
+		}
+	}
+
+	return strongest, flagged
+}
+
+// Records the flagged rules against a message that was let through
+func SaveAutomodFlags(message model.Messages, rules []model.AutomodRules, db *sqlx.DB) {
+
+	for _, rule := range rules {
+		fq := `
+		INSERT INTO automod_flags
+		(created_at, object_salt, community_id, channel_id, message_id, user_id, rule_id, text)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+		_, err := db.Exec(fq, time.Now(), uuid.New().String(), message.CommunityID, message.ChannelID, message.ID, message.UserID, rule.ID, message.Text)
+
+		if err != nil {
+			slog.Error("Couldn't save automod flag 💀",
+				slog.String("error", err.Error()),
+				slog.Uint64("mId", message.ID))
+		}
+	}
+}
+
+// Times the member out of sending in the community. Their cached permissions are dropped
+// so the timeout is seen on their next send.
+func TimeoutMember(userId uint64, communityId uint64, duration time.Duration, db *sqlx.DB, wRdb *redis.Client, ctx context.Context) (time.Time, error) {
+	until := time.Now().Add(duration).Truncate(time.Second)
+
+	_, err := db.Exec("UPDATE communities_users SET timed_out_until = ? WHERE user_id = ? AND community_id = ?", until, userId, communityId)
+
+	if err != nil {
+		return until, err
+	}
+
+	wRdb.Del(ctx, model.PermissionRedisKey(userId, communityId))
+
+	return until, nil
+}
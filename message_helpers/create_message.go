@@ -0,0 +1,76 @@
+package message_helpers
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+// Inserts a new message and its mentions in the transaction, and reads the channel up to it for the
+// author. Returns the message with its id and seq and the users it pinged, so they can be told once
+// the transaction commits.
+func InsertMessage(tx *sqlx.Tx, message model.Messages, canMentionRoles bool, canViewChannel ChannelFilter, db *sqlx.DB) (model.Messages, []uint64, error) {
+
+	seq, err := NextChannelSeq(tx, message.ChannelID)
+
+	if err != nil {
+		return message, nil, err
+	}
+
+	message.Seq = seq
+
+	iq := `
+	INSERT INTO messages
+	(created_at, object_salt, community_id, channel_id, user_id, text, parent_id, seq)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(iq, message.CreatedAt, message.Salt, message.CommunityID, message.ChannelID, message.UserID, message.Text, message.ParentID, message.Seq)
+
+	if err != nil {
+		return message, nil, err
+	}
+
+	err = tx.Get(&message.ID, "SELECT LAST_INSERT_ID()")
+
+	if err != nil {
+		return message, nil, err
+	}
+
+	// The author has seen their own message, so it never counts as unread for them
+	_, err = tx.Exec(upsertReadMarkerQuery, message.UserID, message.ChannelID, message.CommunityID, message.ID, message.Seq, message.CreatedAt.Truncate(time.Second), time.Now())
+
+	if err != nil {
+		return message, nil, err
+	}
+
+	mentions, err := ResolveMentions(message.Text, message.CommunityID, canMentionRoles, canViewChannel, db)
+
+	if err != nil {
+		return message, nil, err
+	}
+
+	mentionedUserIds, err := SaveMentions(tx, message, mentions)
+
+	if err != nil {
+		return message, nil, err
+	}
+
+	return message, mentionedUserIds, nil
+}
+
+// Sends a new message to its channel, to its thread when it's a reply, and to everyone it mentions
+func BroadcastNewMessage(message model.Messages, mappedMessage fiber.Map, channel model.Channels, parent model.Messages, mentionedUserIds []uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) {
+	internal_handlers.SendBroadcast(security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt), mappedMessage)
+
+	if message.ParentID > 0 {
+		BroadcastThreadReply(parent, channel, mappedMessage, db)
+	}
+
+	BroadcastMentions(mentionedUserIds, message, db, wRdb, rRdb, ctx)
+}
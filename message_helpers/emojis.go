@@ -0,0 +1,66 @@
+package message_helpers
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+)
+
+// Custom emoji are written as :name:
+var emojiPattern = regexp.MustCompile(`:([a-z0-9_]{2,32}):`)
+
+// Emoji names are lowercase letters, numbers and underscores
+var EmojiNamePattern = regexp.MustCompile(`^[a-z0-9_]{2,32}$`)
+
+// The custom emoji names written in the text, without their colons
+func EmojiNames(text string) []string {
+	var names = []string{}
+
+	for _, m := range emojiPattern.FindAllStringSubmatch(text, -1) {
+		names = append(names, m[1])
+	}
+
+	return names
+}
+
+// The name of the custom emoji a reaction is, if it's one at all
+func ReactionEmojiName(reaction string) (string, bool) {
+	if !strings.HasPrefix(reaction, ":") || !strings.HasSuffix(reaction, ":") || len(reaction) < 2 {
+		return "", false
+	}
+
+	name := reaction[1 : len(reaction)-1]
+
+	return name, EmojiNamePattern.MatchString(name)
+}
+
+// Looks up which of the names are in the community's emoji set, keyed by name
+func LoadEmojis(names []string, communityId uint64, db *sqlx.DB) (map[string]model.CommunityEmojis, error) {
+	emojisMap := make(map[string]model.CommunityEmojis)
+
+	if len(names) == 0 {
+		return emojisMap, nil
+	}
+
+	q, args, err := sqlx.In("SELECT * FROM community_emojis WHERE community_id = ? AND name IN (?)", communityId, names)
+
+	if err != nil {
+		return nil, err
+	}
+
+	emojis := []model.CommunityEmojis{}
+
+	err = db.Select(&emojis, db.Rebind(q), args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range emojis {
+		emojisMap[e.Name] = e
+	}
+
+	return emojisMap, nil
+}
@@ -0,0 +1,98 @@
+package message_helpers
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"golang.org/x/exp/slog"
+)
+
+// Removes files from Cloudflare once their rows are gone or were never saved. Failures are only
+// logged, with enough to clean them up by hand.
+func DeleteStoredFiles(ctx context.Context, files []model.Files) (int, int) {
+
+	if len(files) == 0 {
+		return 0, 0
+	}
+
+	deleted := 0
+	failed := 0
+
+	accountId := os.Getenv("CLOUDFLARE_ACCOUNT_IDENTIFIER")
+
+	cf, cfErr := cloudflare.New(os.Getenv("CLOUDFLARE_API_KEY"), os.Getenv("CLOUDFLARE_API_EMAIL"))
+
+	r2Resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		return aws.Endpoint{
+			URL:               fmt.Sprintf("https://%s.r2.cloudflarestorage.com", accountId),
+			HostnameImmutable: true,
+			Source:            aws.EndpointSourceCustom,
+		}, nil
+	})
+
+	cfg, r2Err := config.LoadDefaultConfig(ctx,
+		config.WithEndpointResolverWithOptions(r2Resolver),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(os.Getenv("CLOUDFLARE_R2_KEY_ID"), os.Getenv("CLOUDFLARE_R2_ACCESS_SECRET"), "")),
+		config.WithRegion("auto"),
+	)
+
+	var r2 *s3.Client
+
+	if r2Err == nil {
+		r2 = s3.NewFromConfig(cfg)
+	}
+
+	for _, f := range files {
+		var err error
+
+		switch {
+		case f.CFImagesID.Valid:
+			err = cfErr
+
+			if err == nil {
+				err = cf.DeleteImage(ctx, cloudflare.AccountIdentifier(accountId), f.CFImagesID.String)
+			}
+		case f.CFVideoStreamUID.Valid:
+			err = cfErr
+
+			if err == nil {
+				err = cf.StreamDeleteVideo(ctx, cloudflare.StreamParameters{AccountID: accountId, VideoID: f.CFVideoStreamUID.String})
+			}
+		case f.CFF2ID.Valid:
+			err = r2Err
+
+			if err == nil {
+				_, err = r2.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket: aws.String(os.Getenv("CLOUDFLARE_BUCKET_NAME")),
+					Key:    aws.String(f.CFF2ID.String),
+				})
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			failed++
+
+			slog.Error("Couldn't delete stored file 💀",
+				slog.String("error", err.Error()),
+				slog.Uint64("fId", f.ID),
+				slog.String("images_id", f.CFImagesID.String),
+				slog.String("stream_uid", f.CFVideoStreamUID.String),
+				slog.String("r2_key", f.CFF2ID.String))
+
+			continue
+		}
+
+		deleted++
+	}
+
+	return deleted, failed
+}
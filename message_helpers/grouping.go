@@ -0,0 +1,71 @@
+package message_helpers
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+)
+
+// How close together two messages from the same author have to be for clients to render them as one run
+const ContinuationWindow = 7 * time.Minute
+
+// A message continues the one before it when the same author sent both close together.
+// Replies always start a new run, they show the message they're replying to.
+func IsContinuation(message model.Messages, previous model.Messages) bool {
+	if previous.ID == 0 || previous.Deleted || message.ParentID > 0 {
+		return false
+	}
+
+	if message.UserID != previous.UserID {
+		return false
+	}
+
+	return message.CreatedAt.Sub(previous.CreatedAt) <= ContinuationWindow
+}
+
+// The message sent just before the given one in its channel, an empty message when there isn't one
+func PreviousMessage(channelId uint64, messageId uint64, db *sqlx.DB) (model.Messages, error) {
+	previous := model.Messages{}
+
+	q := `
+	SELECT *
+	FROM messages
+	WHERE channel_id = ?
+	AND deleted = 0
+	AND id < ?
+	ORDER BY id DESC
+	LIMIT 1`
+
+	err := db.Get(&previous, q, channelId, messageId)
+
+	if err == sql.ErrNoRows {
+		return model.Messages{}, nil
+	}
+
+	return previous, err
+}
+
+// Adds is_continuation to a page of mapped messages, sorted oldest first.
+// The first message on the page is compared to the one just before the page.
+func MarkContinuations(messages []model.Messages, mapped []fiber.Map, db *sqlx.DB) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	previous, err := PreviousMessage(messages[0].ChannelID, messages[0].ID, db)
+
+	if err != nil {
+		return err
+	}
+
+	for i, m := range messages {
+		mapped[i]["is_continuation"] = IsContinuation(m, previous)
+
+		previous = m
+	}
+
+	return nil
+}
@@ -0,0 +1,557 @@
+package message_helpers
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/security_helpers"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Whether a channel can be shown to whoever the messages are mapped for
+type ChannelFilter func(channel model.Channels) bool
+
+// For messages broadcast to everyone in a channel, where there's no single viewer to check.
+// Private channels are left out since not everyone listening might be let in.
+func PublicChannels(channel model.Channels) bool {
+	return !channel.Private
+}
+
+// Maps messages from a single community into the shape clients render.
+// Authors, their most powerful role, files, reactions, custom emoji, polls, mentions, pins, reply
+// counts and the parent being replied to are all fetched in batches, so this costs the same number
+// of queries for one message or a whole page. Mentions of channels canViewChannel rejects are dropped.
+func MapMessages(messages []model.Messages, communityId uint64, canViewChannel ChannelFilter, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) ([]fiber.Map, error) {
+
+	mm := make([]fiber.Map, len(messages))
+
+	if len(messages) == 0 {
+		return mm, nil
+	}
+
+	var messageIds = []uint64{}
+	var parentIds = []uint64{}
+
+	for _, m := range messages {
+		messageIds = append(messageIds, m.ID)
+
+		if m.ParentID > 0 {
+			parentIds = append(parentIds, m.ParentID)
+		}
+	}
+
+	/* Fetch files */
+
+	// map of message ids to files
+	filesMap := make(map[uint64][]model.Files)
+
+	fq, fArgs, err := sqlx.In("SELECT * FROM files WHERE message_id IN (?)", messageIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files := []model.Files{}
+
+	err = db.Select(&files, db.Rebind(fq), fArgs...)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "after the bind to files query"))
+
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.MessageID.Valid {
+			filesMap[uint64(f.MessageID.Int64)] = append(filesMap[uint64(f.MessageID.Int64)], f)
+		}
+	}
+
+	/* Fetch parents */
+
+	parentsMap := make(map[uint64]model.Messages)
+
+	if len(parentIds) > 0 {
+		pq, pArgs, err := sqlx.In("SELECT * FROM messages WHERE id IN (?)", parentIds)
+
+		if err != nil {
+			return nil, err
+		}
+
+		parents := []model.Messages{}
+
+		err = db.Select(&parents, db.Rebind(pq), pArgs...)
+
+		if err != nil {
+			slog.Error("Database problem 💀",
+				slog.String("error", err.Error()),
+				slog.String("area", "after the bind to parentIds query"))
+
+			return nil, err
+		}
+
+		for _, p := range parents {
+			parentsMap[p.ID] = p
+		}
+	}
+
+	/* Fetch pins */
+
+	pinnedMap := make(map[uint64]bool)
+
+	pq, pArgs, err := sqlx.In("SELECT message_id FROM messages_pins WHERE message_id IN (?)", messageIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pinnedIds := []uint64{}
+
+	err = db.Select(&pinnedIds, db.Rebind(pq), pArgs...)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "after the bind to pins query"))
+
+		return nil, err
+	}
+
+	for _, id := range pinnedIds {
+		pinnedMap[id] = true
+	}
+
+	/* Fetch mentions */
+
+	mentionsMap := make(map[uint64][]model.MessagesMentions)
+
+	mq, mArgs, err := sqlx.In("SELECT * FROM messages_mentions WHERE message_id IN (?)", messageIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mentions := []model.MessagesMentions{}
+
+	err = db.Select(&mentions, db.Rebind(mq), mArgs...)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "after the bind to mentions query"))
+
+		return nil, err
+	}
+
+	var mentionedChannelIds = []uint64{}
+
+	for _, m := range mentions {
+		mentionsMap[m.MessageID] = append(mentionsMap[m.MessageID], m)
+
+		if m.MentionType == model.MENTION_CHANNEL {
+			mentionedChannelIds = append(mentionedChannelIds, m.TargetID)
+		}
+	}
+
+	channelsMap := make(map[uint64]model.Channels)
+
+	if len(mentionedChannelIds) > 0 {
+		cq, cArgs, err := sqlx.In("SELECT * FROM channels WHERE id IN (?)", mentionedChannelIds)
+
+		if err != nil {
+			return nil, err
+		}
+
+		channels := []model.Channels{}
+
+		err = db.Select(&channels, db.Rebind(cq), cArgs...)
+
+		if err != nil {
+			slog.Error("Database problem 💀",
+				slog.String("error", err.Error()),
+				slog.String("area", "after the bind to mentioned channels query"))
+
+			return nil, err
+		}
+
+		for _, ch := range channels {
+			channelsMap[ch.ID] = ch
+		}
+	}
+
+	/* Fetch authors and their roles */
+
+	uIdsMap := make(map[uint64]bool)
+	var uIds = []uint64{}
+
+	for _, m := range messages {
+		if !uIdsMap[m.UserID] {
+			uIdsMap[m.UserID] = true
+			uIds = append(uIds, m.UserID)
+		}
+	}
+
+	for _, p := range parentsMap {
+		if !uIdsMap[p.UserID] {
+			uIdsMap[p.UserID] = true
+			uIds = append(uIds, p.UserID)
+		}
+	}
+
+	for _, m := range mentions {
+		if m.MentionType == model.MENTION_USER && !uIdsMap[m.TargetID] {
+			uIdsMap[m.TargetID] = true
+			uIds = append(uIds, m.TargetID)
+		}
+	}
+
+	uq, uArgs, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", uIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	users := []model.Users{}
+
+	err = db.Select(&users, db.Rebind(uq), uArgs...)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "after the bind to users query"))
+
+		return nil, err
+	}
+
+	usersMap := make(map[uint64]model.Users)
+
+	for _, u := range users {
+		usersMap[u.ID] = u
+	}
+
+	roles := []model.CommunityRoles{}
+
+	err = db.Select(&roles, "SELECT * FROM community_roles WHERE community_id = ?", communityId)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "can't select roles"))
+
+		return nil, err
+	}
+
+	rolesMap := make(map[uint64]model.CommunityRoles)
+
+	for _, r := range roles {
+		rolesMap[r.ID] = r
+	}
+
+	ruq, ruArgs, err := sqlx.In("SELECT * FROM community_roles_users WHERE community_id = ? AND user_id IN (?)", communityId, uIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rolesUsers := []model.CommuniyRolesUsers{}
+
+	err = db.Select(&rolesUsers, db.Rebind(ruq), ruArgs...)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "after the bind selecting roles"))
+
+		return nil, err
+	}
+
+	// Map of user id to their most powerful community role
+	urhMap := make(map[uint64]model.CommunityRoles)
+
+	for _, ru := range rolesUsers {
+		r, ok := rolesMap[ru.CommunityRoleID]
+
+		if !ok {
+			continue
+		}
+
+		if hr, found := urhMap[ru.UserID]; !found || cmp.Less(r.Priority, hr.Priority) {
+			urhMap[ru.UserID] = r
+		}
+	}
+
+	mapUser := func(userId uint64) fiber.Map {
+		mu := model.GHOST_USER
+
+		if fu, found := usersMap[userId]; found {
+			mu = fu
+		}
+
+		var uhr *fiber.Map
+
+		if hr, found := urhMap[userId]; found {
+			uhr = &fiber.Map{
+				"name":  hr.Name,
+				"color": hr.Color,
+			}
+		}
+
+		var avatarUrl *string = nil
+
+		if mu.CFAvatarImagesID.Valid {
+			s := os.Getenv("CLOUDFLARE_IMAGES_PROXY") + mu.CFAvatarImagesID.String + "/public"
+			avatarUrl = &s
+		}
+
+		return fiber.Map{
+			"name":          mu.Name.String,
+			"handle":        mu.Handle.String,
+			"powerful_role": uhr,
+			"avatar_url":    avatarUrl,
+		}
+	}
+
+	// Mentions point at ids, so they keep working after something is renamed
+	mapMentions := func(messageId uint64) []fiber.Map {
+		mms := []fiber.Map{}
+
+		for _, m := range mentionsMap[messageId] {
+			mapped := fiber.Map{
+				"type":  m.MentionType,
+				"token": m.Token,
+			}
+
+			switch m.MentionType {
+			case model.MENTION_USER:
+				u, found := usersMap[m.TargetID]
+
+				if !found {
+					continue
+				}
+
+				maps.Copy(mapped, fiber.Map{
+					"id":     security_helpers.Encode(u.ID, model.USERS_TYPE, u.Salt),
+					"handle": u.Handle.String,
+					"name":   u.Name.String,
+				})
+			case model.MENTION_ROLE:
+				r, found := rolesMap[m.TargetID]
+
+				if !found {
+					continue
+				}
+
+				maps.Copy(mapped, fiber.Map{
+					"id":    security_helpers.Encode(r.ID, model.COMMUNITY_ROLES_TYPE, r.Salt),
+					"name":  r.Name,
+					"color": r.Color,
+				})
+			case model.MENTION_CHANNEL:
+				ch, found := channelsMap[m.TargetID]
+
+				if !found || !canViewChannel(ch) {
+					continue
+				}
+
+				maps.Copy(mapped, ch.ToFiberMap())
+			default:
+				continue
+			}
+
+			mms = append(mms, mapped)
+		}
+
+		return mms
+	}
+
+	/* Fetch reply counts */
+
+	threadsMap, err := ThreadSummaries(messageIds, db)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "counting replies"))
+
+		return nil, err
+	}
+
+	/* Fetch reactions */
+
+	reactionsMap, err := LoadReactions(messageIds, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "loading reactions"))
+
+		return nil, err
+	}
+
+	/* Fetch polls */
+
+	pollsMap, err := MapPolls(messageIds, db)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "loading polls"))
+
+		return nil, err
+	}
+
+	/* Fetch custom emoji */
+
+	// map of message ids to the custom emoji names in their text and reactions
+	emojiNamesMap := make(map[uint64][]string)
+
+	var emojiNames = []string{}
+
+	for _, m := range messages {
+		if m.Deleted {
+			continue
+		}
+
+		names := EmojiNames(m.Text)
+
+		for reaction := range reactionsMap[m.ID].Reactions {
+			if name, ok := ReactionEmojiName(reaction); ok {
+				names = append(names, name)
+			}
+		}
+
+		emojiNamesMap[m.ID] = names
+		emojiNames = append(emojiNames, names...)
+	}
+
+	emojisMap, err := LoadEmojis(emojiNames, communityId, db)
+
+	if err != nil {
+		slog.Error("Database problem 💀",
+			slog.String("error", err.Error()),
+			slog.String("area", "loading emojis"))
+
+		return nil, err
+	}
+
+	mapEmojis := func(messageId uint64) []fiber.Map {
+		mes := []fiber.Map{}
+
+		seen := make(map[string]bool)
+
+		for _, name := range emojiNamesMap[messageId] {
+			e, found := emojisMap[name]
+
+			if !found || seen[name] {
+				continue
+			}
+
+			seen[name] = true
+
+			mes = append(mes, e.ToFiberMap())
+		}
+
+		return mes
+	}
+
+	/* Assemble */
+
+	for i, m := range messages {
+
+		// Tombstones still show their replies so the thread can be opened
+		thread := ThreadSummary{ParentID: m.ID}
+
+		if t, found := threadsMap[m.ID]; found {
+			thread = t
+		}
+
+		if m.Deleted {
+			mm[i] = m.ToTombstoneFiberMap()
+			maps.Copy(mm[i], thread.ToFiberMap())
+			continue
+		}
+
+		mappedMessage := fiber.Map{
+			"id":         security_helpers.Encode(m.ID, model.MESSAGES_TYPE, m.Salt),
+			"created_at": m.CreatedAt.Format(time.RFC3339),
+			"text":       m.Text,
+			"edited":     m.Edited,
+			"user":       mapUser(m.UserID),
+			"mentions":   mapMentions(m.ID),
+			"pinned":     pinnedMap[m.ID],
+		}
+
+		maps.Copy(mappedMessage, thread.ToFiberMap())
+
+		if m.UpdatedAt.Valid {
+			maps.Copy(mappedMessage, fiber.Map{
+				"updated_at": m.UpdatedAt.Time.Format(time.RFC3339),
+			})
+		}
+
+		if reactions, found := reactionsMap[m.ID]; found && len(reactions.Reactions) > 0 {
+			maps.Copy(mappedMessage, fiber.Map{
+				"reactions": reactions.ToFiberMap(),
+			})
+		}
+
+		if poll, found := pollsMap[m.ID]; found {
+			maps.Copy(mappedMessage, fiber.Map{
+				"poll": poll,
+			})
+		}
+
+		if mes := mapEmojis(m.ID); len(mes) > 0 {
+			maps.Copy(mappedMessage, fiber.Map{
+				"emojis": mes,
+			})
+		}
+
+		if mfiles := filesMap[m.ID]; len(mfiles) > 0 {
+			mfs := make([]fiber.Map, len(mfiles))
+			for i, f := range mfiles {
+				mfs[i] = f.ToFiberMap()
+			}
+			maps.Copy(mappedMessage, fiber.Map{
+				"files": mfs,
+			})
+		}
+
+		if p, pok := parentsMap[m.ParentID]; pok && p.Deleted {
+			maps.Copy(mappedMessage, fiber.Map{
+				"parent": p.ToTombstoneFiberMap(),
+			})
+		} else if pok {
+			maps.Copy(mappedMessage, fiber.Map{
+				"parent": fiber.Map{
+					"id":         security_helpers.Encode(p.ID, model.MESSAGES_TYPE, p.Salt),
+					"created_at": p.CreatedAt.Format(time.RFC3339),
+					"text":       p.Text,
+					"edited":     p.Edited,
+					"user":       mapUser(p.UserID),
+				},
+			})
+		}
+
+		mm[i] = mappedMessage
+	}
+
+	return mm, nil
+}
+
+// Sorts messages oldest first, the order clients render them in
+func SortMessages(messages []model.Messages) {
+	slices.SortFunc(messages, func(a, b model.Messages) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
@@ -0,0 +1,479 @@
+package message_helpers
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// An @ or # at the start of a word, followed by a handle
+var mentionPattern = regexp.MustCompile(`(^|[^\w])([@#])([\w-]+)`)
+
+// Role names can have spaces and capitals, they're mentioned the same way channel handles are written
+func roleMentionName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "-")
+}
+
+// Finds the @user, @role and #channel mentions in the text that belong to the community.
+// An @ is checked against member handles first, then role names. Role mentions are dropped
+// when the author isn't allowed to ping roles and channel mentions when the author can't see
+// the channel, the text is left alone either way.
+func ResolveMentions(text string, communityId uint64, canMentionRoles bool, canViewChannel ChannelFilter, db *sqlx.DB) ([]model.MessagesMentions, error) {
+
+	mentions := []model.MessagesMentions{}
+
+	matches := mentionPattern.FindAllStringSubmatch(text, -1)
+
+	if len(matches) == 0 {
+		return mentions, nil
+	}
+
+	var atNames = []string{}
+	var hashNames = []string{}
+
+	for _, m := range matches {
+		name := strings.ToLower(m[3])
+
+		if m[2] == "@" {
+			atNames = append(atNames, name)
+		} else {
+			hashNames = append(hashNames, name)
+		}
+	}
+
+	usersMap := make(map[string]uint64)
+
+	if len(atNames) > 0 {
+		uq := `
+		SELECT users.id, users.handle
+		FROM users
+		JOIN communities_users ON communities_users.user_id = users.id
+		WHERE communities_users.community_id = ?
+		AND users.handle IN (?)`
+
+		q, args, err := sqlx.In(uq, communityId, atNames)
+
+		if err != nil {
+			return nil, err
+		}
+
+		users := []model.Users{}
+
+		err = db.Select(&users, db.Rebind(q), args...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range users {
+			usersMap[strings.ToLower(u.Handle.String)] = u.ID
+		}
+	}
+
+	rolesMap := make(map[string]uint64)
+
+	if len(atNames) > 0 && canMentionRoles {
+		roles := []model.CommunityRoles{}
+
+		err := db.Select(&roles, "SELECT * FROM community_roles WHERE community_id = ?", communityId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range roles {
+			rolesMap[roleMentionName(r.Name)] = r.ID
+		}
+	}
+
+	channelsMap := make(map[string]uint64)
+
+	if len(hashNames) > 0 {
+		q, args, err := sqlx.In("SELECT * FROM channels WHERE community_id = ? AND handle IN (?)", communityId, hashNames)
+
+		if err != nil {
+			return nil, err
+		}
+
+		channels := []model.Channels{}
+
+		err = db.Select(&channels, db.Rebind(q), args...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ch := range channels {
+			if canViewChannel(ch) {
+				channelsMap[ch.Handle] = ch.ID
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+
+	for _, m := range matches {
+		name := strings.ToLower(m[3])
+
+		mention := model.MessagesMentions{
+			CommunityID: communityId,
+			Token:       m[2] + m[3],
+		}
+
+		if id, found := usersMap[name]; found && m[2] == "@" {
+			mention.MentionType = model.MENTION_USER
+			mention.TargetID = id
+		} else if id, found := rolesMap[name]; found && m[2] == "@" {
+			mention.MentionType = model.MENTION_ROLE
+			mention.TargetID = id
+		} else if id, found := channelsMap[name]; found && m[2] == "#" {
+			mention.MentionType = model.MENTION_CHANNEL
+			mention.TargetID = id
+		} else {
+			continue
+		}
+
+		key := mention.MentionType + "-" + mention.Token
+
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+
+		mentions = append(mentions, mention)
+	}
+
+	return mentions, nil
+}
+
+// Replaces the stored mentions for a message, used when it's created and every time it's edited.
+// Each mention is fanned out to the users it pings, returning the users who weren't pinged before.
+func SaveMentions(tx *sqlx.Tx, message model.Messages, mentions []model.MessagesMentions) ([]uint64, error) {
+
+	_, err := tx.Exec("DELETE FROM messages_mentions WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := time.Now()
+
+	iq := `
+	INSERT INTO messages_mentions
+	(created_at, message_id, community_id, channel_id, mention_type, target_id, token)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	// Map of pinged users to the role that pinged them, 0 when they were mentioned directly
+	pinged := make(map[uint64]uint64)
+
+	var roleIds = []uint64{}
+
+	for _, m := range mentions {
+		_, err = tx.Exec(iq, createdAt, message.ID, message.CommunityID, message.ChannelID, m.MentionType, m.TargetID, m.Token)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.MentionType {
+		case model.MENTION_USER:
+			pinged[m.TargetID] = 0
+		case model.MENTION_ROLE:
+			roleIds = append(roleIds, m.TargetID)
+		}
+	}
+
+	if len(roleIds) > 0 {
+		rq, rArgs, err := sqlx.In("SELECT * FROM community_roles_users WHERE community_role_id IN (?)", roleIds)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rolesUsers := []model.CommuniyRolesUsers{}
+
+		err = tx.Select(&rolesUsers, tx.Rebind(rq), rArgs...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ru := range rolesUsers {
+			if _, found := pinged[ru.UserID]; !found {
+				pinged[ru.UserID] = ru.CommunityRoleID
+			}
+		}
+	}
+
+	// Nobody gets pinged by their own message
+	delete(pinged, message.UserID)
+
+	// Or in a channel they can't see
+	if len(pinged) > 0 {
+		userIds := []uint64{}
+
+		for uId := range pinged {
+			userIds = append(userIds, uId)
+		}
+
+		viewers, err := channelViewers(tx, message, userIds)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for uId := range pinged {
+			if !viewers[uId] {
+				delete(pinged, uId)
+			}
+		}
+	}
+
+	previous := []uint64{}
+
+	err = tx.Select(&previous, "SELECT user_id FROM users_mentions WHERE message_id = ?", message.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Users an edit stopped mentioning lose it from their inbox, everyone else keeps their read state
+	for _, uId := range previous {
+		if _, found := pinged[uId]; found {
+			delete(pinged, uId)
+			continue
+		}
+
+		_, err = tx.Exec("DELETE FROM users_mentions WHERE message_id = ? AND user_id = ?", message.ID, uId)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uq := `
+	INSERT INTO users_mentions
+	(created_at, user_id, message_id, community_id, channel_id, community_role_id)
+	VALUES (?, ?, ?, ?, ?, ?)`
+
+	var userIds = []uint64{}
+
+	for uId, roleId := range pinged {
+		_, err = tx.Exec(uq, createdAt, uId, message.ID, message.CommunityID, message.ChannelID, roleId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		userIds = append(userIds, uId)
+	}
+
+	return userIds, nil
+}
+
+// Which of the users can see the message's channel, after the channel's and its group's
+// permission overwrites. Users who aren't in the community can't.
+func channelViewers(tx *sqlx.Tx, message model.Messages, userIds []uint64) (map[uint64]bool, error) {
+
+	viewers := make(map[uint64]bool)
+
+	channel := model.Channels{}
+
+	err := tx.Get(&channel, "SELECT * FROM channels WHERE id = ? LIMIT 1", message.ChannelID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mq, mArgs, err := sqlx.In("SELECT * FROM communities_users WHERE community_id = ? AND user_id IN (?)", message.CommunityID, userIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	members := []model.CommunitiesUsers{}
+
+	err = tx.Select(&members, tx.Rebind(mq), mArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bits, err := ChannelBits(tx, channel, members)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range members {
+		viewers[m.UserID] = bits[m.UserID]&model.ViewChannels.Bit() != 0
+	}
+
+	return viewers, nil
+}
+
+// Each member's permission bits in the channel, after the channel's and its group's permission
+// overwrites. The owner and anyone who can manage the community get every channel permission.
+func ChannelBits(tx *sqlx.Tx, channel model.Channels, members []model.CommunitiesUsers) (map[uint64]uint32, error) {
+
+	bits := make(map[uint64]uint32)
+
+	if len(members) == 0 {
+		return bits, nil
+	}
+
+	var ownerId uint64
+
+	err := tx.Get(&ownerId, "SELECT owner_id FROM communities WHERE id = ? LIMIT 1", channel.CommunityID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	overwrites := []model.PermissionOverwrites{}
+
+	err = tx.Select(&overwrites, "SELECT * FROM permission_overwrites WHERE channel_id = ? OR (group_id > 0 AND group_id = ?)", channel.ID, channel.GroupID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var userIds = []uint64{}
+
+	for _, m := range members {
+		userIds = append(userIds, m.UserID)
+	}
+
+	rq, rArgs, err := sqlx.In("SELECT * FROM community_roles_users WHERE community_id = ? AND user_id IN (?)", channel.CommunityID, userIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rolesUsers := []model.CommuniyRolesUsers{}
+
+	err = tx.Select(&rolesUsers, tx.Rebind(rq), rArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	userRoles := make(map[uint64]map[uint64]bool)
+
+	for _, ru := range rolesUsers {
+		if userRoles[ru.UserID] == nil {
+			userRoles[ru.UserID] = make(map[uint64]bool)
+		}
+
+		userRoles[ru.UserID][ru.CommunityRoleID] = true
+	}
+
+	groupOverwrites := []model.PermissionOverwrites{}
+	channelOverwrites := []model.PermissionOverwrites{}
+
+	for _, o := range overwrites {
+		if o.GroupID > 0 {
+			groupOverwrites = append(groupOverwrites, o)
+		} else {
+			channelOverwrites = append(channelOverwrites, o)
+		}
+	}
+
+	var allChannelBits uint32
+
+	for _, p := range model.ChannelPermissions {
+		allChannelBits |= p.Bit()
+	}
+
+	for _, m := range members {
+		if m.UserID == ownerId || m.ManageCommunity {
+			bits[m.UserID] = m.Permissions.Bits() | allChannelBits
+			continue
+		}
+
+		b := model.ApplyOverwrites(m.Permissions.Bits(), groupOverwrites, m.UserID, userRoles[m.UserID])
+		bits[m.UserID] = model.ChannelOverwriteBits(b, channel, channelOverwrites, m.UserID, userRoles[m.UserID])
+	}
+
+	return bits, nil
+}
+
+// The topic each user subscribes to for things that are only for them
+func UserTopic(user model.Users) string {
+	return security_helpers.Encode(user.ID, model.USERS_TYPE, user.Salt)
+}
+
+// Tells each newly pinged user about the mention on their own topic
+func BroadcastMentions(userIds []uint64, message model.Messages, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) {
+
+	if len(userIds) == 0 {
+		return
+	}
+
+	uq, uArgs, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIds)
+
+	if err != nil {
+		return
+	}
+
+	users := []model.Users{}
+
+	err = db.Select(&users, db.Rebind(uq), uArgs...)
+
+	if err != nil {
+		slog.Error("Couldn't find mentioned users 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("mId", message.ID))
+
+		return
+	}
+
+	community := model.Communities{}
+
+	err = db.Get(&community, "SELECT * FROM communities WHERE id = ? LIMIT 1", message.CommunityID)
+
+	if err != nil {
+		return
+	}
+
+	channel := model.Channels{}
+
+	err = db.Get(&channel, "SELECT * FROM channels WHERE id = ? LIMIT 1", message.ChannelID)
+
+	if err != nil {
+		return
+	}
+
+	mapped, err := MapMessages([]model.Messages{message}, community.ID, PublicChannels, db, wRdb, rRdb, ctx)
+
+	if err != nil {
+		slog.Error("Couldn't map mentioned message 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("mId", message.ID))
+
+		return
+	}
+
+	for _, u := range users {
+		internal_handlers.SendBroadcast(UserTopic(u), fiber.Map{
+			"type": "mention.created",
+			"community": fiber.Map{
+				"id":     security_helpers.Encode(community.ID, model.COMMUNITIES_TYPE, community.Salt),
+				"name":   community.Name,
+				"handle": community.Handle,
+			},
+			"channel": channel.ToFiberMap(),
+			"message": mapped[0],
+		})
+	}
+}
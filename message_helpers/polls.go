@@ -0,0 +1,310 @@
+package message_helpers
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+	"golang.org/x/exp/slog"
+)
+
+// Saves a poll and its options against a message that was just created in the same transaction
+func SavePoll(tx *sqlx.Tx, message model.Messages, question string, options []string, multipleChoice bool, closesAt sql.NullTime) (model.Polls, error) {
+
+	poll := model.Polls{
+		CreatedAt:      time.Now(),
+		Salt:           uuid.New().String(),
+		MessageID:      message.ID,
+		CommunityID:    message.CommunityID,
+		ChannelID:      message.ChannelID,
+		Question:       question,
+		MultipleChoice: multipleChoice,
+		ClosesAt:       closesAt,
+	}
+
+	pq := `
+	INSERT INTO polls
+	(created_at, object_salt, message_id, community_id, channel_id, question, multiple_choice, closes_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := tx.Exec(pq, poll.CreatedAt, poll.Salt, poll.MessageID, poll.CommunityID, poll.ChannelID, poll.Question, poll.MultipleChoice, poll.ClosesAt)
+
+	if err != nil {
+		return poll, err
+	}
+
+	err = tx.Get(&poll.ID, "SELECT LAST_INSERT_ID()")
+
+	if err != nil {
+		return poll, err
+	}
+
+	oq := `
+	INSERT INTO polls_options
+	(object_salt, poll_id, position, text)
+	VALUES (?, ?, ?, ?)`
+
+	for i, o := range options {
+		_, err = tx.Exec(oq, uuid.New().String(), poll.ID, i, o)
+
+		if err != nil {
+			return poll, err
+		}
+	}
+
+	return poll, nil
+}
+
+// Maps the polls attached to the messages with their tallies, keyed by message id.
+// Tallies are the same for everyone, MarkPollVotes adds what the viewer picked.
+func MapPolls(messageIds []uint64, db *sqlx.DB) (map[uint64]fiber.Map, error) {
+
+	pollsMap := make(map[uint64]fiber.Map)
+
+	if len(messageIds) == 0 {
+		return pollsMap, nil
+	}
+
+	pq, pArgs, err := sqlx.In("SELECT * FROM polls WHERE message_id IN (?)", messageIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	polls := []model.Polls{}
+
+	err = db.Select(&polls, db.Rebind(pq), pArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(polls) == 0 {
+		return pollsMap, nil
+	}
+
+	var pollIds = []uint64{}
+
+	for _, p := range polls {
+		pollIds = append(pollIds, p.ID)
+	}
+
+	oq, oArgs, err := sqlx.In("SELECT * FROM polls_options WHERE poll_id IN (?) ORDER BY position ASC", pollIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	options := []model.PollsOptions{}
+
+	err = db.Select(&options, db.Rebind(oq), oArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	type optionTally struct {
+		OptionID uint64 `db:"option_id"`
+		Votes    uint64 `db:"votes"`
+	}
+
+	tq, tArgs, err := sqlx.In("SELECT option_id, count(*) AS votes FROM polls_votes WHERE poll_id IN (?) GROUP BY option_id", pollIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tallies := []optionTally{}
+
+	err = db.Select(&tallies, db.Rebind(tq), tArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	type pollVoters struct {
+		PollID uint64 `db:"poll_id"`
+		Voters uint64 `db:"voters"`
+	}
+
+	vq, vArgs, err := sqlx.In("SELECT poll_id, count(DISTINCT user_id) AS voters FROM polls_votes WHERE poll_id IN (?) GROUP BY poll_id", pollIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	voters := []pollVoters{}
+
+	err = db.Select(&voters, db.Rebind(vq), vArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	talliesMap := make(map[uint64]uint64)
+
+	for _, t := range tallies {
+		talliesMap[t.OptionID] = t.Votes
+	}
+
+	votersMap := make(map[uint64]uint64)
+
+	for _, v := range voters {
+		votersMap[v.PollID] = v.Voters
+	}
+
+	optionsMap := make(map[uint64][]fiber.Map)
+
+	for _, o := range options {
+		optionsMap[o.PollID] = append(optionsMap[o.PollID], fiber.Map{
+			"id":    security_helpers.Encode(o.ID, model.POLLS_OPTIONS_TYPE, o.Salt),
+			"text":  o.Text,
+			"votes": talliesMap[o.ID],
+		})
+	}
+
+	for _, p := range polls {
+		var closesAt *string = nil
+
+		if p.ClosesAt.Valid {
+			s := p.ClosesAt.Time.Format(time.RFC3339)
+			closesAt = &s
+		}
+
+		mo := optionsMap[p.ID]
+
+		if mo == nil {
+			mo = []fiber.Map{}
+		}
+
+		pollsMap[p.MessageID] = fiber.Map{
+			"id":              security_helpers.Encode(p.ID, model.POLLS_TYPE, p.Salt),
+			"question":        p.Question,
+			"multiple_choice": p.MultipleChoice,
+			"closes_at":       closesAt,
+			"closed":          p.IsClosed(),
+			"voters":          votersMap[p.ID],
+			"options":         mo,
+		}
+	}
+
+	return pollsMap, nil
+}
+
+// Adds the options the viewer voted for to each mapped poll
+func MarkPollVotes(userId uint64, messages []model.Messages, mapped []fiber.Map, db *sqlx.DB) error {
+
+	var messageIds = []uint64{}
+
+	for i, m := range messages {
+		if _, found := mapped[i]["poll"]; found {
+			messageIds = append(messageIds, m.ID)
+		}
+	}
+
+	if len(messageIds) == 0 {
+		return nil
+	}
+
+	type votedOption struct {
+		MessageID uint64 `db:"message_id"`
+		OptionID  uint64 `db:"option_id"`
+		Salt      string `db:"object_salt"`
+	}
+
+	vq := `
+	SELECT polls.message_id, polls_options.id AS option_id, polls_options.object_salt
+	FROM polls_votes
+	JOIN polls ON polls.id = polls_votes.poll_id
+	JOIN polls_options ON polls_options.id = polls_votes.option_id
+	WHERE polls_votes.user_id = ?
+	AND polls.message_id IN (?)`
+
+	q, args, err := sqlx.In(vq, userId, messageIds)
+
+	if err != nil {
+		return err
+	}
+
+	voted := []votedOption{}
+
+	err = db.Select(&voted, db.Rebind(q), args...)
+
+	if err != nil {
+		return err
+	}
+
+	votedMap := make(map[uint64][]string)
+
+	for _, v := range voted {
+		votedMap[v.MessageID] = append(votedMap[v.MessageID], security_helpers.Encode(v.OptionID, model.POLLS_OPTIONS_TYPE, v.Salt))
+	}
+
+	for i, m := range messages {
+		poll, ok := mapped[i]["poll"].(fiber.Map)
+
+		if !ok {
+			continue
+		}
+
+		mv := votedMap[m.ID]
+
+		if mv == nil {
+			mv = []string{}
+		}
+
+		poll["voted"] = mv
+	}
+
+	return nil
+}
+
+// Sends the poll's current tallies to its channel, as a poll.updated or poll.closed event
+func BroadcastPoll(poll model.Polls, eventType string, db *sqlx.DB) {
+
+	message := model.Messages{}
+
+	err := db.Get(&message, "SELECT * FROM messages WHERE id = ? LIMIT 1", poll.MessageID)
+
+	if err != nil {
+		return
+	}
+
+	channel := model.Channels{}
+
+	err = db.Get(&channel, "SELECT * FROM channels WHERE id = ? LIMIT 1", poll.ChannelID)
+
+	if err != nil {
+		return
+	}
+
+	polls, err := MapPolls([]uint64{poll.MessageID}, db)
+
+	if err != nil {
+		slog.Error("Couldn't map poll 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("pId", poll.ID))
+
+		return
+	}
+
+	mapped, found := polls[poll.MessageID]
+
+	if !found {
+		return
+	}
+
+	channelTopic := security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt)
+
+	internal_handlers.SendBroadcast(channelTopic, fiber.Map{
+		"type":       eventType,
+		"id":         security_helpers.Encode(message.ID, model.MESSAGES_TYPE, message.Salt),
+		"channel_id": channelTopic,
+		"poll":       mapped,
+	})
+}
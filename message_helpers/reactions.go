@@ -0,0 +1,283 @@
+package message_helpers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Cached reactions expire so anything the cache missed is eventually rebuilt from the table
+const reactionsCacheTTL = 1 * time.Hour
+
+// What redis reports for a key without an expiry, only keys from before the table are like that
+const legacyReactionsTTL = time.Duration(-1)
+
+// Only fills the cache when nothing invalidated it since the table was read, and never over
+// a fill that got there first
+var setReactionsIfVersion = redis.NewScript(`
+if (redis.call("GET", KEYS[2]) or "") ~= ARGV[2] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "NX", "EX", ARGV[3])
+return 1
+`)
+
+func ReactionsKey(messageId uint64) string {
+	return fmt.Sprintf("message-reactions-%d", messageId)
+}
+
+// Bumped on every invalidation so a fill started before it can tell it's stale
+func ReactionsVersionKey(messageId uint64) string {
+	return fmt.Sprintf("reactions-version-%d", messageId)
+}
+
+// Reads each message's reactions from redis. Anything that isn't cached is loaded from the
+// reactions table and cached for next time, messages without reactions are cached as empty.
+func LoadReactions(messageIds []uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) (map[uint64]model.MessagesReactions, error) {
+
+	reactionsMap := make(map[uint64]model.MessagesReactions)
+
+	if len(messageIds) == 0 {
+		return reactionsMap, nil
+	}
+
+	keys := make([]string, len(messageIds))
+
+	for i, id := range messageIds {
+		keys[i] = ReactionsKey(id)
+	}
+
+	// The expiry comes back with each value so legacy keys are never served as they are
+	readPipe := rRdb.Pipeline()
+
+	mget := readPipe.MGet(ctx, keys...)
+
+	ttls := make([]*redis.DurationCmd, len(keys))
+
+	for i, key := range keys {
+		ttls[i] = readPipe.TTL(ctx, key)
+	}
+
+	_, err := readPipe.Exec(ctx)
+
+	vals := mget.Val()
+
+	if err != nil || len(vals) != len(keys) {
+		if err != nil {
+			slog.Error("Couldn't read reactions from redis 💀",
+				slog.String("error", err.Error()))
+		}
+
+		vals = make([]interface{}, len(keys))
+	}
+
+	var missing = []uint64{}
+
+	for i, v := range vals {
+		if ttls[i].Val() == legacyReactionsTTL {
+			if err := ImportLegacyReactions(messageIds[i], db, wRdb, ctx); err != nil {
+				return nil, err
+			}
+
+			missing = append(missing, messageIds[i])
+			continue
+		}
+
+		reactions := model.MessagesReactions{}
+
+		s, ok := v.(string)
+
+		if !ok || json.Unmarshal([]byte(s), &reactions) != nil {
+			missing = append(missing, messageIds[i])
+			continue
+		}
+
+		reactionsMap[messageIds[i]] = reactions
+	}
+
+	if len(missing) == 0 {
+		return reactionsMap, nil
+	}
+
+	versionKeys := make([]string, len(missing))
+
+	for i, id := range missing {
+		versionKeys[i] = ReactionsVersionKey(id)
+	}
+
+	// Read before the table, so an invalidation after this point stops the fill below
+	versions, err := wRdb.MGet(ctx, versionKeys...).Result()
+
+	if err != nil {
+		slog.Error("Couldn't read reactions versions from redis 💀",
+			slog.String("error", err.Error()))
+
+		versions = nil
+	}
+
+	type reactionRow struct {
+		MessageID  uint64         `db:"message_id"`
+		Reaction   string         `db:"reaction"`
+		UserID     uint64         `db:"user_id"`
+		UserHandle sql.NullString `db:"handle"`
+	}
+
+	rq := `
+	SELECT reactions.message_id, reactions.reaction, reactions.user_id, users.handle
+	FROM reactions
+	JOIN users ON users.id = reactions.user_id
+	WHERE reactions.message_id IN (?)
+	ORDER BY reactions.id ASC`
+
+	q, args, err := sqlx.In(rq, missing)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []reactionRow{}
+
+	err = db.Select(&rows, db.Rebind(q), args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range missing {
+		reactionsMap[id] = model.MessagesReactions{
+			MessageID: id,
+			Reactions: make(map[string][]model.ReactionUser),
+		}
+	}
+
+	// Rows come back oldest first, so each reaction lists users in the order they reacted
+	for _, r := range rows {
+		reactionsMap[r.MessageID].Reactions[r.Reaction] = append(reactionsMap[r.MessageID].Reactions[r.Reaction], model.ReactionUser{
+			UserID:     r.UserID,
+			UserHandle: r.UserHandle.String,
+		})
+	}
+
+	// Without the versions there's no telling whether the rows are still current
+	if len(versions) != len(missing) {
+		return reactionsMap, nil
+	}
+
+	pipe := wRdb.Pipeline()
+
+	for i, id := range missing {
+		p, err := json.Marshal(reactionsMap[id])
+
+		if err != nil {
+			continue
+		}
+
+		version, _ := versions[i].(string)
+
+		setReactionsIfVersion.Eval(ctx, pipe, []string{ReactionsKey(id), versionKeys[i]}, p, version, int(reactionsCacheTTL.Seconds()))
+	}
+
+	_, err = pipe.Exec(ctx)
+
+	if err != nil {
+		slog.Error("Couldn't cache reactions in redis 💀",
+			slog.String("error", err.Error()))
+	}
+
+	return reactionsMap, nil
+}
+
+// Drops a message's cached reactions, the next read rebuilds them from the table. A legacy
+// key is imported first, and kept when that fails so its reactions aren't lost.
+func InvalidateReactions(messageId uint64, db *sqlx.DB, wRdb *redis.Client, ctx context.Context) {
+	if err := ImportLegacyReactions(messageId, db, wRdb, ctx); err != nil {
+		slog.Error("Couldn't import legacy reactions 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("mId", messageId))
+
+		return
+	}
+
+	err := dropReactions(messageId, wRdb, ctx)
+
+	if err != nil {
+		slog.Error("Couldn't remove message reactions from redis 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("mId", messageId))
+	}
+}
+
+// Reactions used to only be stored in redis, under the cache's key but without an expiry.
+// Copies a legacy key into the reactions table and drops it, anything else is left alone.
+func ImportLegacyReactions(messageId uint64, db *sqlx.DB, wRdb *redis.Client, ctx context.Context) error {
+
+	key := ReactionsKey(messageId)
+
+	ttl, err := wRdb.TTL(ctx, key).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if ttl != legacyReactionsTTL {
+		return nil
+	}
+
+	val, err := wRdb.Get(ctx, key).Result()
+
+	if err == redis.Nil {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	reactions := model.MessagesReactions{}
+
+	if err := json.Unmarshal([]byte(val), &reactions); err == nil {
+		iq := `
+		INSERT INTO reactions
+		(created_at, message_id, community_id, channel_id, user_id, reaction)
+		SELECT ?, id, community_id, channel_id, ?, ?
+		FROM messages
+		WHERE id = ?
+		AND deleted = 0
+		ON DUPLICATE KEY UPDATE reactions.id = reactions.id`
+
+		createdAt := time.Now()
+
+		for reaction, users := range reactions.Reactions {
+			for _, u := range users {
+				_, err = db.ExecContext(ctx, iq, createdAt, u.UserID, reaction, messageId)
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return dropReactions(messageId, wRdb, ctx)
+}
+
+// Removes the cached reactions and bumps the version, which outlives any fill that could have
+// read the table before this
+func dropReactions(messageId uint64, wRdb *redis.Client, ctx context.Context) error {
+	pipe := wRdb.TxPipeline()
+
+	pipe.Incr(ctx, ReactionsVersionKey(messageId))
+	pipe.Expire(ctx, ReactionsVersionKey(messageId), reactionsCacheTTL)
+	pipe.Del(ctx, ReactionsKey(messageId))
+
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
@@ -0,0 +1,361 @@
+package message_helpers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Markers live in the read_markers table, redis only saves the lookup when counting unreads
+const readMarkerCacheTTL = 24 * time.Hour
+
+// Holds the seq of the message the user has read the channel up to.
+// Keys written before seqs existed hold an RFC3339 time instead.
+func ReadMarkerKey(userId uint64, channelId uint64) string {
+	return fmt.Sprintf("user-%d-channel-%d", userId, channelId)
+}
+
+// Reads how far the user has read each channel as a seq, keyed by channel id. Markers missing
+// from redis are loaded from the table and cached, channels the user has never read are left out.
+func LoadReadMarkers(userId uint64, channelIds []uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) map[uint64]uint64 {
+
+	markersMap := make(map[uint64]uint64)
+
+	if len(channelIds) == 0 {
+		return markersMap
+	}
+
+	keys := make([]string, len(channelIds))
+
+	for i, id := range channelIds {
+		keys[i] = ReadMarkerKey(userId, id)
+	}
+
+	vals, err := rRdb.MGet(ctx, keys...).Result()
+
+	if err != nil {
+		slog.Error("Couldn't read markers from redis 💀",
+			slog.String("error", err.Error()))
+
+		vals = make([]interface{}, len(keys))
+	}
+
+	var missing = []uint64{}
+
+	legacy := make(map[uint64]time.Time)
+
+	for i, v := range vals {
+		s, ok := v.(string)
+
+		if !ok {
+			missing = append(missing, channelIds[i])
+			continue
+		}
+
+		if seq, err := strconv.ParseUint(s, 10, 64); err == nil {
+			markersMap[channelIds[i]] = seq
+			continue
+		}
+
+		missing = append(missing, channelIds[i])
+
+		if tm, err := time.Parse(time.RFC3339, s); err == nil {
+			legacy[channelIds[i]] = tm
+		}
+	}
+
+	if len(missing) == 0 {
+		return markersMap
+	}
+
+	q, args, err := sqlx.In("SELECT * FROM read_markers WHERE user_id = ? AND channel_id IN (?)", userId, missing)
+
+	if err != nil {
+		return markersMap
+	}
+
+	markers := []model.ReadMarkers{}
+
+	err = db.Select(&markers, db.Rebind(q), args...)
+
+	if err != nil {
+		slog.Error("Couldn't load read markers 💀",
+			slog.String("error", err.Error()))
+
+		return markersMap
+	}
+
+	for _, m := range markers {
+		markersMap[m.ChannelID] = m.Seq
+
+		delete(legacy, m.ChannelID)
+
+		cacheReadMarker(userId, m.ChannelID, m.Seq, wRdb, ctx)
+	}
+
+	// Markers only ever kept in redis are moved into the table the first time they're read
+	for channelId, readAt := range legacy {
+		marker, err := legacyReadMarker(userId, channelId, readAt, db)
+
+		if err != nil {
+			slog.Error("Couldn't convert read marker 💀",
+				slog.String("error", err.Error()),
+				slog.Uint64("cId", channelId))
+
+			continue
+		}
+
+		_, err = db.Exec(upsertReadMarkerQuery, marker.UserID, marker.ChannelID, marker.CommunityID, marker.MessageID, marker.Seq, marker.ReadAt, marker.UpdatedAt)
+
+		if err != nil {
+			slog.Error("Couldn't save converted read marker 💀",
+				slog.String("error", err.Error()),
+				slog.Uint64("cId", channelId))
+
+			continue
+		}
+
+		markersMap[channelId] = marker.Seq
+
+		cacheReadMarker(userId, channelId, marker.Seq, wRdb, ctx)
+	}
+
+	return markersMap
+}
+
+// Works out the message a marker kept as a time pointed at
+func legacyReadMarker(userId uint64, channelId uint64, readAt time.Time, db *sqlx.DB) (model.ReadMarkers, error) {
+	marker := model.ReadMarkers{
+		UserID:    userId,
+		ChannelID: channelId,
+		ReadAt:    readAt,
+		UpdatedAt: time.Now(),
+	}
+
+	err := db.Get(&marker.CommunityID, "SELECT community_id FROM channels WHERE id = ? LIMIT 1", channelId)
+
+	if err != nil {
+		return marker, err
+	}
+
+	lq := `
+	SELECT COALESCE(MAX(id), 0) AS id, COALESCE(MAX(seq), 0) AS seq
+	FROM messages
+	WHERE channel_id = ?
+	AND created_at <= ?`
+
+	latest := struct {
+		ID  uint64 `db:"id"`
+		Seq uint64 `db:"seq"`
+	}{}
+
+	err = db.Get(&latest, lq, channelId, readAt)
+
+	marker.MessageID = latest.ID
+	marker.Seq = latest.Seq
+
+	return marker, err
+}
+
+func cacheReadMarker(userId uint64, channelId uint64, seq uint64, wRdb *redis.Client, ctx context.Context) {
+	err := wRdb.Set(ctx, ReadMarkerKey(userId, channelId), seq, readMarkerCacheTTL).Err()
+
+	if err != nil {
+		slog.Error("Couldn't cache read marker 💀",
+			slog.String("error", err.Error()))
+	}
+}
+
+// Caches the marker InsertMessage moved for the author once the message commits. Another device
+// might have read further already, so an older seq never overwrites a newer one.
+func CacheSentReadMarker(message model.Messages, wRdb *redis.Client, ctx context.Context) {
+	err := setSeqIfGreater.Run(ctx, wRdb, []string{ReadMarkerKey(message.UserID, message.ChannelID)}, message.Seq, int(readMarkerCacheTTL.Seconds())).Err()
+
+	if err != nil {
+		slog.Error("Couldn't cache read marker 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("cId", message.ChannelID))
+	}
+}
+
+// Each column compares against seq before it's updated, so seq has to be set last
+const upsertReadMarkerQuery = `
+	INSERT INTO read_markers
+	(user_id, channel_id, community_id, message_id, seq, read_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE
+	message_id = IF(VALUES(seq) > seq, VALUES(message_id), message_id),
+	read_at = IF(VALUES(seq) > seq, VALUES(read_at), read_at),
+	updated_at = IF(VALUES(seq) > seq, VALUES(updated_at), updated_at),
+	seq = GREATEST(seq, VALUES(seq))`
+
+// Moves the user's markers forward by seq, a marker never moves back to an older message.
+// Markers that moved are cached, their mentions marked read and the user's other devices told.
+func MoveReadMarkers(user model.Users, markers []model.ReadMarkers, db *sqlx.DB, wRdb *redis.Client, ctx context.Context) ([]model.ReadMarkers, error) {
+
+	moved := []model.ReadMarkers{}
+
+	for _, m := range markers {
+		m.UserID = user.ID
+		m.ReadAt = m.ReadAt.Truncate(time.Second)
+		m.UpdatedAt = time.Now()
+
+		res, err := db.Exec(upsertReadMarkerQuery, m.UserID, m.ChannelID, m.CommunityID, m.MessageID, m.Seq, m.ReadAt, m.UpdatedAt)
+
+		if err != nil {
+			return moved, err
+		}
+
+		changed, err := res.RowsAffected()
+
+		if err != nil {
+			return moved, err
+		}
+
+		if changed == 0 {
+			continue
+		}
+
+		moved = append(moved, m)
+
+		cacheReadMarker(user.ID, m.ChannelID, m.Seq, wRdb, ctx)
+
+		_, err = db.Exec("UPDATE users_mentions SET read_at = ? WHERE user_id = ? AND channel_id = ? AND created_at <= ? AND read_at IS NULL", m.UpdatedAt, user.ID, m.ChannelID, m.ReadAt)
+
+		if err != nil {
+			slog.Error("Couldn't mark mentions read 💀",
+				slog.String("error", err.Error()))
+		}
+	}
+
+	if len(moved) > 0 {
+		go BroadcastReadMarkers(user, moved, db)
+	}
+
+	return moved, nil
+}
+
+// The newest message in the channel and its seq, what the channel is read up to when it's read right now
+func LatestMessage(channelId uint64, db *sqlx.DB) (uint64, uint64, error) {
+	latest := struct {
+		ID  uint64 `db:"id"`
+		Seq uint64 `db:"seq"`
+	}{}
+
+	err := db.Get(&latest, "SELECT COALESCE(MAX(id), 0) AS id, COALESCE(MAX(seq), 0) AS seq FROM messages WHERE channel_id = ?", channelId)
+
+	return latest.ID, latest.Seq, err
+}
+
+func MapReadMarkers(markers []model.ReadMarkers, db *sqlx.DB) ([]fiber.Map, error) {
+
+	mm := []fiber.Map{}
+
+	if len(markers) == 0 {
+		return mm, nil
+	}
+
+	var channelIds = []uint64{}
+	var messageIds = []uint64{}
+
+	for _, m := range markers {
+		channelIds = append(channelIds, m.ChannelID)
+
+		if m.MessageID > 0 {
+			messageIds = append(messageIds, m.MessageID)
+		}
+	}
+
+	cq, cArgs, err := sqlx.In("SELECT * FROM channels WHERE id IN (?)", channelIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	channels := []model.Channels{}
+
+	err = db.Select(&channels, db.Rebind(cq), cArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	channelsMap := make(map[uint64]model.Channels)
+
+	for _, ch := range channels {
+		channelsMap[ch.ID] = ch
+	}
+
+	messagesMap := make(map[uint64]model.Messages)
+
+	if len(messageIds) > 0 {
+		mq, mArgs, err := sqlx.In("SELECT * FROM messages WHERE id IN (?)", messageIds)
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages := []model.Messages{}
+
+		err = db.Select(&messages, db.Rebind(mq), mArgs...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range messages {
+			messagesMap[m.ID] = m
+		}
+	}
+
+	for _, m := range markers {
+		channel, found := channelsMap[m.ChannelID]
+
+		if !found {
+			continue
+		}
+
+		var messageId *string = nil
+
+		if message, found := messagesMap[m.MessageID]; found {
+			s := security_helpers.Encode(message.ID, model.MESSAGES_TYPE, message.Salt)
+			messageId = &s
+		}
+
+		mm = append(mm, fiber.Map{
+			"channel_id": security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt),
+			"message_id": messageId,
+			"seq":        m.Seq,
+			"read_at":    m.ReadAt.Format(time.RFC3339),
+		})
+	}
+
+	return mm, nil
+}
+
+// Tells the user's other devices their markers moved so they can clear their badges
+func BroadcastReadMarkers(user model.Users, markers []model.ReadMarkers, db *sqlx.DB) {
+
+	mapped, err := MapReadMarkers(markers, db)
+
+	if err != nil {
+		slog.Error("Couldn't map read markers 💀",
+			slog.String("error", err.Error()))
+
+		return
+	}
+
+	internal_handlers.SendBroadcast(UserTopic(user), fiber.Map{
+		"type":    "read_markers.updated",
+		"markers": mapped,
+	})
+}
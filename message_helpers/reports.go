@@ -0,0 +1,181 @@
+package message_helpers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+	"golang.org/x/exp/slog"
+)
+
+// Only handed to members who can moderate, the ws api checks again when it's subscribed to
+func ModeratorsTopic(community model.Communities) string {
+	return security_helpers.Encode(community.ID, model.MODERATORS_TYPE, community.Salt)
+}
+
+func MapReports(reports []model.Reports, db *sqlx.DB) ([]fiber.Map, error) {
+
+	mr := []fiber.Map{}
+
+	if len(reports) == 0 {
+		return mr, nil
+	}
+
+	var userIds = []uint64{}
+	var messageIds = []uint64{}
+	var channelIds = []uint64{}
+
+	for _, r := range reports {
+		userIds = append(userIds, r.ReporterID, r.TargetUserID)
+
+		if r.ResolvedBy > 0 {
+			userIds = append(userIds, r.ResolvedBy)
+		}
+
+		if r.MessageID > 0 {
+			messageIds = append(messageIds, r.MessageID)
+			channelIds = append(channelIds, r.ChannelID)
+		}
+	}
+
+	uq, uArgs, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	users := []model.Users{}
+
+	err = db.Select(&users, db.Rebind(uq), uArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	usersMap := make(map[uint64]fiber.Map)
+
+	for _, u := range users {
+		usersMap[u.ID] = u.ToFiberMap()
+	}
+
+	messagesMap := make(map[uint64]model.Messages)
+	channelsMap := make(map[uint64]model.Channels)
+
+	if len(messageIds) > 0 {
+		mq, mArgs, err := sqlx.In("SELECT * FROM messages WHERE id IN (?) AND deleted = 0", messageIds)
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages := []model.Messages{}
+
+		err = db.Select(&messages, db.Rebind(mq), mArgs...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range messages {
+			messagesMap[m.ID] = m
+		}
+
+		cq, cArgs, err := sqlx.In("SELECT * FROM channels WHERE id IN (?)", channelIds)
+
+		if err != nil {
+			return nil, err
+		}
+
+		channels := []model.Channels{}
+
+		err = db.Select(&channels, db.Rebind(cq), cArgs...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ch := range channels {
+			channelsMap[ch.ID] = ch
+		}
+	}
+
+	for _, r := range reports {
+		report := fiber.Map{
+			"id":          security_helpers.Encode(r.ID, model.REPORTS_TYPE, r.Salt),
+			"created_at":  r.CreatedAt.Format(time.RFC3339),
+			"status":      r.Status,
+			"category":    r.Category,
+			"details":     nil,
+			"reporter":    usersMap[r.ReporterID],
+			"target_user": usersMap[r.TargetUserID],
+			"message":     nil,
+			"resolution":  nil,
+			"resolved_by": nil,
+			"resolved_at": nil,
+		}
+
+		if r.Details.Valid {
+			report["details"] = r.Details.String
+		}
+
+		// The copy of the text is kept even once the message itself is gone
+		if r.MessageID > 0 {
+			message := fiber.Map{
+				"id":         nil,
+				"channel_id": nil,
+				"text":       r.MessageText.String,
+				"deleted":    true,
+			}
+
+			if m, found := messagesMap[r.MessageID]; found {
+				message["id"] = security_helpers.Encode(m.ID, model.MESSAGES_TYPE, m.Salt)
+				message["deleted"] = false
+			}
+
+			if ch, found := channelsMap[r.ChannelID]; found {
+				message["channel_id"] = security_helpers.Encode(ch.ID, model.CHANNELS_TYPE, ch.Salt)
+			}
+
+			report["message"] = message
+		}
+
+		if r.Resolution.Valid {
+			report["resolution"] = r.Resolution.String
+		}
+
+		if r.ResolvedBy > 0 {
+			report["resolved_by"] = usersMap[r.ResolvedBy]
+		}
+
+		if r.ResolvedAt.Valid {
+			report["resolved_at"] = r.ResolvedAt.Time.Format(time.RFC3339)
+		}
+
+		mr = append(mr, report)
+	}
+
+	return mr, nil
+}
+
+// Tells the community's moderators a report was made, resolved or dismissed so their queues stay current
+func BroadcastReports(community model.Communities, eventType string, reports []model.Reports, db *sqlx.DB) {
+
+	mapped, err := MapReports(reports, db)
+
+	if err != nil {
+		slog.Error("Couldn't map reports 💀",
+			slog.String("error", err.Error()))
+
+		return
+	}
+
+	for _, m := range mapped {
+		internal_handlers.SendBroadcast(ModeratorsTopic(community), fiber.Map{
+			"type":   eventType,
+			"report": m,
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package message_helpers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// The channels table holds the real sequence, redis only saves the lookup when counting unreads
+const channelSeqCacheTTL = 24 * time.Hour
+
+// Messages can commit out of order, so an older sequence never overwrites a newer one
+var setSeqIfGreater = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0") or 0
+if tonumber(ARGV[1]) > current then
+	redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// Holds the seq of the newest message in the channel
+func ChannelSeqKey(channelId uint64) string {
+	return fmt.Sprintf("channel-seq-%d", channelId)
+}
+
+// Takes the next seq for a message in the channel. The channel row stays locked until the
+// transaction ends, so seqs are handed out in order without gaps.
+func NextChannelSeq(tx *sqlx.Tx, channelId uint64) (uint64, error) {
+	_, err := tx.Exec("UPDATE channels SET last_seq = last_seq + 1 WHERE id = ?", channelId)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var seq uint64
+
+	err = tx.Get(&seq, "SELECT last_seq FROM channels WHERE id = ?", channelId)
+
+	return seq, err
+}
+
+// Mirrors a committed message's seq to redis
+func CacheChannelSeq(channelId uint64, seq uint64, wRdb *redis.Client, ctx context.Context) {
+	err := setSeqIfGreater.Run(ctx, wRdb, []string{ChannelSeqKey(channelId)}, seq, int(channelSeqCacheTTL.Seconds())).Err()
+
+	if err != nil {
+		slog.Error("Couldn't cache channel seq 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("cId", channelId))
+	}
+}
+
+// Reads the newest seq of each channel, keyed by channel id. Anything missing from redis
+// is loaded from the channels table in one query and cached.
+func LoadChannelSeqs(channelIds []uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) map[uint64]uint64 {
+
+	seqsMap := make(map[uint64]uint64)
+
+	if len(channelIds) == 0 {
+		return seqsMap
+	}
+
+	keys := make([]string, len(channelIds))
+
+	for i, id := range channelIds {
+		keys[i] = ChannelSeqKey(id)
+	}
+
+	vals, err := rRdb.MGet(ctx, keys...).Result()
+
+	if err != nil {
+		slog.Error("Couldn't read channel seqs from redis 💀",
+			slog.String("error", err.Error()))
+
+		vals = make([]interface{}, len(keys))
+	}
+
+	var missing = []uint64{}
+
+	for i, v := range vals {
+		s, ok := v.(string)
+
+		if !ok {
+			missing = append(missing, channelIds[i])
+			continue
+		}
+
+		seq, err := strconv.ParseUint(s, 10, 64)
+
+		if err != nil {
+			missing = append(missing, channelIds[i])
+			continue
+		}
+
+		seqsMap[channelIds[i]] = seq
+	}
+
+	if len(missing) == 0 {
+		return seqsMap
+	}
+
+	type channelSeq struct {
+		ID      uint64 `db:"id"`
+		LastSeq uint64 `db:"last_seq"`
+	}
+
+	q, args, err := sqlx.In("SELECT id, last_seq FROM channels WHERE id IN (?)", missing)
+
+	if err != nil {
+		return seqsMap
+	}
+
+	seqs := []channelSeq{}
+
+	err = db.Select(&seqs, db.Rebind(q), args...)
+
+	if err != nil {
+		slog.Error("Couldn't load channel seqs 💀",
+			slog.String("error", err.Error()))
+
+		return seqsMap
+	}
+
+	for _, s := range seqs {
+		seqsMap[s.ID] = s.LastSeq
+
+		CacheChannelSeq(s.ID, s.LastSeq, wRdb, ctx)
+	}
+
+	return seqsMap
+}
+
+// Unread messages in each channel for the user, keyed by channel id. Channels the user
+// has never read count as read, the same as before read markers were kept. Sending moves the
+// author's marker, so their own messages aren't counted, but deleted and purged messages still
+// take up their seq and are counted until the channel is read.
+func UnreadCounts(userId uint64, channelIds []uint64, db *sqlx.DB, wRdb *redis.Client, rRdb *redis.Client, ctx context.Context) map[uint64]uint64 {
+
+	unreadMap := make(map[uint64]uint64)
+
+	readSeqs := LoadReadMarkers(userId, channelIds, db, wRdb, rRdb, ctx)
+
+	if len(readSeqs) == 0 {
+		return unreadMap
+	}
+
+	var readChannelIds = []uint64{}
+
+	for id := range readSeqs {
+		readChannelIds = append(readChannelIds, id)
+	}
+
+	latestSeqs := LoadChannelSeqs(readChannelIds, db, wRdb, rRdb, ctx)
+
+	for id, readSeq := range readSeqs {
+		if latest := latestSeqs[id]; latest > readSeq {
+			unreadMap[id] = latest - readSeq
+		}
+	}
+
+	return unreadMap
+}
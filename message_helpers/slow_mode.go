@@ -0,0 +1,59 @@
+package message_helpers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/redis/go-redis/v9"
+)
+
+// Set when the user sends in a slow mode channel and expires when they can send again
+func SlowModeKey(userId uint64, channelId uint64) string {
+	return fmt.Sprintf("slow-mode-user-%d-channel-%d", userId, channelId)
+}
+
+// Claims the user's next send in the channel. When they already sent within the interval
+// nothing is claimed and the time left until they can send again is returned.
+func ClaimSlowMode(userId uint64, channel model.Channels, wRdb *redis.Client, ctx context.Context) (bool, time.Duration, error) {
+	if channel.SlowModeSeconds == 0 {
+		return true, 0, nil
+	}
+
+	key := SlowModeKey(userId, channel.ID)
+
+	claimed, err := wRdb.SetNX(ctx, key, 1, time.Duration(channel.SlowModeSeconds)*time.Second).Result()
+
+	if err != nil || claimed {
+		return claimed, 0, err
+	}
+
+	return false, SlowModeRetryAfter(userId, channel, wRdb, ctx), nil
+}
+
+// Gives back a claim for a send that never went out
+func ReleaseSlowMode(userId uint64, channel model.Channels, wRdb *redis.Client, ctx context.Context) {
+	wRdb.Del(ctx, SlowModeKey(userId, channel.ID))
+}
+
+// Time left until the user can send in the channel again, 0 when they can send now
+func SlowModeRetryAfter(userId uint64, channel model.Channels, rdb *redis.Client, ctx context.Context) time.Duration {
+	if channel.SlowModeSeconds == 0 {
+		return 0
+	}
+
+	ttl, err := rdb.PTTL(ctx, SlowModeKey(userId, channel.ID)).Result()
+
+	if err != nil || ttl < 0 {
+		return 0
+	}
+
+	return ttl
+}
+
+// Whole seconds for clients counting down, rounded up so they never retry early
+func RetryAfterSeconds(d time.Duration) uint64 {
+	return uint64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,114 @@
+package message_helpers
+
+import (
+	"database/sql"
+	"maps"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+	"golang.org/x/exp/slog"
+)
+
+type ThreadSummary struct {
+	ParentID    uint64       `db:"parent_id"`
+	ReplyCount  uint64       `db:"reply_count"`
+	LastReplyAt sql.NullTime `db:"last_reply_at"`
+}
+
+func (t ThreadSummary) ToFiberMap() fiber.Map {
+	var lastReplyAt *string = nil
+
+	if t.LastReplyAt.Valid {
+		s := t.LastReplyAt.Time.Format(time.RFC3339)
+		lastReplyAt = &s
+	}
+
+	return fiber.Map{
+		"reply_count":   t.ReplyCount,
+		"last_reply_at": lastReplyAt,
+	}
+}
+
+// Counts the replies under each of the parent messages, deleted replies aren't counted.
+// Parents without any replies are missing from the map.
+func ThreadSummaries(parentIds []uint64, db *sqlx.DB) (map[uint64]ThreadSummary, error) {
+
+	summaries := make(map[uint64]ThreadSummary)
+
+	if len(parentIds) == 0 {
+		return summaries, nil
+	}
+
+	q := `
+	SELECT m.parent_id, COUNT(*) AS reply_count, MAX(m.created_at) AS last_reply_at
+	FROM messages m
+	INNER JOIN messages p ON p.id = m.parent_id AND p.channel_id = m.channel_id
+	WHERE m.parent_id IN (?)
+	AND m.deleted = 0
+	GROUP BY m.parent_id`
+
+	tq, tArgs, err := sqlx.In(q, parentIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []ThreadSummary{}
+
+	err = db.Select(&rows, db.Rebind(tq), tArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rows {
+		summaries[r.ParentID] = r
+	}
+
+	return summaries, nil
+}
+
+// The topic clients subscribe to for live replies to a message
+func ThreadTopic(parent model.Messages) string {
+	return security_helpers.Encode(parent.ID, model.MESSAGES_TYPE, parent.Salt)
+}
+
+// Sends a new reply to anyone watching the thread, and the parent's new reply count to the channel
+func BroadcastThreadReply(parent model.Messages, channel model.Channels, reply fiber.Map, db *sqlx.DB) {
+	internal_handlers.SendBroadcast(ThreadTopic(parent), reply)
+
+	BroadcastThreadUpdated(parent, channel, db)
+}
+
+// Tells the channel how many replies a message has now
+func BroadcastThreadUpdated(parent model.Messages, channel model.Channels, db *sqlx.DB) {
+	threads, err := ThreadSummaries([]uint64{parent.ID}, db)
+
+	if err != nil {
+		slog.Error("Couldn't count thread replies 💀",
+			slog.String("error", err.Error()),
+			slog.Uint64("mId", parent.ID))
+
+		return
+	}
+
+	thread := ThreadSummary{ParentID: parent.ID}
+
+	if t, found := threads[parent.ID]; found {
+		thread = t
+	}
+
+	event := fiber.Map{
+		"type":       "thread.updated",
+		"id":         security_helpers.Encode(parent.ID, model.MESSAGES_TYPE, parent.Salt),
+		"channel_id": security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt),
+	}
+
+	maps.Copy(event, thread.ToFiberMap())
+
+	internal_handlers.SendBroadcast(security_helpers.Encode(channel.ID, model.CHANNELS_TYPE, channel.Salt), event)
+}
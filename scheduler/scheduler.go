@@ -48,14 +48,28 @@ func main() {
 		panic(err)
 	}
 
+	rdb := redis.NewClient(writeRedisOpts)
+
+	defer rdb.Close()
+
+	redisOpt := asynq.RedisClientOpt{
+		Network:  writeRedisOpts.Network,
+		Addr:     writeRedisOpts.Addr,
+		Username: writeRedisOpts.Username,
+		Password: writeRedisOpts.Password,
+		DB:       writeRedisOpts.DB,
+	}
+
+	// One-off jobs aren't reachable over http, they're queued from here and picked up by the
+	// running workers, e.g. go run scheduler.go rebuild-search-index
+	if len(os.Args) > 1 {
+		enqueueCommand(os.Args[1], redisOpt)
+
+		return
+	}
+
 	srv := asynq.NewServer(
-		asynq.RedisClientOpt{
-			Network:  writeRedisOpts.Network,
-			Addr:     writeRedisOpts.Addr,
-			Username: writeRedisOpts.Username,
-			Password: writeRedisOpts.Password,
-			DB:       writeRedisOpts.DB,
-		},
+		redisOpt,
 		asynq.Config{
 			Concurrency: 10,
 			Queues: map[string]int{
@@ -66,6 +80,27 @@ func main() {
 		},
 	)
 
+	periodic := asynq.NewScheduler(redisOpt, nil)
+
+	// Unique keeps a slow purge from overlapping the next one
+	_, err = periodic.Register("@every 1h", tasks.NewPurgeExpiredMessagesTask(), asynq.Queue("low"), asynq.Unique(time.Hour))
+
+	if err != nil {
+		slog.Error("Unable to register purge",
+			slog.String("error", err.Error()))
+
+		panic(err)
+	}
+
+	if err := periodic.Start(); err != nil {
+		slog.Error("Unable to start periodic tasks",
+			slog.String("error", err.Error()))
+
+		panic(err)
+	}
+
+	defer periodic.Shutdown()
+
 	mux := asynq.NewServeMux()
 
 	mux.HandleFunc(tasks.TypeEmailDelivery, tasks.HandleEmailDeliveryTask)
@@ -78,8 +113,63 @@ func main() {
 		return tasks.HandleDeleteCommunityTask(ctx, t, db)
 	})
 
+	mux.HandleFunc(tasks.TypeRebuildSearchIndex, func(ctx context.Context, t *asynq.Task) error {
+		return tasks.HandleRebuildSearchIndexTask(ctx, t, db)
+	})
+
+	mux.HandleFunc(tasks.TypeImportReactions, func(ctx context.Context, t *asynq.Task) error {
+		return tasks.HandleImportReactionsTask(ctx, t, db, rdb)
+	})
+
+	mux.HandleFunc(tasks.TypeClosePoll, func(ctx context.Context, t *asynq.Task) error {
+		return tasks.HandleClosePollTask(ctx, t, db)
+	})
+
+	mux.HandleFunc(tasks.TypeSendScheduledMessage, func(ctx context.Context, t *asynq.Task) error {
+		return tasks.HandleSendScheduledMessageTask(ctx, t, db, rdb)
+	})
+
+	mux.HandleFunc(tasks.TypePurgeExpiredMessages, func(ctx context.Context, t *asynq.Task) error {
+		return tasks.HandlePurgeExpiredMessagesTask(ctx, t, db, rdb)
+	})
+
 	if err := srv.Run(mux); err != nil {
 		slog.Error("Scheduler crashed",
 			slog.String("error", err.Error()))
 	}
 }
+
+func enqueueCommand(command string, redisOpt asynq.RedisClientOpt) {
+	client := asynq.NewClient(redisOpt)
+
+	defer client.Close()
+
+	var task *asynq.Task
+	var err error
+
+	switch command {
+	case "rebuild-search-index":
+		task, err = tasks.NewRebuildSearchIndexTask()
+	case "import-reactions":
+		task, err = tasks.NewImportReactionsTask()
+	default:
+		slog.Error("Unknown command", slog.String("command", command))
+
+		os.Exit(1)
+	}
+
+	if err == nil {
+		// These lock or scan large tables, so only one of each can be queued at a time
+		_, err = client.Enqueue(task, asynq.Queue("low"), asynq.Unique(1*time.Hour))
+	}
+
+	if err != nil {
+		slog.Error("Unable to queue command",
+			slog.String("command", command),
+			slog.String("error", err.Error()))
+
+		os.Exit(1)
+	}
+
+	slog.Info("Queued command ✅", slog.String("command", command))
+}
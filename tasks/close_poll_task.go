@@ -0,0 +1,86 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+)
+
+const (
+	TypeClosePoll = "poll:close"
+)
+
+type ClosePollPayload struct {
+	PollID uint64
+}
+
+func NewClosePollTask(pollId uint64) (*asynq.Task, error) {
+	payload, err := json.Marshal(ClosePollPayload{PollID: pollId})
+
+	slog.Info("Scheduling poll close")
+
+	if err != nil {
+		slog.Error("Unable to schedule poll close",
+			slog.String("error", err.Error()))
+
+		return nil, err
+	}
+
+	return asynq.NewTask(TypeClosePoll, payload), nil
+}
+
+// The task id keeps a poll from having its close scheduled twice
+func ClosePollTaskID(pollId uint64) string {
+	return fmt.Sprintf("poll-close-%d", pollId)
+}
+
+func HandleClosePollTask(ctx context.Context, t *asynq.Task, db *sqlx.DB) error {
+	slog.Info("Closing poll ✅")
+
+	var p ClosePollPayload
+
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		slog.Error("Could not close poll",
+			slog.String("error", err.Error()))
+
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+
+	res, err := db.ExecContext(ctx, "UPDATE polls SET closed = 1, closed_at = ? WHERE id = ? AND closed = 0", time.Now(), p.PollID)
+
+	if err != nil {
+		return fmt.Errorf("close poll failed: %v", err)
+	}
+
+	closed, err := res.RowsAffected()
+
+	if err != nil {
+		return fmt.Errorf("close poll failed: %v", err)
+	}
+
+	// Already closed, or the message was deleted along with its poll
+	if closed == 0 {
+		return nil
+	}
+
+	poll := model.Polls{}
+
+	err = db.GetContext(ctx, &poll, "SELECT * FROM polls WHERE id = ? LIMIT 1", p.PollID)
+
+	if err != nil {
+		return fmt.Errorf("close poll failed: %v", err)
+	}
+
+	message_helpers.BroadcastPoll(poll, "poll.closed", db)
+
+	slog.Info("Closed poll ✅", slog.Uint64("pId", poll.ID))
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	TypeImportReactions = "reactions:import"
+)
+
+func NewImportReactionsTask() (*asynq.Task, error) {
+	slog.Info("Scheduling reactions import")
+
+	return asynq.NewTask(TypeImportReactions, nil), nil
+}
+
+// Reactions used to only be stored in redis. This copies any that are still there into the
+// reactions table up front, reads and writes import the rest as they come across them.
+func HandleImportReactionsTask(ctx context.Context, t *asynq.Task, db *sqlx.DB, rdb *redis.Client) error {
+	slog.Info("Importing reactions ✅")
+
+	var scanned uint64
+
+	iter := rdb.Scan(ctx, 0, "message-reactions-*", 500).Iterator()
+
+	for iter.Next(ctx) {
+		key := iter.Val()
+
+		messageId, err := strconv.ParseUint(strings.TrimPrefix(key, "message-reactions-"), 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		err = message_helpers.ImportLegacyReactions(messageId, db, rdb, ctx)
+
+		if err != nil {
+			slog.Error("Unable to import reactions 💀",
+				slog.String("error", err.Error()),
+				slog.Uint64("mId", messageId))
+
+			return fmt.Errorf("import reactions failed: %v", err)
+		}
+
+		scanned++
+	}
+
+	if err := iter.Err(); err != nil {
+		slog.Error("Unable to scan reactions 💀",
+			slog.String("error", err.Error()))
+
+		return fmt.Errorf("import reactions failed: %v", err)
+	}
+
+	slog.Info("Imported reactions ✅", slog.Uint64("messages", scanned))
+
+	return nil
+}
@@ -0,0 +1,318 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	TypePurgeExpiredMessages = "message:purge-expired"
+)
+
+// Messages purged per transaction
+const purgeBatchSize = 500
+
+// Runs from the scheduler's periodic tasks, there's no payload
+func NewPurgeExpiredMessagesTask() *asynq.Task {
+	return asynq.NewTask(TypePurgeExpiredMessages, nil)
+}
+
+type purgeSummary struct {
+	channels       int
+	deleted        int
+	stubbed        int
+	files          int
+	filesFailed    int
+	channelsFailed int
+}
+
+// Deletes messages older than their channel's retention, with their files, reactions, mentions, pins,
+// revisions and polls. An expired message that still has replies inside the window becomes a thread stub,
+// a tombstone like a deleted message, and is removed on a later run once its replies have expired too.
+func HandlePurgeExpiredMessagesTask(ctx context.Context, t *asynq.Task, db *sqlx.DB, rdb *redis.Client) error {
+	slog.Info("Purging expired messages ✅")
+
+	startedAt := time.Now()
+
+	cq := `
+	SELECT channels.*
+	FROM channels
+	JOIN communities ON communities.id = channels.community_id
+	WHERE channels.retention_days > 0
+	OR communities.retention_days > 0`
+
+	channels := []model.Channels{}
+
+	err := db.SelectContext(ctx, &channels, cq)
+
+	if err != nil {
+		return fmt.Errorf("purge expired messages failed: %v", err)
+	}
+
+	if len(channels) == 0 {
+		slog.Info("No channels with retention, nothing to purge ✅")
+
+		return nil
+	}
+
+	var communityIds = []uint64{}
+
+	for _, ch := range channels {
+		communityIds = append(communityIds, ch.CommunityID)
+	}
+
+	q, args, err := sqlx.In("SELECT * FROM communities WHERE id IN (?)", communityIds)
+
+	if err != nil {
+		return fmt.Errorf("purge expired messages failed: %v", err)
+	}
+
+	communities := []model.Communities{}
+
+	err = db.SelectContext(ctx, &communities, db.Rebind(q), args...)
+
+	if err != nil {
+		return fmt.Errorf("purge expired messages failed: %v", err)
+	}
+
+	communitiesMap := make(map[uint64]model.Communities)
+
+	for _, cm := range communities {
+		communitiesMap[cm.ID] = cm
+	}
+
+	summary := purgeSummary{}
+
+	for _, channel := range channels {
+		days := channel.EffectiveRetentionDays(communitiesMap[channel.CommunityID])
+
+		if days == 0 {
+			continue
+		}
+
+		summary.channels++
+
+		cutoff := startedAt.Add(-time.Duration(days) * 24 * time.Hour)
+
+		err = purgeChannel(ctx, channel, cutoff, db, rdb, &summary)
+
+		// One channel failing shouldn't hold the rest back, the next run picks it up again
+		if err != nil {
+			summary.channelsFailed++
+
+			slog.Error("Couldn't purge channel 💀",
+				slog.String("error", err.Error()),
+				slog.Uint64("cId", channel.ID))
+		}
+	}
+
+	slog.Info("Purged expired messages ✅",
+		slog.Int("channels", summary.channels),
+		slog.Int("channels_failed", summary.channelsFailed),
+		slog.Int("messages_deleted", summary.deleted),
+		slog.Int("thread_stubs", summary.stubbed),
+		slog.Int("files_deleted", summary.files),
+		slog.Int("files_failed", summary.filesFailed),
+		slog.Duration("took", time.Since(startedAt)))
+
+	return nil
+}
+
+func purgeChannel(ctx context.Context, channel model.Channels, cutoff time.Time, db *sqlx.DB, rdb *redis.Client, summary *purgeSummary) error {
+
+	var lastId uint64 = 0
+
+	for {
+		messages := []model.Messages{}
+
+		mq := `
+		SELECT *
+		FROM messages
+		WHERE channel_id = ?
+		AND created_at < ?
+		AND id > ?
+		ORDER BY id ASC
+		LIMIT ?`
+
+		err := db.SelectContext(ctx, &messages, mq, channel.ID, cutoff, lastId, purgeBatchSize)
+
+		if err != nil {
+			return err
+		}
+
+		if len(messages) == 0 {
+			return nil
+		}
+
+		lastId = messages[len(messages)-1].ID
+
+		err = purgeMessages(ctx, messages, cutoff, db, rdb, summary)
+
+		if err != nil {
+			return err
+		}
+
+		if len(messages) < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+func purgeMessages(ctx context.Context, messages []model.Messages, cutoff time.Time, db *sqlx.DB, rdb *redis.Client, summary *purgeSummary) error {
+
+	var messageIds = []uint64{}
+
+	for _, m := range messages {
+		messageIds = append(messageIds, m.ID)
+	}
+
+	// Parents with replies still inside the window are kept as stubs so the thread has something to hang off
+	rq, rArgs, err := sqlx.In("SELECT DISTINCT parent_id FROM messages WHERE parent_id IN (?) AND created_at >= ?", messageIds, cutoff)
+
+	if err != nil {
+		return err
+	}
+
+	parentIds := []uint64{}
+
+	err = db.SelectContext(ctx, &parentIds, db.Rebind(rq), rArgs...)
+
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[uint64]bool)
+
+	for _, id := range parentIds {
+		keep[id] = true
+	}
+
+	var deleteIds = []uint64{}
+	var stubIds = []uint64{}
+
+	for _, m := range messages {
+		if !keep[m.ID] {
+			deleteIds = append(deleteIds, m.ID)
+		} else if !m.Deleted {
+			stubIds = append(stubIds, m.ID)
+		}
+	}
+
+	fq, fArgs, err := sqlx.In("SELECT * FROM files WHERE message_id IN (?)", messageIds)
+
+	if err != nil {
+		return err
+	}
+
+	files := []model.Files{}
+
+	err = db.SelectContext(ctx, &files, db.Rebind(fq), fArgs...)
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		"DELETE FROM files WHERE message_id IN (?)",
+		"DELETE FROM messages_mentions WHERE message_id IN (?)",
+		"DELETE FROM users_mentions WHERE message_id IN (?)",
+		"DELETE FROM messages_pins WHERE message_id IN (?)",
+		"DELETE FROM messages_revisions WHERE message_id IN (?)",
+		"DELETE FROM reactions WHERE message_id IN (?)",
+		"DELETE FROM bookmarks WHERE message_id IN (?)",
+		"DELETE FROM automod_flags WHERE message_id IN (?)",
+		"DELETE polls_votes FROM polls_votes JOIN polls ON polls.id = polls_votes.poll_id WHERE polls.message_id IN (?)",
+		"DELETE polls_options FROM polls_options JOIN polls ON polls.id = polls_options.poll_id WHERE polls.message_id IN (?)",
+		"DELETE FROM polls WHERE message_id IN (?)",
+	}
+
+	for _, dq := range queries {
+		q, args, err := sqlx.In(dq, messageIds)
+
+		if err != nil {
+			tx.Rollback()
+
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, tx.Rebind(q), args...)
+
+		if err != nil {
+			tx.Rollback()
+
+			return err
+		}
+	}
+
+	if len(deleteIds) > 0 {
+		q, args, err := sqlx.In("DELETE FROM messages WHERE id IN (?)", deleteIds)
+
+		if err != nil {
+			tx.Rollback()
+
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, tx.Rebind(q), args...)
+
+		if err != nil {
+			tx.Rollback()
+
+			return err
+		}
+	}
+
+	if len(stubIds) > 0 {
+		deletedAt := time.Now()
+
+		q, args, err := sqlx.In("UPDATE messages SET text = '', deleted = 1, deleted_at = ?, updated_at = ? WHERE id IN (?)", deletedAt, deletedAt, stubIds)
+
+		if err != nil {
+			tx.Rollback()
+
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, tx.Rebind(q), args...)
+
+		if err != nil {
+			tx.Rollback()
+
+			return err
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range messageIds {
+		message_helpers.InvalidateReactions(id, db, rdb, ctx)
+	}
+
+	summary.deleted += len(deleteIds)
+	summary.stubbed += len(stubIds)
+
+	deleted, failed := message_helpers.DeleteStoredFiles(ctx, files)
+
+	summary.files += deleted
+	summary.filesFailed += failed
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	TypeRebuildSearchIndex = "search:rebuild-index"
+)
+
+func NewRebuildSearchIndexTask() (*asynq.Task, error) {
+	slog.Info("Scheduling search index rebuild")
+
+	return asynq.NewTask(TypeRebuildSearchIndex, nil), nil
+}
+
+func HandleRebuildSearchIndexTask(ctx context.Context, t *asynq.Task, db *sqlx.DB) error {
+	slog.Info("Rebuilding search index ✅")
+
+	// Dropping and adding in one statement means search is never left without an index
+	q := `
+	ALTER TABLE messages
+	DROP INDEX messages_text_ft_idx,
+	ADD FULLTEXT INDEX messages_text_ft_idx (text)`
+
+	_, err := db.ExecContext(ctx, q)
+
+	if err != nil {
+		slog.Error("Unable to rebuild search index 💀",
+			slog.String("error", err.Error()))
+
+		return fmt.Errorf("rebuild search index failed: %v", err)
+	}
+
+	slog.Info("Rebuilt search index ✅")
+
+	return nil
+}
@@ -0,0 +1,309 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jmoiron/sqlx"
+	"github.com/macwilko/exotic-auth/db/chat_users_db/model"
+	"github.com/macwilko/exotic-auth/internal_handlers"
+	"github.com/macwilko/exotic-auth/message_helpers"
+	"github.com/macwilko/exotic-auth/security_helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	TypeSendScheduledMessage = "message:send-scheduled"
+)
+
+// SendAt is checked against the stored send time, so a task left behind by an edit does nothing
+type SendScheduledMessagePayload struct {
+	ScheduledMessageID uint64
+	SendAt             int64
+}
+
+func NewSendScheduledMessageTask(scheduled model.ScheduledMessages) (*asynq.Task, error) {
+	payload, err := json.Marshal(SendScheduledMessagePayload{ScheduledMessageID: scheduled.ID, SendAt: scheduled.SendAt.Unix()})
+
+	slog.Info("Scheduling message send")
+
+	if err != nil {
+		slog.Error("Unable to schedule message send",
+			slog.String("error", err.Error()))
+
+		return nil, err
+	}
+
+	return asynq.NewTask(TypeSendScheduledMessage, payload), nil
+}
+
+// One task per scheduled message and send time
+func SendScheduledMessageTaskID(scheduled model.ScheduledMessages) string {
+	return fmt.Sprintf("scheduled-message-%d-%d", scheduled.ID, scheduled.SendAt.Unix())
+}
+
+func HandleSendScheduledMessageTask(ctx context.Context, t *asynq.Task, db *sqlx.DB, rdb *redis.Client) error {
+	slog.Info("Sending scheduled message ✅")
+
+	var p SendScheduledMessagePayload
+
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		slog.Error("Could not send scheduled message",
+			slog.String("error", err.Error()))
+
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: false})
+
+	if err != nil {
+		return fmt.Errorf("send scheduled message failed: %v", err)
+	}
+
+	scheduled := model.ScheduledMessages{}
+
+	// Locks the row so a retry running alongside can't send it twice
+	err = tx.Get(&scheduled, "SELECT * FROM scheduled_messages WHERE id = ? FOR UPDATE", p.ScheduledMessageID)
+
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+
+		slog.Info("Scheduled message was cancelled ✅")
+
+		return nil
+	}
+
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("send scheduled message failed: %v", err)
+	}
+
+	if !scheduled.IsPending() || scheduled.SendAt.Unix() != p.SendAt {
+		tx.Rollback()
+
+		slog.Info("Scheduled message already sent or rescheduled ✅")
+
+		return nil
+	}
+
+	// The author might have lost access since they scheduled it
+	fail := func(reason string) error {
+		_, err := tx.Exec("UPDATE scheduled_messages SET failed_at = ?, failure = ? WHERE id = ?", time.Now(), reason, scheduled.ID)
+
+		if err != nil {
+			tx.Rollback()
+
+			return fmt.Errorf("send scheduled message failed: %v", err)
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			return fmt.Errorf("send scheduled message failed: %v", err)
+		}
+
+		slog.Warn("Couldn't send scheduled message 💀",
+			slog.String("reason", reason),
+			slog.Uint64("sId", scheduled.ID))
+
+		broadcastScheduledMessageFailed(scheduled, reason, db)
+
+		return nil
+	}
+
+	cU := model.CommunitiesUsers{}
+
+	err = tx.Get(&cU, "SELECT * FROM communities_users WHERE user_id = ? AND community_id = ?", scheduled.UserID, scheduled.CommunityID)
+
+	if err == sql.ErrNoRows {
+		return fail("Not allowed.")
+	}
+
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("send scheduled message failed: %v", err)
+	}
+
+	if cU.TimeoutRemaining() > 0 {
+		return fail("Timed out of this community.")
+	}
+
+	channel := model.Channels{}
+
+	err = tx.Get(&channel, "SELECT * FROM channels WHERE id = ? AND community_id = ? LIMIT 1", scheduled.ChannelID, scheduled.CommunityID)
+
+	if err == sql.ErrNoRows {
+		return fail("Channel not found.")
+	}
+
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("send scheduled message failed: %v", err)
+	}
+
+	// Checked the same way as sending now, overwrites on the channel or its group can take
+	// sending away and a private channel is closed to anyone not let in
+	channelBits, err := message_helpers.ChannelBits(tx, channel, []model.CommunitiesUsers{cU})
+
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("send scheduled message failed: %v", err)
+	}
+
+	channelPermissions := model.PermissionsFromBits(channelBits[cU.UserID])
+
+	if !channelPermissions.Has(model.ViewChannels) || !channelPermissions.Has(model.SendMessages) {
+		return fail("Not allowed.")
+	}
+
+	// Scheduled sends go through automod the same as sending now, checked against the rules at send time
+	flaggedBy := []model.AutomodRules{}
+
+	if !cU.HasCommunityPermission(model.ManageCommunity) {
+		rules, err := message_helpers.LoadAutomodRules(scheduled.CommunityID, db, rdb, rdb, ctx)
+
+		if err != nil {
+			slog.Error("Couldn't load automod rules 💀",
+				slog.String("error", err.Error()))
+		}
+
+		strongest, flagged := message_helpers.EvaluateAutomod(rules, scheduled.Text)
+
+		if strongest != nil && strongest.Action == model.AUTOMOD_TIMEOUT {
+			_, err = message_helpers.TimeoutMember(scheduled.UserID, scheduled.CommunityID, time.Duration(strongest.TimeoutSeconds)*time.Second, db, rdb, ctx)
+
+			if err != nil {
+				slog.Error("Couldn't time out member 💀",
+					slog.String("error", err.Error()))
+			}
+		}
+
+		if strongest != nil && strongest.Action != model.AUTOMOD_FLAG {
+			return fail("Blocked by automod rule " + strongest.Name + ".")
+		}
+
+		flaggedBy = flagged
+	}
+
+	parent := model.Messages{}
+
+	if scheduled.ParentID > 0 {
+		err = tx.Get(&parent, "SELECT * FROM messages WHERE id = ? AND community_id = ? AND channel_id = ? AND deleted = 0 LIMIT 1", scheduled.ParentID, scheduled.CommunityID, scheduled.ChannelID)
+
+		if err == sql.ErrNoRows {
+			return fail("Message being replied to was deleted.")
+		}
+
+		if err != nil {
+			tx.Rollback()
+
+			return fmt.Errorf("send scheduled message failed: %v", err)
+		}
+	}
+
+	// Channels the author can't see aren't mentioned, each one is checked with its own overwrites
+	canViewChannel := func(ch model.Channels) bool {
+		bits, err := message_helpers.ChannelBits(tx, ch, []model.CommunitiesUsers{cU})
+
+		return err == nil && bits[cU.UserID]&model.ViewChannels.Bit() != 0
+	}
+
+	message, mentionedUserIds, err := message_helpers.InsertMessage(tx, model.Messages{
+		CreatedAt:   time.Now(),
+		Salt:        uuid.New().String(),
+		CommunityID: scheduled.CommunityID,
+		ChannelID:   scheduled.ChannelID,
+		UserID:      scheduled.UserID,
+		Text:        scheduled.Text,
+		ParentID:    scheduled.ParentID,
+	}, channelPermissions.Has(model.MentionRoles), canViewChannel, db)
+
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("send scheduled message failed: %v", err)
+	}
+
+	_, err = tx.Exec("UPDATE scheduled_messages SET sent_at = ?, message_id = ? WHERE id = ?", message.CreatedAt, message.ID, scheduled.ID)
+
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("send scheduled message failed: %v", err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return fmt.Errorf("send scheduled message failed: %v", err)
+	}
+
+	message_helpers.CacheChannelSeq(message.ChannelID, message.Seq, rdb, ctx)
+	message_helpers.CacheSentReadMarker(message, rdb, ctx)
+
+	if len(flaggedBy) > 0 {
+		message_helpers.SaveAutomodFlags(message, flaggedBy, db)
+	}
+
+	newMessage := model.Messages{}
+
+	err = db.Get(&newMessage, "SELECT * FROM messages WHERE id = ? LIMIT 1", message.ID)
+
+	// The message is sent, only the live update is lost
+	if err != nil {
+		slog.Error("Couldn't find scheduled message after sending 💀",
+			slog.String("error", err.Error()))
+
+		return nil
+	}
+
+	mapped, err := message_helpers.MapMessages([]model.Messages{newMessage}, scheduled.CommunityID, message_helpers.PublicChannels, db, rdb, rdb, ctx)
+
+	if err != nil {
+		slog.Error("Couldn't map scheduled message 💀",
+			slog.String("error", err.Error()))
+
+		return nil
+	}
+
+	err = message_helpers.MarkContinuations([]model.Messages{newMessage}, mapped, db)
+
+	if err != nil {
+		slog.Error("Couldn't group scheduled message 💀",
+			slog.String("error", err.Error()))
+	}
+
+	message_helpers.BroadcastNewMessage(newMessage, mapped[0], channel, parent, mentionedUserIds, db, rdb, rdb, ctx)
+
+	slog.Info("Sent scheduled message ✅", slog.Uint64("mId", newMessage.ID))
+
+	return nil
+}
+
+// Lets the author know their scheduled message didn't go out
+func broadcastScheduledMessageFailed(scheduled model.ScheduledMessages, reason string, db *sqlx.DB) {
+	user := model.Users{}
+
+	err := db.Get(&user, "SELECT * FROM users WHERE id = ? LIMIT 1", scheduled.UserID)
+
+	if err != nil {
+		return
+	}
+
+	internal_handlers.SendBroadcast(message_helpers.UserTopic(user), fiber.Map{
+		"type":    "scheduled_message.failed",
+		"id":      security_helpers.Encode(scheduled.ID, model.SCHEDULED_MESSAGES_TYPE, scheduled.Salt),
+		"failure": reason,
+	})
+}